@@ -0,0 +1,215 @@
+package anvil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Chunk compression types. CompressionExternal is set in addition to the
+// type when the chunk is stored in a separate c.<x>.<z>.mcc file.
+const (
+	CompressionGzip     = 1
+	CompressionZlib     = 2
+	CompressionNone     = 3
+	CompressionLZ4      = 4
+	CompressionCustom   = 127
+	CompressionExternal = 0x80
+)
+
+// nbtCompound is the tag type every chunk starts with.
+const nbtCompound = 10
+
+// timestampSlack is how far in the future a chunk timestamp may be before
+// it is considered corrupt, to tolerate clock adjustments.
+const timestampSlack = 24 * time.Hour
+
+// Problem is a defect found in a region file.
+type Problem struct {
+	Chunk   int // Index of the chunk, -1 for the file as a whole
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Chunk < 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("chunk %d,%d: %s", p.Chunk%32, p.Chunk/32, p.Message)
+}
+
+// CheckResult is the outcome of checking a region file.
+type CheckResult struct {
+	Chunks   int // Chunks present in the file
+	Problems []Problem
+}
+
+func (r *CheckResult) add(chunk int, format string, args ...any) {
+	r.Problems = append(r.Problems, Problem{Chunk: chunk, Message: fmt.Sprintf(format, args...)})
+}
+
+// CheckFile checks the region file at path, including the external chunk
+// files next to it.
+func CheckFile(path string) (*CheckResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	external := func(i int) ([]byte, error) {
+		x, z, ok := ParseRegionName(filepath.Base(path))
+		if !ok {
+			return nil, fmt.Errorf("cannot locate external chunk of %s", filepath.Base(path))
+		}
+		pos := ChunkAt(x, z, i)
+		return os.ReadFile(filepath.Join(filepath.Dir(path), fmt.Sprintf("c.%d.%d.mcc", pos.X, pos.Z)))
+	}
+	return Check(f, fi.Size(), external, time.Now())
+}
+
+// Check validates a region file of size bytes: the header tables, that
+// chunks lie within the file without overlapping, their compression types,
+// and that every chunk decompresses to NBT data. external reads the data of
+// chunks stored outside the region file. Chunks compressed with LZ4 or a
+// custom algorithm are only checked for their bounds.
+func Check(r io.ReaderAt, size int64, external func(chunk int) ([]byte, error), now time.Time) (*CheckResult, error) {
+	result := &CheckResult{}
+	if size == 0 {
+		// The server creates empty region files before saving chunks
+		return result, nil
+	}
+	if size < HeaderSize {
+		result.add(-1, "file is %d bytes, shorter than the header", size)
+		return result, nil
+	}
+	if size%SectorSize != 0 {
+		result.add(-1, "file is %d bytes, not a multiple of the sector size", size)
+	}
+
+	var header Header
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	sectors := uint32((size + SectorSize - 1) / SectorSize)
+	owners := make([]int16, sectors)
+	latest := uint32(now.Add(timestampSlack).Unix())
+
+	for i := 0; i < ChunksPerRegion; i++ {
+		offset, count := header.Location(i)
+		if offset == 0 && count == 0 {
+			continue
+		}
+		result.Chunks++
+		if ts := header.Timestamp(i); ts > latest {
+			result.add(i, "timestamp %d lies in the future", ts)
+		}
+		switch {
+		case count == 0:
+			result.add(i, "location entry has no sectors")
+			continue
+		case offset < HeaderSize/SectorSize:
+			result.add(i, "sectors %d-%d overlap the header", offset, offset+count-1)
+			continue
+		case offset+count > sectors:
+			result.add(i, "sectors %d-%d lie beyond the end of the file (%d sectors)", offset, offset+count-1, sectors)
+			continue
+		}
+		overlapping := false
+		for s := offset; s < offset+count; s++ {
+			if owners[s] != 0 {
+				if !overlapping {
+					other := int(owners[s]) - 1
+					result.add(i, "sectors overlap chunk %d,%d", other%32, other/32)
+				}
+				overlapping = true
+				continue
+			}
+			owners[s] = int16(i + 1)
+		}
+		if overlapping {
+			continue
+		}
+
+		data := make([]byte, int64(count)*SectorSize)
+		if _, err := r.ReadAt(data, int64(offset)*SectorSize); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read chunk %d: %w", i, err)
+		}
+		checkChunk(result, i, data, external)
+	}
+	return result, nil
+}
+
+// checkChunk validates the stored data of chunk i.
+func checkChunk(result *CheckResult, i int, data []byte, external func(chunk int) ([]byte, error)) {
+	length := binary.BigEndian.Uint32(data)
+	if length == 0 {
+		result.add(i, "chunk length is zero")
+		return
+	}
+	if int64(length) > int64(len(data))-4 {
+		result.add(i, "chunk length %d exceeds its %d sectors", length, len(data)/SectorSize)
+		return
+	}
+	compression := data[4]
+	payload := data[5 : 4+length]
+	if compression&CompressionExternal != 0 {
+		compression &^= CompressionExternal
+		if external == nil {
+			result.add(i, "chunk is stored externally")
+			return
+		}
+		var err error
+		if payload, err = external(i); err != nil {
+			result.add(i, "external chunk file: %v", err)
+			return
+		}
+	}
+
+	var reader io.Reader
+	switch compression {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			result.add(i, "invalid gzip data: %v", err)
+			return
+		}
+		reader = zr
+	case CompressionZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			result.add(i, "invalid zlib data: %v", err)
+			return
+		}
+		reader = zr
+	case CompressionNone:
+		reader = bytes.NewReader(payload)
+	case CompressionLZ4, CompressionCustom:
+		return
+	default:
+		result.add(i, "unknown compression type %d", compression)
+		return
+	}
+
+	var first [1]byte
+	if _, err := io.ReadFull(reader, first[:]); err != nil {
+		result.add(i, "chunk data is empty: %v", err)
+		return
+	}
+	if first[0] != nbtCompound {
+		result.add(i, "chunk data does not start with an NBT compound")
+		return
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		result.add(i, "chunk data does not decompress: %v", err)
+	}
+}
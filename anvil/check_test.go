@@ -0,0 +1,102 @@
+package anvil
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkSector returns a sector holding a chunk of the given compression.
+func chunkSector(t *testing.T, compression byte, data []byte) []byte {
+	t.Helper()
+	if compression == CompressionZlib {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data = buf.Bytes()
+	}
+	sector := make([]byte, SectorSize)
+	binary.BigEndian.PutUint32(sector, uint32(len(data)+1))
+	sector[4] = compression
+	copy(sector[5:], data)
+	return sector
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	region := make([]byte, HeaderSize)
+	locate := func(i int, offset uint32, count uint32, timestamp uint32) {
+		binary.BigEndian.PutUint32(region[4*i:], offset<<8|count)
+		binary.BigEndian.PutUint32(region[SectorSize+4*i:], timestamp)
+	}
+	nbt := []byte{nbtCompound, 0, 0, 0}
+
+	locate(0, 2, 1, uint32(now.Unix()))
+	region = append(region, chunkSector(t, CompressionZlib, nbt)...)
+	locate(1, 3, 1, 0)
+	region = append(region, chunkSector(t, CompressionNone, nbt)...)
+	locate(2, 4, 1, 0)
+	region = append(region, chunkSector(t, 9, nbt)...)
+	locate(3, 5, 1, 0)
+	region = append(region, chunkSector(t, CompressionZlib, []byte("garbage"))[:SectorSize]...)
+	region[5*SectorSize+5] = 0xff // Corrupt the zlib header
+	locate(4, 3, 1, 0)            // Overlaps chunk 1
+	locate(5, 1, 1, 0)            // Overlaps the header
+	locate(6, 9, 2, 0)            // Beyond the end
+	locate(7, 2, 1, uint32(now.Add(48*time.Hour).Unix()))
+	locate(32, 6, 1, 0)
+	region = append(region, chunkSector(t, CompressionExternal|CompressionNone, nil)...)
+
+	external := func(i int) ([]byte, error) {
+		if i != 32 {
+			t.Fatalf("unexpected external chunk %d", i)
+		}
+		return nbt, nil
+	}
+	result, err := Check(bytes.NewReader(region), int64(len(region)), external, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Chunks != 9 {
+		t.Fatalf("unexpected chunk count: want 9, got %d", result.Chunks)
+	}
+
+	var got []string
+	for _, problem := range result.Problems {
+		got = append(got, problem.String())
+	}
+	want := []string{
+		"chunk 2,0: unknown compression type 9",
+		"chunk 3,0: invalid zlib data",
+		"chunk 4,0: sectors overlap chunk 1,0",
+		"chunk 5,0: sectors 1-1 overlap the header",
+		"chunk 6,0: sectors 9-10 lie beyond the end of the file (7 sectors)",
+		"chunk 7,0: timestamp",
+		"chunk 7,0: sectors overlap chunk 0,0",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected problems: want %d, got %q", len(want), got)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Fatalf("unexpected problem %d: want %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestCheck_ShortFiles(t *testing.T) {
+	result, err := Check(bytes.NewReader(nil), 0, nil, time.Now())
+	if err != nil || len(result.Problems) != 0 {
+		t.Fatalf("expected an empty region file to be valid: %v, %v", err, result.Problems)
+	}
+	result, err = Check(bytes.NewReader(make([]byte, 100)), 100, nil, time.Now())
+	if err != nil || len(result.Problems) != 1 {
+		t.Fatalf("expected a truncated header to be reported: %v, %v", err, result.Problems)
+	}
+}
@@ -0,0 +1,63 @@
+package anvil
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Heatmap renders values per chunk as an image with scale pixels per
+// chunk, north up. Colors run from blue for the smallest to red for the
+// largest value on a logarithmic scale; chunks without a value stay
+// transparent.
+func Heatmap(values map[ChunkPos]int64, scale int) *image.NRGBA {
+	if len(values) == 0 {
+		return image.NewNRGBA(image.Rect(0, 0, 0, 0))
+	}
+	first := true
+	var minPos, maxPos ChunkPos
+	var maxValue int64
+	for pos, value := range values {
+		if first {
+			minPos, maxPos, first = pos, pos, false
+		}
+		minPos.X, minPos.Z = min(minPos.X, pos.X), min(minPos.Z, pos.Z)
+		maxPos.X, maxPos.Z = max(maxPos.X, pos.X), max(maxPos.Z, pos.Z)
+		maxValue = max(maxValue, value)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, (maxPos.X-minPos.X+1)*scale, (maxPos.Z-minPos.Z+1)*scale))
+	top := math.Log1p(float64(maxValue))
+	for pos, value := range values {
+		t := 1.0
+		if top > 0 {
+			t = math.Log1p(float64(max(value, 0))) / top
+		}
+		c := heatColor(t)
+		x0, z0 := (pos.X-minPos.X)*scale, (pos.Z-minPos.Z)*scale
+		for dz := 0; dz < scale; dz++ {
+			for dx := 0; dx < scale; dx++ {
+				img.SetNRGBA(x0+dx, z0+dz, c)
+			}
+		}
+	}
+	return img
+}
+
+// heatColor maps t in [0, 1] from blue over green and yellow to red.
+func heatColor(t float64) color.NRGBA {
+	stops := []color.NRGBA{
+		{0x30, 0x40, 0xc0, 0xff},
+		{0x30, 0xc0, 0x60, 0xff},
+		{0xf0, 0xe0, 0x30, 0xff},
+		{0xe0, 0x30, 0x20, 0xff},
+	}
+	t = math.Max(0, math.Min(1, t)) * float64(len(stops)-1)
+	i := min(int(t), len(stops)-2)
+	f := t - float64(i)
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*f + 0.5)
+	}
+	a, b := stops[i], stops[i+1]
+	return color.NRGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 0xff}
+}
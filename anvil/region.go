@@ -0,0 +1,132 @@
+// Package anvil reads Minecraft region files in the Anvil format.
+//
+// A region file holds 32x32 chunks. It starts with an 8KiB header: a
+// location table of 1024 big-endian entries holding the sector offset (3
+// bytes) and sector count (1 byte) of each chunk, followed by a table of
+// 1024 big-endian 32-bit timestamps. Chunk data is stored in 4KiB sectors
+// after the header.
+package anvil
+
+import (
+	"encoding/binary"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	SectorSize      = 4096
+	HeaderSize      = 2 * SectorSize
+	ChunksPerRegion = 32 * 32
+)
+
+// ChunkPos is the position of a chunk in a dimension, in chunk coordinates.
+type ChunkPos struct {
+	X, Z int
+}
+
+// Header is the header of a region file.
+type Header [HeaderSize]byte
+
+// Location returns the first sector and the number of sectors of the chunk
+// at index i. Both are zero for chunks that were never generated.
+func (h *Header) Location(i int) (offset uint32, count uint32) {
+	entry := binary.BigEndian.Uint32(h[4*i:])
+	return entry >> 8, entry & 0xff
+}
+
+// Timestamp returns the time chunk i was last saved, in Unix seconds.
+func (h *Header) Timestamp(i int) uint32 {
+	return binary.BigEndian.Uint32(h[SectorSize+4*i:])
+}
+
+// ChunksInRange returns the indexes of the chunks a write of length bytes
+// at offset touched: the location and timestamp entries it overwrote, and
+// the chunks whose sectors, according to h, it covers.
+func (h *Header) ChunksInRange(offset int64, length int64) []int {
+	end := offset + length
+	seen := make(map[int]bool)
+	var chunks []int
+	add := func(i int) {
+		if i >= 0 && i < ChunksPerRegion && !seen[i] {
+			seen[i] = true
+			chunks = append(chunks, i)
+		}
+	}
+
+	for _, table := range []int64{0, SectorSize} {
+		from, to := max(offset, table), min(end, table+SectorSize)
+		for pos := from - from%4; pos < to; pos += 4 {
+			add(int((pos - table) / 4))
+		}
+	}
+	if end > HeaderSize {
+		first := uint32(max(offset, HeaderSize) / SectorSize)
+		last := uint32((end - 1) / SectorSize)
+		for i := 0; i < ChunksPerRegion; i++ {
+			sector, count := h.Location(i)
+			if count > 0 && sector <= last && sector+count > first {
+				add(i)
+			}
+		}
+	}
+	return chunks
+}
+
+// ParseRegionName returns the region coordinates of a file named
+// r.<x>.<z>.mca.
+func ParseRegionName(name string) (x int, z int, ok bool) {
+	rest, ok := strings.CutPrefix(name, "r.")
+	if !ok {
+		return 0, 0, false
+	}
+	rest, ok = strings.CutSuffix(rest, ".mca")
+	if !ok {
+		return 0, 0, false
+	}
+	xs, zs, ok := strings.Cut(rest, ".")
+	if !ok {
+		return 0, 0, false
+	}
+	x, errX := strconv.Atoi(xs)
+	z, errZ := strconv.Atoi(zs)
+	if errX != nil || errZ != nil {
+		return 0, 0, false
+	}
+	return x, z, true
+}
+
+// ChunkAt returns the position of chunk i of region (x, z).
+func ChunkAt(regionX int, regionZ int, i int) ChunkPos {
+	return ChunkPos{X: regionX*32 + i%32, Z: regionZ*32 + i/32}
+}
+
+// Dimension names of the vanilla dimensions.
+const (
+	Overworld = "minecraft:overworld"
+	Nether    = "minecraft:the_nether"
+	End       = "minecraft:the_end"
+)
+
+// DimensionOf returns the dimension of a region file from its path, which
+// must be in a region directory: region/ for the overworld, DIM-1/region/
+// and DIM1/region/ for the nether and the end, and
+// dimensions/<namespace>/<name>/region/ for custom dimensions.
+func DimensionOf(p string) (string, bool) {
+	dir := path.Dir(p)
+	if path.Base(dir) != "region" {
+		return "", false
+	}
+	parts := strings.Split(path.Dir(dir), "/")
+	n := len(parts)
+	switch {
+	case n >= 3 && parts[n-3] == "dimensions":
+		return parts[n-2] + ":" + parts[n-1], true
+	case parts[n-1] == "DIM-1":
+		return Nether, true
+	case parts[n-1] == "DIM1":
+		return End, true
+	default:
+		return Overworld, true
+	}
+}
@@ -0,0 +1,75 @@
+package anvil
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHeader_ChunksInRange(t *testing.T) {
+	var h Header
+	// Chunk 0 in sectors 2-3, chunk 33 in sector 4
+	binary.BigEndian.PutUint32(h[0:], 2<<8|2)
+	binary.BigEndian.PutUint32(h[4*33:], 4<<8|1)
+
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           []int
+	}{
+		{"location entries", 4, 8, []int{1, 2}},
+		{"timestamp entry", SectorSize + 4*33, 4, []int{33}},
+		{"second sector of chunk 0", 3*SectorSize + 100, 10, []int{0}},
+		{"across chunks", 3 * SectorSize, 2 * SectorSize, []int{0, 33}},
+		{"unused sector", 9 * SectorSize, SectorSize, nil},
+	}
+	for _, tt := range tests {
+		got := h.ChunksInRange(tt.offset, tt.length)
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: unexpected chunks: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRegionNamesAndDimensions(t *testing.T) {
+	x, z, ok := ParseRegionName("r.3.-2.mca")
+	if !ok || x != 3 || z != -2 {
+		t.Fatalf("unexpected region: %d, %d, %v", x, z, ok)
+	}
+	if pos := ChunkAt(x, z, 33); pos != (ChunkPos{X: 97, Z: -63}) {
+		t.Fatalf("unexpected chunk position: %+v", pos)
+	}
+	if _, _, ok := ParseRegionName("level.dat"); ok {
+		t.Fatalf("expected level.dat not to be a region file")
+	}
+
+	for p, want := range map[string]string{
+		"worlds/world/region/r.0.0.mca":                  Overworld,
+		"worlds/world_nether/DIM-1/region/r.0.0.mca":     Nether,
+		"worlds/world_the_end/DIM1/region/r.0.0.mca":     End,
+		"world/dimensions/mymod/mining/region/r.0.0.mca": "mymod:mining",
+		"region/r.0.0.mca":                               Overworld,
+	} {
+		if got, ok := DimensionOf(p); !ok || got != want {
+			t.Fatalf("unexpected dimension of %s: want %q, got %q", p, want, got)
+		}
+	}
+	if _, ok := DimensionOf("world/entities/r.0.0.mca"); ok {
+		t.Fatalf("expected entities not to be a region directory")
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	img := Heatmap(map[ChunkPos]int64{{X: -1, Z: 0}: 10, {X: 2, Z: 1}: 1000}, 2)
+	if got := img.Bounds().Size(); got.X != 8 || got.Y != 4 {
+		t.Fatalf("unexpected size: %v", got)
+	}
+	if img.NRGBAAt(0, 0).A == 0 || img.NRGBAAt(2, 0).A != 0 {
+		t.Fatalf("unexpected pixels")
+	}
+	if c := img.NRGBAAt(7, 3); c.R < c.B {
+		t.Fatalf("expected the largest value to be red, got %v", c)
+	}
+}
@@ -0,0 +1,350 @@
+// Package nbt decodes Minecraft's Named Binary Tag format, as used by
+// level.dat, player data and chunks.
+package nbt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Tag types
+const (
+	TagEnd       = 0
+	TagByte      = 1
+	TagShort     = 2
+	TagInt       = 3
+	TagLong      = 4
+	TagFloat     = 5
+	TagDouble    = 6
+	TagByteArray = 7
+	TagString    = 8
+	TagList      = 9
+	TagCompound  = 10
+	TagIntArray  = 11
+	TagLongArray = 12
+)
+
+// maxDepth limits the nesting of lists and compounds.
+const maxDepth = 512
+
+// maxArrayLength limits the length of arrays and lists. They are grown while
+// reading rather than allocated up front, so a corrupt length does not
+// allocate more than the data actually holds.
+const maxArrayLength = 1 << 26
+
+// initialCapacity caps the capacity arrays and lists are allocated with
+// before their elements are read.
+const initialCapacity = 1024
+
+// ErrInvalid is wrapped by errors about malformed data.
+var ErrInvalid = errors.New("invalid NBT data")
+
+// Compound is a compound tag. Values are int8, int16, int32, int64,
+// float32, float64, []byte, string, List, Compound, []int32 or []int64.
+type Compound map[string]any
+
+// List is a list tag.
+type List []any
+
+// Decode reads a named root tag from r, which may be gzip or zlib
+// compressed.
+func Decode(r io.Reader) (name string, root Compound, err error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	var src io.Reader = br
+	switch {
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return "", nil, err
+		}
+		defer zr.Close()
+		src = zr
+	case magic[0] == 0x78:
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return "", nil, err
+		}
+		defer zr.Close()
+		src = zr
+	}
+	return DecodeUncompressed(src)
+}
+
+// DecodeUncompressed reads a named root compound from uncompressed data.
+func DecodeUncompressed(r io.Reader) (name string, root Compound, err error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	tagType, err := d.u8()
+	if err != nil {
+		return "", nil, err
+	}
+	if tagType != TagCompound {
+		return "", nil, fmt.Errorf("%w: root tag has type %d, not a compound", ErrInvalid, tagType)
+	}
+	if name, err = d.string(); err != nil {
+		return "", nil, err
+	}
+	value, err := d.payload(TagCompound, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, value.(Compound), nil
+}
+
+// ReadFile decodes the NBT file at path.
+func ReadFile(path string) (Compound, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, root, err := Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return root, nil
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	buf [8]byte
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return d.buf[:n], nil
+}
+
+func (d *decoder) u8() (byte, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) u16() (uint16, error) {
+	b, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *decoder) u32() (uint32, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *decoder) u64() (uint64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// length reads the length of an array or list.
+func (d *decoder) length() (int, error) {
+	n, err := d.u32()
+	if err != nil {
+		return 0, err
+	}
+	if int32(n) < 0 || n > maxArrayLength {
+		return 0, fmt.Errorf("%w: length %d out of range", ErrInvalid, int32(n))
+	}
+	return int(n), nil
+}
+
+// string reads a length-prefixed string. Strings use Java's modified UTF-8,
+// which only differs from UTF-8 for NUL and supplementary characters.
+func (d *decoder) string() (string, error) {
+	n, err := d.u16()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalid, io.ErrUnexpectedEOF)
+	}
+	return string(b), nil
+}
+
+func (d *decoder) payload(tagType byte, depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrInvalid)
+	}
+	switch tagType {
+	case TagByte:
+		v, err := d.u8()
+		return int8(v), err
+	case TagShort:
+		v, err := d.u16()
+		return int16(v), err
+	case TagInt:
+		v, err := d.u32()
+		return int32(v), err
+	case TagLong:
+		v, err := d.u64()
+		return int64(v), err
+	case TagFloat:
+		v, err := d.u32()
+		return math.Float32frombits(v), err
+	case TagDouble:
+		v, err := d.u64()
+		return math.Float64frombits(v), err
+	case TagByteArray:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(io.LimitReader(d.r, int64(n)))
+		if err == nil && len(b) != n {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return b, nil
+	case TagString:
+		return d.string()
+	case TagList:
+		elemType, err := d.u8()
+		if err != nil {
+			return nil, err
+		}
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		if elemType == TagEnd && n > 0 {
+			return nil, fmt.Errorf("%w: list of %d end tags", ErrInvalid, n)
+		}
+		list := make(List, 0, min(n, initialCapacity))
+		for i := 0; i < n; i++ {
+			v, err := d.payload(elemType, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case TagCompound:
+		c := make(Compound)
+		for {
+			childType, err := d.u8()
+			if err != nil {
+				return nil, err
+			}
+			if childType == TagEnd {
+				return c, nil
+			}
+			name, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if c[name], err = d.payload(childType, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	case TagIntArray:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		a := make([]int32, 0, min(n, initialCapacity))
+		for i := 0; i < n; i++ {
+			v, err := d.u32()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, int32(v))
+		}
+		return a, nil
+	case TagLongArray:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		a := make([]int64, 0, min(n, initialCapacity))
+		for i := 0; i < n; i++ {
+			v, err := d.u64()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, int64(v))
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown tag type %d", ErrInvalid, tagType)
+	}
+}
+
+// Compound returns the compound named name.
+func (c Compound) Compound(name string) (Compound, bool) {
+	v, ok := c[name].(Compound)
+	return v, ok
+}
+
+// List returns the list named name.
+func (c Compound) List(name string) (List, bool) {
+	v, ok := c[name].(List)
+	return v, ok
+}
+
+// String returns the string named name.
+func (c Compound) String(name string) (string, bool) {
+	v, ok := c[name].(string)
+	return v, ok
+}
+
+// Int returns the integer named name, of any integer tag type.
+func (c Compound) Int(name string) (int64, bool) {
+	switch v := c[name].(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Float returns the number named name, of any numeric tag type.
+func (c Compound) Float(name string) (float64, bool) {
+	switch v := c[name].(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	i, ok := c.Int(name)
+	return float64(i), ok
+}
+
+// Bool returns the byte named name as a boolean.
+func (c Compound) Bool(name string) (bool, bool) {
+	v, ok := c.Int(name)
+	return v != 0, ok
+}
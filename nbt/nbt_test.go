@@ -0,0 +1,145 @@
+package nbt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// builder writes NBT data for tests.
+type builder struct{ bytes.Buffer }
+
+func (b *builder) tag(tagType byte, name string) *builder {
+	b.WriteByte(tagType)
+	return b.str(name)
+}
+
+func (b *builder) str(s string) *builder {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+func (b *builder) be(v any) *builder {
+	binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+func sample() []byte {
+	b := &builder{}
+	b.tag(TagCompound, "")
+	b.tag(TagCompound, "Data")
+	b.tag(TagByte, "raining").be(int8(1))
+	b.tag(TagShort, "short").be(int16(-2))
+	b.tag(TagInt, "DataVersion").be(int32(4556))
+	b.tag(TagLong, "DayTime").be(int64(19_500_000))
+	b.tag(TagFloat, "float").be(math.Float32bits(1.5))
+	b.tag(TagDouble, "double").be(math.Float64bits(-0.25))
+	b.tag(TagByteArray, "bytes").be(int32(3)).Write([]byte{1, 2, 3})
+	b.tag(TagString, "LevelName").str("world ✓")
+	b.tag(TagList, "Pos").be(byte(TagDouble)).be(int32(2)).be(math.Float64bits(1)).be(math.Float64bits(2))
+	b.tag(TagList, "empty").be(byte(TagEnd)).be(int32(0))
+	b.tag(TagIntArray, "UUID").be(int32(2)).be(int32(-1)).be(int32(7))
+	b.tag(TagLongArray, "longs").be(int32(1)).be(int64(math.MinInt64))
+	b.WriteByte(TagEnd) // Data
+	b.WriteByte(TagEnd) // root
+	return b.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	want := Compound{"Data": Compound{
+		"raining":     int8(1),
+		"short":       int16(-2),
+		"DataVersion": int32(4556),
+		"DayTime":     int64(19_500_000),
+		"float":       float32(1.5),
+		"double":      float64(-0.25),
+		"bytes":       []byte{1, 2, 3},
+		"LevelName":   "world ✓",
+		"Pos":         List{float64(1), float64(2)},
+		"empty":       List{},
+		"UUID":        []int32{-1, 7},
+		"longs":       []int64{math.MinInt64},
+	}}
+
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(sample())
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(sample())
+	zw.Close()
+
+	for name, data := range map[string][]byte{"raw": sample(), "gzip": gz.Bytes(), "zlib": zl.Bytes()} {
+		_, root, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(root, want) {
+			t.Fatalf("%s: unexpected value: want %v, got %v", name, want, root)
+		}
+	}
+}
+
+func TestCompoundAccessors(t *testing.T) {
+	_, root, err := Decode(bytes.NewReader(sample()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, ok := root.Compound("Data")
+	if !ok {
+		t.Fatalf("expected a Data compound")
+	}
+	if v, ok := data.Int("DayTime"); !ok || v != 19_500_000 {
+		t.Fatalf("unexpected DayTime: %d, %v", v, ok)
+	}
+	if v, ok := data.Bool("raining"); !ok || !v {
+		t.Fatalf("unexpected raining: %v, %v", v, ok)
+	}
+	if v, ok := data.Float("DataVersion"); !ok || v != 4556 {
+		t.Fatalf("unexpected DataVersion as float: %v, %v", v, ok)
+	}
+	if _, ok := data.String("DayTime"); ok {
+		t.Fatalf("expected DayTime not to be a string")
+	}
+}
+
+func TestDecode_Invalid(t *testing.T) {
+	data := sample()
+	for i := 1; i < len(data)-1; i += 7 {
+		if _, _, err := Decode(bytes.NewReader(data[:i])); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected data truncated at %d to be invalid, got %v", i, err)
+		}
+	}
+
+	huge := (&builder{}).tag(TagCompound, "").tag(TagByteArray, "a").be(int32(-1)).Bytes()
+	if _, _, err := Decode(bytes.NewReader(huge)); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected a negative length to be invalid, got %v", err)
+	}
+	// A corrupt length is only as expensive as the data behind it
+	for _, tagType := range []byte{TagByteArray, TagIntArray, TagLongArray, TagList} {
+		b := (&builder{}).tag(TagCompound, "").tag(tagType, "a")
+		if tagType == TagList {
+			b.be(byte(TagLong))
+		}
+		corrupt := b.be(int32(maxArrayLength)).be(int64(1)).Bytes()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, _, err := Decode(bytes.NewReader(corrupt)); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected a truncated array of type %d to be invalid, got %v", tagType, err)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Fatalf("decoding a truncated array of type %d allocated %d bytes", tagType, allocated)
+		}
+	}
+	if _, _, err := Decode(bytes.NewReader([]byte{TagInt, 0, 0})); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected a non-compound root to be invalid, got %v", err)
+	}
+}
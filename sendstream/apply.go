@@ -0,0 +1,514 @@
+package sendstream
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocPunchHole is the fallocate mode flag for punching holes.
+const fallocPunchHole = 0x02
+
+// Applier applies send streams to an ordinary directory tree, the way btrfs
+// receive applies them to a subvolume. A full stream is applied to an empty
+// directory and each incremental to the tree its parent left behind.
+//
+// Ownership, extended attributes and inode flags are applied on a best
+// effort basis, as they need privileges or filesystem support that a
+// restore host may lack.
+type Applier struct {
+	root string
+
+	// Decode decodes the data of encoded writes with compression types
+	// other than none and zlib. unencodedLen is the decoded length.
+	Decode func(compression uint64, data []byte, unencodedLen uint64) ([]byte, error)
+	// Logf reports what could not be applied fully.
+	Logf func(format string, args ...any)
+
+	clones *cloneSources
+
+	// The file of the last write stays open for the writes that follow
+	file     *os.File
+	filePath string
+
+	warned map[string]bool
+}
+
+// NewApplier returns an applier for the directory at root, which must
+// exist.
+func NewApplier(root string) (*Applier, error) {
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", root, err)
+	}
+	return &Applier{
+		root:   resolved,
+		Logf:   log.Printf,
+		clones: newCloneSources(),
+		warned: make(map[string]bool),
+	}, nil
+}
+
+// ApplyStream applies every command of the stream read from r.
+func (a *Applier) ApplyStream(r io.Reader) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer a.closeFile()
+	for {
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			return a.closeFile()
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.Apply(cmd); err != nil {
+			path, _ := cmd.Attrs.String(AttrPath)
+			return fmt.Errorf("%s %s: %w", cmd.Name(), path, err)
+		}
+	}
+}
+
+// Apply applies a single command.
+func (a *Applier) Apply(cmd *Command) error {
+	if err := a.apply(cmd); err != nil {
+		return err
+	}
+	a.clones.touch(cmd)
+	return nil
+}
+
+func (a *Applier) apply(cmd *Command) error {
+	switch cmd.Type {
+	case CmdWrite, CmdEncodedWrite, CmdClone:
+		// These may reuse the open file
+	default:
+		if err := a.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	switch cmd.Type {
+	case CmdSubvol, CmdSnapshot:
+		return a.clones.begin(cmd)
+	case CmdMkfile:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		})
+	case CmdMkdir:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			return os.Mkdir(path, 0700)
+		})
+	case CmdMknod:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			mode, err := cmd.Attrs.Uint64(AttrMode)
+			if err != nil {
+				return err
+			}
+			rdev, err := cmd.Attrs.Uint64(AttrRdev)
+			if err != nil {
+				return err
+			}
+			return syscall.Mknod(path, uint32(mode), int(rdev))
+		})
+	case CmdMkfifo:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			return syscall.Mkfifo(path, 0600)
+		})
+	case CmdMksock:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			return syscall.Mknod(path, syscall.S_IFSOCK|0600, 0)
+		})
+	case CmdSymlink:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			target, err := cmd.Attrs.String(AttrPathLink)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, path)
+		})
+	case CmdRename:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			to, err := a.attrPath(cmd.Attrs, AttrPathTo)
+			if err != nil {
+				return err
+			}
+			return os.Rename(path, to)
+		})
+	case CmdLink:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			existing, err := a.attrPath(cmd.Attrs, AttrPathLink)
+			if err != nil {
+				return err
+			}
+			return os.Link(existing, path)
+		})
+	case CmdUnlink, CmdRmdir:
+		return a.withPath(cmd.Attrs, os.Remove)
+	case CmdSetXattr:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			name, err := cmd.Attrs.String(AttrXattrName)
+			if err != nil {
+				return err
+			}
+			data, err := cmd.Attrs.Bytes(AttrXattrData)
+			if err != nil {
+				return err
+			}
+			if err := unix.Lsetxattr(path, name, data, 0); err != nil {
+				a.warnOnce("xattr", "Cannot set extended attributes, skipping them: %v", err)
+			}
+			return nil
+		})
+	case CmdRemoveXattr:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			name, err := cmd.Attrs.String(AttrXattrName)
+			if err != nil {
+				return err
+			}
+			if err := unix.Lremovexattr(path, name); err != nil && !errors.Is(err, unix.ENODATA) {
+				a.warnOnce("xattr", "Cannot remove extended attributes, skipping them: %v", err)
+			}
+			return nil
+		})
+	case CmdWrite:
+		return a.write(cmd.Attrs)
+	case CmdEncodedWrite:
+		return a.encodedWrite(cmd.Attrs)
+	case CmdClone:
+		return a.clone(cmd.Attrs)
+	case CmdTruncate:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			size, err := cmd.Attrs.Uint64(AttrSize)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return f.Truncate(int64(size))
+		})
+	case CmdChmod:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			mode, err := cmd.Attrs.Uint64(AttrMode)
+			if err != nil {
+				return err
+			}
+			// Symlinks have no mode of their own, do not follow them
+			if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return nil
+			}
+			return syscall.Chmod(path, uint32(mode&07777))
+		})
+	case CmdChown:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			uid, err := cmd.Attrs.Uint64(AttrUID)
+			if err != nil {
+				return err
+			}
+			gid, err := cmd.Attrs.Uint64(AttrGID)
+			if err != nil {
+				return err
+			}
+			if err := os.Lchown(path, int(uid), int(gid)); err != nil {
+				if !errors.Is(err, os.ErrPermission) {
+					return err
+				}
+				a.warnOnce("chown", "Cannot change ownership, files keep the current user: %v", err)
+			}
+			return nil
+		})
+	case CmdUtimes:
+		return a.withPath(cmd.Attrs, func(path string) error {
+			atime, err := cmd.Attrs.Time(AttrAtime)
+			if err != nil {
+				return err
+			}
+			mtime, err := cmd.Attrs.Time(AttrMtime)
+			if err != nil {
+				return err
+			}
+			// The change time cannot be set
+			ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+			return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+		})
+	case CmdUpdateExtent:
+		// Only sent by streams without file data, nothing to write
+		return nil
+	case CmdFallocate:
+		return a.fallocate(cmd.Attrs)
+	case CmdFileattr:
+		a.warnOnce("fileattr", "Inode flags are not restored")
+		return nil
+	case CmdEnd:
+		return nil
+	default:
+		return fmt.Errorf("unsupported command %s", cmd.Name())
+	}
+}
+
+// Close releases the file kept open between writes.
+func (a *Applier) Close() error {
+	return a.closeFile()
+}
+
+func (a *Applier) write(attrs Attributes) error {
+	path, err := a.attrPath(attrs, AttrPath)
+	if err != nil {
+		return err
+	}
+	offset, err := attrs.Uint64(AttrFileOffset)
+	if err != nil {
+		return err
+	}
+	data, err := attrs.Bytes(AttrData)
+	if err != nil {
+		return err
+	}
+	f, err := a.openFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, int64(offset))
+	return err
+}
+
+func (a *Applier) encodedWrite(attrs Attributes) error {
+	path, err := a.attrPath(attrs, AttrPath)
+	if err != nil {
+		return err
+	}
+	data, offset, err := DecodeEncodedWrite(attrs, a.Decode)
+	if err != nil {
+		return err
+	}
+	f, err := a.openFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+// DecodeEncodedWrite returns the file data of an encoded write command and
+// the offset it belongs at. decode handles compression types other than none
+// and zlib, if not nil.
+func DecodeEncodedWrite(attrs Attributes, decode func(compression uint64, data []byte, unencodedLen uint64) ([]byte, error)) ([]byte, int64, error) {
+	var err error
+	values := make(map[uint16]uint64)
+	for _, attr := range []uint16{AttrFileOffset, AttrUnencodedFileLen, AttrUnencodedLen, AttrUnencodedOffset} {
+		if values[attr], err = attrs.Uint64(attr); err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, attr := range []uint16{AttrCompression, AttrEncryption} {
+		if attrs.Has(attr) {
+			if values[attr], err = attrs.Uint64(attr); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	if values[AttrEncryption] != 0 {
+		return nil, 0, fmt.Errorf("encrypted extents are not supported")
+	}
+	data, err := attrs.Bytes(AttrData)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	unencodedLen := values[AttrUnencodedLen]
+	var decoded []byte
+	switch compression := values[AttrCompression]; {
+	case compression == CompressionNone:
+		decoded = data
+	case compression == CompressionZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decompress zlib extent: %w", err)
+		}
+		decoded, err = io.ReadAll(io.LimitReader(zr, int64(unencodedLen)))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decompress zlib extent: %w", err)
+		}
+	case decode != nil:
+		if decoded, err = decode(compression, data, unencodedLen); err != nil {
+			return nil, 0, err
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported compression type %d", compression)
+	}
+
+	start, length := values[AttrUnencodedOffset], values[AttrUnencodedFileLen]
+	if start+length > uint64(len(decoded)) {
+		return nil, 0, fmt.Errorf("extent decodes to %d bytes, need %d", len(decoded), start+length)
+	}
+	return decoded[start : start+length], int64(values[AttrFileOffset]), nil
+}
+
+func (a *Applier) clone(attrs Attributes) error {
+	path, err := a.attrPath(attrs, AttrPath)
+	if err != nil {
+		return err
+	}
+	if err := a.clones.check(attrs); err != nil {
+		return err
+	}
+	source, err := a.attrPath(attrs, AttrClonePath)
+	if err != nil {
+		return err
+	}
+	values := make(map[uint16]uint64)
+	for _, attr := range []uint16{AttrFileOffset, AttrCloneOffset, AttrCloneLen} {
+		if values[attr], err = attrs.Uint64(attr); err != nil {
+			return err
+		}
+	}
+
+	dst, err := a.openFile(path)
+	if err != nil {
+		return err
+	}
+	src, err := os.OpenFile(source, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	length := int64(values[AttrCloneLen])
+	n, err := io.Copy(io.NewOffsetWriter(dst, int64(values[AttrFileOffset])), io.NewSectionReader(src, int64(values[AttrCloneOffset]), length))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("clone source is too short: copied %d of %d bytes", n, length)
+	}
+	return nil
+}
+
+func (a *Applier) fallocate(attrs Attributes) error {
+	path, err := a.attrPath(attrs, AttrPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fallocateFile(f, attrs)
+}
+
+// fallocateFile applies a fallocate command to f.
+func fallocateFile(f *os.File, attrs Attributes) error {
+	mode, err := attrs.Uint64(AttrFallocateMode)
+	if err != nil {
+		return err
+	}
+	offset, err := attrs.Uint64(AttrFileOffset)
+	if err != nil {
+		return err
+	}
+	length, err := attrs.Uint64(AttrSize)
+	if err != nil {
+		return err
+	}
+	if err := unix.Fallocate(int(f.Fd()), uint32(mode), int64(offset), int64(length)); err != nil {
+		if mode&fallocPunchHole == 0 || !errors.Is(err, unix.EOPNOTSUPP) {
+			return err
+		}
+		// Without hole punching support, write the zeros instead
+		_, err = io.Copy(io.NewOffsetWriter(f, int64(offset)), io.LimitReader(zeroReader{}, int64(length)))
+		return err
+	}
+	return nil
+}
+
+// withPath calls fn with the resolved path of the command.
+func (a *Applier) withPath(attrs Attributes, fn func(path string) error) error {
+	path, err := a.attrPath(attrs, AttrPath)
+	if err != nil {
+		return err
+	}
+	return fn(path)
+}
+
+// attrPath resolves a path attribute below the root. Paths leaving the
+// tree, directly or through a symlink in the stream, are rejected.
+func (a *Applier) attrPath(attrs Attributes, attr uint16) (string, error) {
+	p, err := attrs.String(attr)
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		// The subvolume root itself
+		return a.root, nil
+	}
+	if !filepath.IsLocal(p) {
+		return "", fmt.Errorf("path %q leaves the restore directory", p)
+	}
+	full := filepath.Join(a.root, p)
+	parent, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		// The operation itself reports the missing directory
+		return full, nil
+	}
+	if parent != a.root && !strings.HasPrefix(parent, a.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q leaves the restore directory", p)
+	}
+	return full, nil
+}
+
+func (a *Applier) openFile(path string) (*os.File, error) {
+	if a.file != nil && a.filePath == path {
+		return a.file, nil
+	}
+	if err := a.closeFile(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	a.file, a.filePath = f, path
+	return f, nil
+}
+
+func (a *Applier) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file, a.filePath = nil, ""
+	return err
+}
+
+func (a *Applier) warnOnce(key string, format string, args ...any) {
+	if a.warned[key] || a.Logf == nil {
+		return
+	}
+	a.warned[key] = true
+	a.Logf(format, args...)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
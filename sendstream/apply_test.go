@@ -0,0 +1,209 @@
+package sendstream
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func uuidOf(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 16)
+}
+
+func timespec(sec uint64) []byte {
+	return append(u64(sec), 0, 0, 0, 0)
+}
+
+func path(p string) []byte {
+	return tlv(AttrPath, []byte(p))
+}
+
+func applyStreams(t *testing.T, root string, streams ...[]byte) error {
+	t.Helper()
+	a, err := NewApplier(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.Logf = t.Logf
+	for _, stream := range streams {
+		if err := a.ApplyStream(bytes.NewReader(stream)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestApplier_FullAndIncremental(t *testing.T) {
+	root := t.TempDir()
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("xxHELLOyy"))
+	zw.Close()
+
+	full := buildStream(2,
+		Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+		Command{Type: CmdMkdir, Payload: path("o257-1-0")},
+		Command{Type: CmdRename, Payload: payload(path("o257-1-0"), tlv(AttrPathTo, []byte("region")))},
+		Command{Type: CmdMkfile, Payload: path("region/r.0.0.mca")},
+		Command{Type: CmdWrite, Payload: payload(path("region/r.0.0.mca"), tlv(AttrFileOffset, u64(0)), binary.LittleEndian.AppendUint16(nil, AttrData), []byte("0123456789"))},
+		Command{Type: CmdMkfile, Payload: path("level.dat")},
+		Command{Type: CmdEncodedWrite, Payload: payload(path("level.dat"), tlv(AttrFileOffset, u64(0)),
+			tlv(AttrUnencodedFileLen, u64(5)), tlv(AttrUnencodedLen, u64(9)), tlv(AttrUnencodedOffset, u64(2)),
+			tlv(AttrCompression, binary.LittleEndian.AppendUint32(nil, CompressionZlib)),
+			binary.LittleEndian.AppendUint16(nil, AttrData), compressed.Bytes())},
+		Command{Type: CmdSymlink, Payload: payload(path("latest"), tlv(AttrPathLink, []byte("level.dat")))},
+		Command{Type: CmdChmod, Payload: payload(path("level.dat"), tlv(AttrMode, u64(0o640)))},
+		Command{Type: CmdUtimes, Payload: payload(path("level.dat"), tlv(AttrAtime, timespec(1000)), tlv(AttrMtime, timespec(2000)), tlv(AttrCtime, timespec(3000)))},
+		Command{Type: CmdEnd},
+	)
+	incremental := buildStream(2,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt200"), tlv(AttrUUID, uuidOf(2)), tlv(AttrCtransid, u64(2)), tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)))},
+		Command{Type: CmdMkfile, Payload: path("region/r.0.1.mca")},
+		Command{Type: CmdClone, Payload: payload(path("region/r.0.1.mca"), tlv(AttrFileOffset, u64(0)), tlv(AttrCloneLen, u64(4)),
+			tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)), tlv(AttrClonePath, []byte("region/r.0.0.mca")), tlv(AttrCloneOffset, u64(2)))},
+		Command{Type: CmdTruncate, Payload: payload(path("region/r.0.0.mca"), tlv(AttrSize, u64(3)))},
+		Command{Type: CmdLink, Payload: payload(path("level.dat_old"), tlv(AttrPathLink, []byte("level.dat")))},
+		Command{Type: CmdUnlink, Payload: path("latest")},
+		Command{Type: CmdEnd},
+	)
+
+	if err := applyStreams(t, root, full, incremental); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"region/r.0.0.mca": "012",
+		"region/r.0.1.mca": "2345",
+		"level.dat":        "HELLO",
+		"level.dat_old":    "HELLO",
+	} {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("unexpected content of %s: want %q, got %q", name, want, got)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(root, "level.dat"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode().Perm() != 0o640 || !fi.ModTime().Equal(time.Unix(2000, 0)) {
+		t.Fatalf("unexpected mode %v or mtime %v", fi.Mode(), fi.ModTime())
+	}
+	if _, err := os.Lstat(filepath.Join(root, "latest")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected symlink to be removed, got %v", err)
+	}
+}
+
+func TestApplier_RejectsWrongParent(t *testing.T) {
+	full := buildStream(1,
+		Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+		Command{Type: CmdEnd},
+	)
+	incremental := buildStream(1,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt300"), tlv(AttrUUID, uuidOf(3)), tlv(AttrCtransid, u64(3)), tlv(AttrCloneUUID, uuidOf(2)), tlv(AttrCloneCtransid, u64(2)))},
+		Command{Type: CmdEnd},
+	)
+	if err := applyStreams(t, t.TempDir(), full, incremental); err == nil {
+		t.Fatalf("expected error for an incremental of another parent")
+	}
+}
+
+func TestApplier_RejectsCloneFromEarlierSnapshot(t *testing.T) {
+	root := t.TempDir()
+	full := buildStream(1,
+		Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+		Command{Type: CmdMkfile, Payload: path("level.dat")},
+		Command{Type: CmdWrite, Payload: payload(path("level.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("OLD")))},
+		Command{Type: CmdEnd},
+	)
+	incremental := buildStream(1,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt200"), tlv(AttrUUID, uuidOf(2)), tlv(AttrCtransid, u64(2)), tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)))},
+		Command{Type: CmdWrite, Payload: payload(path("level.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("NEW")))},
+		Command{Type: CmdEnd},
+	)
+	// Sent with gt100 as extra clone source: the tree holds gt200 by now,
+	// so cloning level.dat would copy NEW instead of OLD
+	second := buildStream(1,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt300"), tlv(AttrUUID, uuidOf(3)), tlv(AttrCtransid, u64(3)), tlv(AttrCloneUUID, uuidOf(2)), tlv(AttrCloneCtransid, u64(2)))},
+		Command{Type: CmdMkfile, Payload: path("level.dat_old")},
+		Command{Type: CmdClone, Payload: payload(path("level.dat_old"), tlv(AttrFileOffset, u64(0)), tlv(AttrCloneLen, u64(3)),
+			tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)), tlv(AttrClonePath, []byte("level.dat")), tlv(AttrCloneOffset, u64(0)))},
+		Command{Type: CmdEnd},
+	)
+	err := applyStreams(t, root, full, incremental, second)
+	if err == nil || !strings.Contains(err.Error(), "earlier snapshot") {
+		t.Fatalf("expected the clone from gt100 to be refused, got %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "level.dat_old")); err == nil && len(got) > 0 {
+		t.Fatalf("expected no data to be cloned, got %q", got)
+	}
+}
+
+func TestApplier_RejectsCloneFromChangedParentFile(t *testing.T) {
+	full := buildStream(1,
+		Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+		Command{Type: CmdMkdir, Payload: path("region")},
+		Command{Type: CmdMkfile, Payload: path("region/a.mca")},
+		Command{Type: CmdWrite, Payload: payload(path("region/a.mca"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("OLD")))},
+		Command{Type: CmdEnd},
+	)
+	for name, change := range map[string]Command{
+		// cp --reflink a b, then a write to a: btrfs receive clones b from
+		// the untouched parent, the tree already holds NEW
+		"written":           {Type: CmdWrite, Payload: payload(path("region/a.mca"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("NEW")))},
+		"directory renamed": {Type: CmdRename, Payload: payload(path("region"), tlv(AttrPathTo, []byte("o257-1-0")))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			incremental := buildStream(1,
+				Command{Type: CmdSnapshot, Payload: payload(path("gt200"), tlv(AttrUUID, uuidOf(2)), tlv(AttrCtransid, u64(2)), tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)))},
+				change,
+				Command{Type: CmdMkfile, Payload: path("b.mca")},
+				Command{Type: CmdClone, Payload: payload(path("b.mca"), tlv(AttrFileOffset, u64(0)), tlv(AttrCloneLen, u64(3)),
+					tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)), tlv(AttrClonePath, []byte("region/a.mca")), tlv(AttrCloneOffset, u64(0)))},
+				Command{Type: CmdEnd},
+			)
+			root := t.TempDir()
+			err := applyStreams(t, root, full, incremental)
+			if err == nil || !strings.Contains(err.Error(), "already changed") {
+				t.Fatalf("expected the clone from the changed file to be refused, got %v", err)
+			}
+			if got, err := os.ReadFile(filepath.Join(root, "b.mca")); err == nil && len(got) > 0 {
+				t.Fatalf("expected no data to be cloned, got %q", got)
+			}
+		})
+	}
+}
+
+func TestApplier_StaysInsideRoot(t *testing.T) {
+	outside := t.TempDir()
+	for name, stream := range map[string][]byte{
+		"dot-dot": buildStream(1,
+			Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+			Command{Type: CmdMkfile, Payload: path("../escaped")},
+			Command{Type: CmdEnd},
+		),
+		"symlink": buildStream(1,
+			Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+			Command{Type: CmdSymlink, Payload: payload(path("link"), tlv(AttrPathLink, []byte(outside)))},
+			Command{Type: CmdMkfile, Payload: path("link/escaped")},
+			Command{Type: CmdEnd},
+		),
+	} {
+		if err := applyStreams(t, t.TempDir(), stream); err == nil {
+			t.Fatalf("%s: expected error for a path outside the root", name)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("stream escaped the restore directory")
+	}
+}
@@ -0,0 +1,121 @@
+package sendstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Attributes holds the attributes of a command by type. Values point into
+// the command payload.
+type Attributes map[uint16][]byte
+
+// parseAttributes splits a command payload into its attributes. Each
+// attribute is a 16-bit type and a 16-bit length followed by the value,
+// except that in version 2 the data attribute has no length and runs to
+// the end of the command, so it can exceed 64KiB.
+func parseAttributes(version uint32, cmdType uint16, payload []byte) (Attributes, error) {
+	attrs := make(Attributes)
+	for pos := 0; pos < len(payload); {
+		if len(payload)-pos < 2 {
+			return nil, invalidf("truncated attribute header in %s command", CommandName(cmdType))
+		}
+		attr := binary.LittleEndian.Uint16(payload[pos:])
+		pos += 2
+
+		var value []byte
+		if version >= 2 && attr == AttrData {
+			value = payload[pos:]
+		} else {
+			if len(payload)-pos < 2 {
+				return nil, invalidf("truncated attribute header in %s command", CommandName(cmdType))
+			}
+			length := int(binary.LittleEndian.Uint16(payload[pos:]))
+			pos += 2
+			if len(payload)-pos < length {
+				return nil, invalidf("attribute %s overruns %s command", AttributeName(attr), CommandName(cmdType))
+			}
+			value = payload[pos : pos+length]
+		}
+		pos += len(value)
+		attrs[attr] = value
+	}
+	return attrs, nil
+}
+
+// Has reports whether the attribute is present.
+func (a Attributes) Has(attr uint16) bool {
+	_, ok := a[attr]
+	return ok
+}
+
+// Bytes returns the raw value of an attribute.
+func (a Attributes) Bytes(attr uint16) ([]byte, error) {
+	value, ok := a[attr]
+	if !ok {
+		return nil, invalidf("missing attribute %s", AttributeName(attr))
+	}
+	return value, nil
+}
+
+// String returns an attribute holding a path or name.
+func (a Attributes) String(attr uint16) (string, error) {
+	value, err := a.Bytes(attr)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// Uint64 returns an integer attribute. btrfs stores most integers in 64
+// bits and a few in 32 bits.
+func (a Attributes) Uint64(attr uint16) (uint64, error) {
+	value, err := a.Bytes(attr)
+	if err != nil {
+		return 0, err
+	}
+	switch len(value) {
+	case 8:
+		return binary.LittleEndian.Uint64(value), nil
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(value)), nil
+	default:
+		return 0, invalidf("attribute %s has %d bytes, not an integer", AttributeName(attr), len(value))
+	}
+}
+
+// Time returns a timestamp attribute, stored as 64-bit seconds and 32-bit
+// nanoseconds.
+func (a Attributes) Time(attr uint16) (time.Time, error) {
+	value, err := a.Bytes(attr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(value) != 12 {
+		return time.Time{}, invalidf("attribute %s has %d bytes, not a timestamp", AttributeName(attr), len(value))
+	}
+	sec := int64(binary.LittleEndian.Uint64(value))
+	nsec := int64(binary.LittleEndian.Uint32(value[8:]))
+	return time.Unix(sec, nsec), nil
+}
+
+// UUID is a subvolume UUID.
+type UUID [16]byte
+
+func (u UUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// UUID returns a UUID attribute.
+func (a Attributes) UUID(attr uint16) (UUID, error) {
+	var u UUID
+	value, err := a.Bytes(attr)
+	if err != nil {
+		return u, err
+	}
+	if len(value) != len(u) {
+		return u, invalidf("attribute %s has %d bytes, not a UUID", AttributeName(attr), len(value))
+	}
+	copy(u[:], value)
+	return u, nil
+}
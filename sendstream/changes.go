@@ -0,0 +1,117 @@
+package sendstream
+
+import (
+	"sort"
+	"strings"
+)
+
+// Change describes what a stream did to a single path.
+type Change struct {
+	Path  string   `json:"path"`
+	Bytes int64    `json:"bytes,omitempty"` // File data written or cloned
+	Ops   []string `json:"ops"`             // Names of the commands, in order of first use
+}
+
+// ChangeIndex collects the paths a stream touches. btrfs send creates new
+// inodes under temporary names and renames them into place, so changes
+// follow renames and are reported under the final path.
+type ChangeIndex struct {
+	changes map[string]*Change
+}
+
+// NewChangeIndex returns an empty index.
+func NewChangeIndex() *ChangeIndex {
+	return &ChangeIndex{changes: make(map[string]*Change)}
+}
+
+// Add records a command of the stream.
+func (x *ChangeIndex) Add(cmd *Command) {
+	path, err := cmd.Attrs.String(AttrPath)
+	if err != nil {
+		// subvol, snapshot and end carry no file path or only the name
+		// of the subvolume
+		return
+	}
+	switch cmd.Type {
+	case CmdSubvol, CmdSnapshot:
+		return
+	case CmdUtimes:
+		// Sent for the parent directory of every change, mostly noise
+		return
+	case CmdRename:
+		to, err := cmd.Attrs.String(AttrPathTo)
+		if err != nil {
+			return
+		}
+		x.rename(path, to)
+		x.record(to, cmd.Name(), 0)
+		return
+	case CmdWrite, CmdEncodedWrite:
+		data, _ := cmd.Attrs.Bytes(AttrData)
+		n := int64(len(data))
+		if cmd.Type == CmdEncodedWrite {
+			if length, err := cmd.Attrs.Uint64(AttrUnencodedFileLen); err == nil {
+				n = int64(length)
+			}
+		}
+		x.record(path, cmd.Name(), n)
+		return
+	case CmdClone:
+		length, _ := cmd.Attrs.Uint64(AttrCloneLen)
+		x.record(path, cmd.Name(), int64(length))
+		return
+	case CmdUpdateExtent:
+		// Takes the place of writes in streams sent with --no-data
+		size, _ := cmd.Attrs.Uint64(AttrSize)
+		x.record(path, cmd.Name(), int64(size))
+		return
+	}
+	x.record(path, cmd.Name(), 0)
+}
+
+func (x *ChangeIndex) record(path string, op string, bytes int64) {
+	change, ok := x.changes[path]
+	if !ok {
+		change = &Change{Path: path}
+		x.changes[path] = change
+	}
+	change.Bytes += bytes
+	for _, existing := range change.Ops {
+		if existing == op {
+			return
+		}
+	}
+	change.Ops = append(change.Ops, op)
+}
+
+// rename moves the changes of from, and of everything below it, to to.
+func (x *ChangeIndex) rename(from string, to string) {
+	moved := make(map[string]*Change)
+	for path, change := range x.changes {
+		switch {
+		case path == from:
+			change.Path = to
+		case strings.HasPrefix(path, from+"/"):
+			change.Path = to + path[len(from):]
+		default:
+			continue
+		}
+		delete(x.changes, path)
+		moved[change.Path] = change
+	}
+	for path, change := range moved {
+		x.changes[path] = change
+	}
+}
+
+// Changes returns the recorded changes ordered by path.
+func (x *ChangeIndex) Changes() []Change {
+	changes := make([]Change, 0, len(x.changes))
+	for _, change := range x.changes {
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
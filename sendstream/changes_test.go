@@ -0,0 +1,37 @@
+package sendstream
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestChangeIndex_FollowsRenames(t *testing.T) {
+	stream := buildStream(1,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt200"), tlv(AttrUUID, uuidOf(2)), tlv(AttrCtransid, u64(2)), tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)))},
+		Command{Type: CmdMkdir, Payload: path("o258-2-0")},
+		Command{Type: CmdMkfile, Payload: path("o258-2-0/o259-2-0")},
+		Command{Type: CmdRename, Payload: payload(path("o258-2-0/o259-2-0"), tlv(AttrPathTo, []byte("o258-2-0/r.3.-2.mca")))},
+		Command{Type: CmdWrite, Payload: payload(path("o258-2-0/r.3.-2.mca"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, make([]byte, 100)))},
+		Command{Type: CmdRename, Payload: payload(path("o258-2-0"), tlv(AttrPathTo, []byte("region")))},
+		Command{Type: CmdWrite, Payload: payload(path("level.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, make([]byte, 10)))},
+		Command{Type: CmdWrite, Payload: payload(path("level.dat"), tlv(AttrFileOffset, u64(10)), tlv(AttrData, make([]byte, 5)))},
+		Command{Type: CmdUpdateExtent, Payload: payload(path("session.lock"), tlv(AttrFileOffset, u64(0)), tlv(AttrSize, u64(3)))},
+		Command{Type: CmdUtimes, Payload: payload(path(""), tlv(AttrAtime, timespec(1)), tlv(AttrMtime, timespec(1)), tlv(AttrCtime, timespec(1)))},
+		Command{Type: CmdEnd},
+	)
+
+	index := NewChangeIndex()
+	if err := Walk(bytes.NewReader(stream), index.Add); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Change{
+		{Path: "level.dat", Bytes: 15, Ops: []string{"write"}},
+		{Path: "region", Ops: []string{"mkdir", "rename"}},
+		{Path: "region/r.3.-2.mca", Bytes: 100, Ops: []string{"mkfile", "rename", "write"}},
+		{Path: "session.lock", Bytes: 3, Ops: []string{"update_extent"}},
+	}
+	if got := index.Changes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected changes:\nwant %+v\ngot  %+v", want, got)
+	}
+}
@@ -0,0 +1,108 @@
+package sendstream
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cloneSources tracks which clone sources a chain of streams can be
+// reproduced from when each stream changes the tree of its parent in place.
+// A clone from the stream's own subvolume reads the tree as the stream left
+// it, which is what btrfs receive reads too. A clone from the parent reads
+// the parent unchanged, so the tree only has the right data at paths the
+// stream has not changed yet. Earlier snapshots are not kept at all.
+type cloneSources struct {
+	subvolumes map[UUID]bool // UUIDs of the streams applied so far
+	current    UUID
+	parent     UUID // Parent of the current stream, zero for a full one
+
+	// Paths the current stream created, removed, renamed or wrote to
+	touched map[string]bool
+}
+
+func newCloneSources() *cloneSources {
+	return &cloneSources{subvolumes: make(map[UUID]bool), touched: make(map[string]bool)}
+}
+
+// begin starts the stream whose first command is cmd.
+func (c *cloneSources) begin(cmd *Command) error {
+	uuid, err := cmd.Attrs.UUID(AttrUUID)
+	if err != nil {
+		return err
+	}
+	switch cmd.Type {
+	case CmdSubvol:
+		if len(c.subvolumes) > 0 {
+			return fmt.Errorf("full stream applied on top of another stream")
+		}
+		c.parent = UUID{}
+	case CmdSnapshot:
+		parent, err := cmd.Attrs.UUID(AttrCloneUUID)
+		if err != nil {
+			return err
+		}
+		// Without earlier streams the tree is assumed to hold the parent
+		if len(c.subvolumes) > 0 && parent != c.current {
+			return fmt.Errorf("stream expects parent %s, but the tree holds %s", parent, c.current)
+		}
+		c.subvolumes[parent] = true
+		c.parent = parent
+	}
+	c.subvolumes[uuid] = true
+	c.current = uuid
+	clear(c.touched)
+	return nil
+}
+
+// touch records the paths cmd changes. Metadata changes keep the data a
+// clone reads, so they do not count.
+func (c *cloneSources) touch(cmd *Command) {
+	var attrs []uint16
+	switch cmd.Type {
+	case CmdMkfile, CmdMkdir, CmdMknod, CmdMkfifo, CmdMksock, CmdSymlink, CmdLink,
+		CmdUnlink, CmdRmdir, CmdWrite, CmdEncodedWrite, CmdClone, CmdTruncate, CmdFallocate:
+		attrs = []uint16{AttrPath}
+	case CmdRename:
+		attrs = []uint16{AttrPath, AttrPathTo}
+	}
+	for _, attr := range attrs {
+		if p, err := cmd.Attrs.String(attr); err == nil {
+			c.touched[p] = true
+		}
+	}
+}
+
+// check returns an error if the tree does not hold the data btrfs receive
+// would read for the clone in attrs at its clone path.
+func (c *cloneSources) check(attrs Attributes) error {
+	p, err := attrs.String(AttrClonePath)
+	if err != nil {
+		return err
+	}
+	uuid, err := attrs.UUID(AttrCloneUUID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !c.subvolumes[uuid]:
+		// Other subvolumes are not available, only the tree being restored
+		return fmt.Errorf("clone source subvolume %s is not part of the restored chain", uuid)
+	case uuid == c.current:
+		return nil
+	case uuid != c.parent || c.parent == UUID{}:
+		return fmt.Errorf("clone source subvolume %s is an earlier snapshot of the chain, whose files are not kept", uuid)
+	}
+	// The path names a file of the parent, which is gone from the tree if
+	// the stream changed it or moved a directory above it
+	for dir := p; ; {
+		if c.touched[dir] {
+			return fmt.Errorf("clone source %q of the parent was already changed by this stream", p)
+		}
+		i := strings.LastIndex(dir, "/")
+		if i < 0 {
+			break
+		}
+		dir = dir[:i]
+	}
+	return nil
+}
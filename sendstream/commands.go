@@ -0,0 +1,160 @@
+package sendstream
+
+import "fmt"
+
+// Command types. Types from CmdFallocate on only appear in version 2
+// streams.
+const (
+	CmdUnspec       = 0
+	CmdSubvol       = 1
+	CmdSnapshot     = 2
+	CmdMkfile       = 3
+	CmdMkdir        = 4
+	CmdMknod        = 5
+	CmdMkfifo       = 6
+	CmdMksock       = 7
+	CmdSymlink      = 8
+	CmdRename       = 9
+	CmdLink         = 10
+	CmdUnlink       = 11
+	CmdRmdir        = 12
+	CmdSetXattr     = 13
+	CmdRemoveXattr  = 14
+	CmdWrite        = 15
+	CmdClone        = 16
+	CmdTruncate     = 17
+	CmdChmod        = 18
+	CmdChown        = 19
+	CmdUtimes       = 20
+	CmdUpdateExtent = 22
+	CmdFallocate    = 23
+	CmdFileattr     = 24
+	CmdEncodedWrite = 25
+)
+
+var commandNames = map[uint16]string{
+	CmdUnspec:       "unspec",
+	CmdSubvol:       "subvol",
+	CmdSnapshot:     "snapshot",
+	CmdMkfile:       "mkfile",
+	CmdMkdir:        "mkdir",
+	CmdMknod:        "mknod",
+	CmdMkfifo:       "mkfifo",
+	CmdMksock:       "mksock",
+	CmdSymlink:      "symlink",
+	CmdRename:       "rename",
+	CmdLink:         "link",
+	CmdUnlink:       "unlink",
+	CmdRmdir:        "rmdir",
+	CmdSetXattr:     "set_xattr",
+	CmdRemoveXattr:  "remove_xattr",
+	CmdWrite:        "write",
+	CmdClone:        "clone",
+	CmdTruncate:     "truncate",
+	CmdChmod:        "chmod",
+	CmdChown:        "chown",
+	CmdUtimes:       "utimes",
+	CmdEnd:          "end",
+	CmdUpdateExtent: "update_extent",
+	CmdFallocate:    "fallocate",
+	CmdFileattr:     "fileattr",
+	CmdEncodedWrite: "encoded_write",
+}
+
+// CommandName returns the name btrfs uses for a command type.
+func CommandName(cmdType uint16) string {
+	if name, ok := commandNames[cmdType]; ok {
+		return name
+	}
+	return fmt.Sprintf("cmd%d", cmdType)
+}
+
+// Attribute types. Types from AttrFallocateMode on only appear in version
+// 2 streams.
+const (
+	AttrUUID             = 1
+	AttrCtransid         = 2
+	AttrIno              = 3
+	AttrSize             = 4
+	AttrMode             = 5
+	AttrUID              = 6
+	AttrGID              = 7
+	AttrRdev             = 8
+	AttrCtime            = 9
+	AttrMtime            = 10
+	AttrAtime            = 11
+	AttrOtime            = 12
+	AttrXattrName        = 13
+	AttrXattrData        = 14
+	AttrPath             = 15
+	AttrPathTo           = 16
+	AttrPathLink         = 17
+	AttrFileOffset       = 18
+	AttrData             = 19
+	AttrCloneUUID        = 20
+	AttrCloneCtransid    = 21
+	AttrClonePath        = 22
+	AttrCloneOffset      = 23
+	AttrCloneLen         = 24
+	AttrFallocateMode    = 25
+	AttrFileattr         = 26
+	AttrUnencodedFileLen = 27
+	AttrUnencodedLen     = 28
+	AttrUnencodedOffset  = 29
+	AttrCompression      = 30
+	AttrEncryption       = 31
+)
+
+var attributeNames = map[uint16]string{
+	AttrUUID:             "uuid",
+	AttrCtransid:         "ctransid",
+	AttrIno:              "ino",
+	AttrSize:             "size",
+	AttrMode:             "mode",
+	AttrUID:              "uid",
+	AttrGID:              "gid",
+	AttrRdev:             "rdev",
+	AttrCtime:            "ctime",
+	AttrMtime:            "mtime",
+	AttrAtime:            "atime",
+	AttrOtime:            "otime",
+	AttrXattrName:        "xattr_name",
+	AttrXattrData:        "xattr_data",
+	AttrPath:             "path",
+	AttrPathTo:           "path_to",
+	AttrPathLink:         "path_link",
+	AttrFileOffset:       "file_offset",
+	AttrData:             "data",
+	AttrCloneUUID:        "clone_uuid",
+	AttrCloneCtransid:    "clone_ctransid",
+	AttrClonePath:        "clone_path",
+	AttrCloneOffset:      "clone_offset",
+	AttrCloneLen:         "clone_len",
+	AttrFallocateMode:    "fallocate_mode",
+	AttrFileattr:         "fileattr",
+	AttrUnencodedFileLen: "unencoded_file_len",
+	AttrUnencodedLen:     "unencoded_len",
+	AttrUnencodedOffset:  "unencoded_offset",
+	AttrCompression:      "compression",
+	AttrEncryption:       "encryption",
+}
+
+// AttributeName returns the name btrfs uses for an attribute type.
+func AttributeName(attr uint16) string {
+	if name, ok := attributeNames[attr]; ok {
+		return name
+	}
+	return fmt.Sprintf("attr%d", attr)
+}
+
+// Compression types of encoded writes.
+const (
+	CompressionNone   = 0
+	CompressionZlib   = 1
+	CompressionZstd   = 2
+	CompressionLZO4K  = 3
+	CompressionLZO8K  = 4
+	CompressionLZO16K = 5
+	CompressionLZO32K = 6
+	CompressionLZO64K = 7
+)
@@ -0,0 +1,131 @@
+package sendstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dump prints the commands of a stream one per line, in the style of
+// btrfs receive --dump.
+func Dump(w io.Writer, r io.Reader) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for {
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			bw.Flush()
+			return err
+		}
+		fmt.Fprintln(bw, FormatCommand(cmd))
+	}
+}
+
+// dumpFields lists the attributes printed for each command after its path,
+// with the label they are printed under.
+var dumpFields = map[uint16][]struct {
+	attr  uint16
+	label string
+}{
+	CmdSubvol:       {{AttrUUID, "uuid"}, {AttrCtransid, "transid"}},
+	CmdSnapshot:     {{AttrUUID, "uuid"}, {AttrCtransid, "transid"}, {AttrCloneUUID, "parent_uuid"}, {AttrCloneCtransid, "parent_transid"}},
+	CmdMkfile:       nil,
+	CmdMkdir:        nil,
+	CmdMknod:        {{AttrMode, "mode"}, {AttrRdev, "dev"}},
+	CmdSymlink:      {{AttrPathLink, "dest"}},
+	CmdRename:       {{AttrPathTo, "dest"}},
+	CmdLink:         {{AttrPathLink, "dest"}},
+	CmdSetXattr:     {{AttrXattrName, "name"}, {AttrXattrData, "data"}},
+	CmdRemoveXattr:  {{AttrXattrName, "name"}},
+	CmdWrite:        {{AttrFileOffset, "offset"}, {AttrData, "len"}},
+	CmdClone:        {{AttrFileOffset, "offset"}, {AttrCloneLen, "len"}, {AttrClonePath, "from"}, {AttrCloneOffset, "clone_offset"}},
+	CmdTruncate:     {{AttrSize, "size"}},
+	CmdChmod:        {{AttrMode, "mode"}},
+	CmdChown:        {{AttrGID, "gid"}, {AttrUID, "uid"}},
+	CmdUtimes:       {{AttrAtime, "atime"}, {AttrMtime, "mtime"}, {AttrCtime, "ctime"}},
+	CmdUpdateExtent: {{AttrFileOffset, "offset"}, {AttrSize, "len"}},
+	CmdFallocate:    {{AttrFallocateMode, "mode"}, {AttrFileOffset, "offset"}, {AttrSize, "len"}},
+	CmdFileattr:     {{AttrFileattr, "fileattr"}},
+	CmdEncodedWrite: {{AttrFileOffset, "offset"}, {AttrData, "len"}, {AttrUnencodedFileLen, "unencoded_file_len"}, {AttrUnencodedLen, "unencoded_len"}, {AttrUnencodedOffset, "unencoded_offset"}, {AttrCompression, "compression"}, {AttrEncryption, "encryption"}},
+}
+
+// FormatCommand renders a command as a single line.
+func FormatCommand(cmd *Command) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-16s", cmd.Name())
+	if path, err := cmd.Attrs.String(AttrPath); err == nil {
+		b.WriteString(quotePath(path))
+	}
+
+	fields, known := dumpFields[cmd.Type]
+	if !known {
+		// Show whatever an unknown command carries
+		for _, attr := range slices.Sorted(maps.Keys(cmd.Attrs)) {
+			if attr != AttrPath {
+				fields = append(fields, struct {
+					attr  uint16
+					label string
+				}{attr, AttributeName(attr)})
+			}
+		}
+	}
+	for _, field := range fields {
+		if !cmd.Attrs.Has(field.attr) {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%s", field.label, formatAttribute(cmd.Attrs, field.attr))
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func formatAttribute(attrs Attributes, attr uint16) string {
+	value := attrs[attr]
+	switch attr {
+	case AttrUUID, AttrCloneUUID:
+		if u, err := attrs.UUID(attr); err == nil {
+			return u.String()
+		}
+	case AttrCtime, AttrMtime, AttrAtime, AttrOtime:
+		if t, err := attrs.Time(attr); err == nil {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	case AttrMode:
+		if mode, err := attrs.Uint64(attr); err == nil {
+			return fmt.Sprintf("%o", mode)
+		}
+	case AttrData:
+		// The contents are not interesting, their length is
+		return strconv.Itoa(len(value))
+	case AttrXattrData:
+		return fmt.Sprintf("%q", value)
+	case AttrPathTo, AttrPathLink, AttrClonePath, AttrXattrName:
+		return quotePath(string(value))
+	default:
+		if n, err := attrs.Uint64(attr); err == nil {
+			return strconv.FormatUint(n, 10)
+		}
+	}
+	return fmt.Sprintf("%x", value)
+}
+
+// quotePath escapes paths with whitespace or unprintable characters so
+// every command stays on one line.
+func quotePath(path string) string {
+	for _, r := range path {
+		if r <= ' ' || r == '"' || r == '\\' || !strconv.IsPrint(r) {
+			return strconv.Quote(path)
+		}
+	}
+	return path
+}
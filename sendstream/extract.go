@@ -0,0 +1,517 @@
+package sendstream
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// inode is a file of the tree a chain of streams describes.
+type inode struct {
+	id       int
+	dir      bool
+	children map[string]*inode
+
+	symlink string
+	mode    uint64
+	hasMode bool
+	atime   time.Time
+	mtime   time.Time
+}
+
+// namespace tracks the directory tree of a chain of streams without any
+// file data. Inode ids are assigned in creation order, so replaying the
+// same streams assigns the same ids.
+type namespace struct {
+	root *inode
+	next int
+}
+
+func newNamespace() *namespace {
+	return &namespace{root: &inode{dir: true, children: make(map[string]*inode)}, next: 1}
+}
+
+func (n *namespace) lookup(p string) *inode {
+	node := n.root
+	if p == "" {
+		return node
+	}
+	for _, name := range strings.Split(p, "/") {
+		if node.children == nil {
+			return nil
+		}
+		if node = node.children[name]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// parent returns the directory containing p and the name of p in it.
+func (n *namespace) parent(p string) (*inode, string, error) {
+	dir, name := "", p
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		dir, name = p[:i], p[i+1:]
+	}
+	parent := n.lookup(dir)
+	if parent == nil || !parent.dir {
+		return nil, "", fmt.Errorf("parent directory of %q does not exist", p)
+	}
+	return parent, name, nil
+}
+
+func (n *namespace) create(p string, dir bool) (*inode, error) {
+	parent, name, err := n.parent(p)
+	if err != nil {
+		return nil, err
+	}
+	node := &inode{id: n.next, dir: dir}
+	if dir {
+		node.children = make(map[string]*inode)
+	}
+	n.next++
+	parent.children[name] = node
+	return node, nil
+}
+
+func (n *namespace) attach(p string, node *inode) error {
+	parent, name, err := n.parent(p)
+	if err != nil {
+		return err
+	}
+	parent.children[name] = node
+	return nil
+}
+
+func (n *namespace) remove(p string) (*inode, error) {
+	parent, name, err := n.parent(p)
+	if err != nil {
+		return nil, err
+	}
+	node := parent.children[name]
+	if node == nil {
+		return nil, fmt.Errorf("%q does not exist", p)
+	}
+	delete(parent.children, name)
+	return node, nil
+}
+
+// walk calls fn for every path below the root, parents before children.
+func (n *namespace) walk(fn func(p string, node *inode)) {
+	var visit func(prefix string, dir *inode)
+	visit = func(prefix string, dir *inode) {
+		names := make([]string, 0, len(dir.children))
+		for name := range dir.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := dir.children[name]
+			p := prefix + name
+			fn(p, child)
+			if child.dir {
+				visit(p+"/", child)
+			}
+		}
+	}
+	visit("", n.root)
+}
+
+// Extractor recreates selected paths of the last snapshot of a chain
+// without restoring the rest. It reads the chain twice: Scan finds the
+// inodes the selected paths end up as, following renames, hard links and
+// clones, and Apply then only writes data of those inodes.
+type Extractor struct {
+	// Decode decodes encoded writes, see Applier.
+	Decode func(compression uint64, data []byte, unencodedLen uint64) ([]byte, error)
+
+	match func(p string) bool
+	work  string
+	ns    *namespace
+	chain *cloneSources
+
+	applying bool
+	clones   map[int][]int // Inodes the data of an inode was cloned from
+	wanted   map[int]bool
+
+	file   *os.File
+	fileID int
+}
+
+// NewExtractor returns an extractor for the paths match accepts. Data of
+// the selected files is assembled below work.
+func NewExtractor(work string, match func(p string) bool) *Extractor {
+	return &Extractor{
+		match:  match,
+		work:   work,
+		ns:     newNamespace(),
+		chain:  newCloneSources(),
+		clones: make(map[int][]int),
+	}
+}
+
+// Scan reads the next stream of the chain in the first pass.
+func (e *Extractor) Scan(r io.Reader) error {
+	if e.applying {
+		return fmt.Errorf("scan after apply")
+	}
+	return e.read(r)
+}
+
+// Select ends the first pass and returns how many paths were selected.
+func (e *Extractor) Select() int {
+	e.wanted = make(map[int]bool)
+	var queue []int
+	selected := 0
+	e.ns.walk(func(p string, node *inode) {
+		if e.match(p) {
+			selected++
+			if !e.wanted[node.id] {
+				e.wanted[node.id] = true
+				queue = append(queue, node.id)
+			}
+		}
+	})
+	// Data cloned into a selected file has to be written as well
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, source := range e.clones[id] {
+			if !e.wanted[source] {
+				e.wanted[source] = true
+				queue = append(queue, source)
+			}
+		}
+	}
+
+	e.applying = true
+	e.ns = newNamespace()
+	e.chain = newCloneSources()
+	return selected
+}
+
+// Apply reads the next stream of the chain in the second pass.
+func (e *Extractor) Apply(r io.Reader) error {
+	if !e.applying {
+		return fmt.Errorf("apply before select")
+	}
+	defer e.closeFile()
+	return e.read(r)
+}
+
+func (e *Extractor) read(r io.Reader) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		cmd, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := e.command(cmd); err != nil {
+			p, _ := cmd.Attrs.String(AttrPath)
+			return fmt.Errorf("%s %s: %w", cmd.Name(), p, err)
+		}
+		e.chain.touch(cmd)
+	}
+}
+
+func (e *Extractor) command(cmd *Command) error {
+	p, _ := cmd.Attrs.String(AttrPath)
+	switch cmd.Type {
+	case CmdSubvol, CmdSnapshot:
+		return e.chain.begin(cmd)
+	case CmdMkfile, CmdMknod, CmdMkfifo, CmdMksock:
+		node, err := e.ns.create(p, false)
+		if err != nil {
+			return err
+		}
+		if e.applying && cmd.Type == CmdMkfile && e.wanted[node.id] {
+			f, err := os.Create(e.dataPath(node.id))
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+		return nil
+	case CmdMkdir:
+		_, err := e.ns.create(p, true)
+		return err
+	case CmdSymlink:
+		node, err := e.ns.create(p, false)
+		if err != nil {
+			return err
+		}
+		node.symlink, err = cmd.Attrs.String(AttrPathLink)
+		return err
+	case CmdLink:
+		existing, err := cmd.Attrs.String(AttrPathLink)
+		if err != nil {
+			return err
+		}
+		node := e.ns.lookup(existing)
+		if node == nil {
+			return fmt.Errorf("link target %q does not exist", existing)
+		}
+		return e.ns.attach(p, node)
+	case CmdUnlink, CmdRmdir:
+		_, err := e.ns.remove(p)
+		return err
+	case CmdRename:
+		to, err := cmd.Attrs.String(AttrPathTo)
+		if err != nil {
+			return err
+		}
+		node, err := e.ns.remove(p)
+		if err != nil {
+			return err
+		}
+		return e.ns.attach(to, node)
+	case CmdClone:
+		return e.clone(p, cmd.Attrs)
+	}
+
+	if !e.applying {
+		return nil
+	}
+	node := e.ns.lookup(p)
+	if node == nil {
+		switch cmd.Type {
+		case CmdEnd, CmdUpdateExtent:
+			return nil
+		}
+		return fmt.Errorf("%q does not exist", p)
+	}
+
+	switch cmd.Type {
+	case CmdChmod:
+		mode, err := cmd.Attrs.Uint64(AttrMode)
+		if err != nil {
+			return err
+		}
+		node.mode, node.hasMode = mode&07777, true
+	case CmdUtimes:
+		var err error
+		if node.atime, err = cmd.Attrs.Time(AttrAtime); err != nil {
+			return err
+		}
+		if node.mtime, err = cmd.Attrs.Time(AttrMtime); err != nil {
+			return err
+		}
+	case CmdWrite, CmdEncodedWrite, CmdTruncate, CmdFallocate:
+		if !e.wanted[node.id] {
+			return nil
+		}
+		f, err := e.openFile(node.id)
+		if err != nil {
+			return err
+		}
+		switch cmd.Type {
+		case CmdWrite:
+			offset, err := cmd.Attrs.Uint64(AttrFileOffset)
+			if err != nil {
+				return err
+			}
+			data, err := cmd.Attrs.Bytes(AttrData)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt(data, int64(offset))
+			return err
+		case CmdEncodedWrite:
+			data, offset, err := DecodeEncodedWrite(cmd.Attrs, e.Decode)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt(data, offset)
+			return err
+		case CmdTruncate:
+			size, err := cmd.Attrs.Uint64(AttrSize)
+			if err != nil {
+				return err
+			}
+			return f.Truncate(int64(size))
+		case CmdFallocate:
+			return fallocateFile(f, cmd.Attrs)
+		}
+	}
+	return nil
+}
+
+func (e *Extractor) clone(p string, attrs Attributes) error {
+	// The namespace holds the parent only where the stream did not change it
+	if err := e.chain.check(attrs); err != nil {
+		return err
+	}
+	sourcePath, err := attrs.String(AttrClonePath)
+	if err != nil {
+		return err
+	}
+	node, source := e.ns.lookup(p), e.ns.lookup(sourcePath)
+	if node == nil || source == nil {
+		return fmt.Errorf("clone between missing files")
+	}
+	if !e.applying {
+		e.clones[node.id] = append(e.clones[node.id], source.id)
+		return nil
+	}
+	if !e.wanted[node.id] {
+		return nil
+	}
+
+	offset, err := attrs.Uint64(AttrFileOffset)
+	if err != nil {
+		return err
+	}
+	sourceOffset, err := attrs.Uint64(AttrCloneOffset)
+	if err != nil {
+		return err
+	}
+	length, err := attrs.Uint64(AttrCloneLen)
+	if err != nil {
+		return err
+	}
+	dst, err := e.openFile(node.id)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(e.dataPath(source.id))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	n, err := io.Copy(io.NewOffsetWriter(dst, int64(offset)), io.NewSectionReader(src, int64(sourceOffset), int64(length)))
+	if err != nil {
+		return err
+	}
+	if n != int64(length) {
+		return fmt.Errorf("clone source is too short: copied %d of %d bytes", n, length)
+	}
+	return nil
+}
+
+// Finish writes the selected paths below out and returns them.
+func (e *Extractor) Finish(out string) ([]string, error) {
+	if err := e.closeFile(); err != nil {
+		return nil, err
+	}
+	var extracted []string
+	var dirs []struct {
+		path string
+		node *inode
+	}
+	var err error
+	e.ns.walk(func(p string, node *inode) {
+		if err != nil || !e.match(p) {
+			return
+		}
+		if !filepath.IsLocal(p) {
+			err = fmt.Errorf("path %q leaves the output directory", p)
+			return
+		}
+		target := filepath.Join(out, filepath.FromSlash(p))
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return
+		}
+		switch {
+		case node.dir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return
+			}
+			// Directory times change while their contents are written
+			dirs = append(dirs, struct {
+				path string
+				node *inode
+			}{target, node})
+		case node.symlink != "":
+			if err = os.Symlink(node.symlink, target); err != nil {
+				return
+			}
+		case e.wanted[node.id]:
+			if err = copyFile(e.dataPath(node.id), target); err != nil {
+				return
+			}
+			err = setAttributes(target, node)
+		default:
+			// Device nodes, fifos and sockets have no data to extract
+			return
+		}
+		extracted = append(extracted, p)
+	})
+	if err != nil {
+		return extracted, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setAttributes(dirs[i].path, dirs[i].node); err != nil {
+			return extracted, err
+		}
+	}
+	return extracted, nil
+}
+
+func setAttributes(path string, node *inode) error {
+	if node.hasMode {
+		if err := syscall.Chmod(path, uint32(node.mode)); err != nil {
+			return err
+		}
+	}
+	if !node.mtime.IsZero() {
+		return os.Chtimes(path, node.atime, node.mtime)
+	}
+	return nil
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (e *Extractor) dataPath(id int) string {
+	return filepath.Join(e.work, strconv.Itoa(id))
+}
+
+func (e *Extractor) openFile(id int) (*os.File, error) {
+	if e.file != nil && e.fileID == id {
+		return e.file, nil
+	}
+	if err := e.closeFile(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(e.dataPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	e.file, e.fileID = f, id
+	return f, nil
+}
+
+func (e *Extractor) closeFile() error {
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
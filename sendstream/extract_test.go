@@ -0,0 +1,105 @@
+package sendstream
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractor_SelectedPathsOnly(t *testing.T) {
+	full := buildStream(1,
+		Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+		Command{Type: CmdMkdir, Payload: path("o257-1-0")},
+		Command{Type: CmdRename, Payload: payload(path("o257-1-0"), tlv(AttrPathTo, []byte("playerdata")))},
+		Command{Type: CmdMkdir, Payload: path("region")},
+		Command{Type: CmdMkfile, Payload: path("o258-1-0")},
+		Command{Type: CmdRename, Payload: payload(path("o258-1-0"), tlv(AttrPathTo, []byte("playerdata/a.dat")))},
+		Command{Type: CmdWrite, Payload: payload(path("playerdata/a.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("player-a")))},
+		Command{Type: CmdMkfile, Payload: path("region/r.0.0.mca")},
+		Command{Type: CmdWrite, Payload: payload(path("region/r.0.0.mca"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("REGIONDATA")))},
+		Command{Type: CmdEnd},
+	)
+	incremental := buildStream(1,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt200"), tlv(AttrUUID, uuidOf(2)), tlv(AttrCtransid, u64(2)), tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)))},
+		Command{Type: CmdRename, Payload: payload(path("playerdata/a.dat"), tlv(AttrPathTo, []byte("playerdata/c.dat")))},
+		Command{Type: CmdWrite, Payload: payload(path("playerdata/c.dat"), tlv(AttrFileOffset, u64(6)), tlv(AttrData, []byte("-C")))},
+		Command{Type: CmdMkfile, Payload: path("playerdata/b.dat")},
+		Command{Type: CmdClone, Payload: payload(path("playerdata/b.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrCloneLen, u64(6)),
+			tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)), tlv(AttrClonePath, []byte("region/r.0.0.mca")), tlv(AttrCloneOffset, u64(0)))},
+		Command{Type: CmdChmod, Payload: payload(path("playerdata/b.dat"), tlv(AttrMode, u64(0o600)))},
+		Command{Type: CmdEnd},
+	)
+
+	work, out := t.TempDir(), t.TempDir()
+	x := NewExtractor(work, func(p string) bool {
+		return p == "playerdata" || strings.HasPrefix(p, "playerdata/")
+	})
+	for _, stream := range [][]byte{full, incremental} {
+		if err := x.Scan(bytes.NewReader(stream)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := x.Select(); n != 3 {
+		t.Fatalf("unexpected number of selected paths: want 3, got %d", n)
+	}
+	for _, stream := range [][]byte{full, incremental} {
+		if err := x.Apply(bytes.NewReader(stream)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	extracted, err := x.Finish(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Join(extracted, ","); got != "playerdata,playerdata/b.dat,playerdata/c.dat" {
+		t.Fatalf("unexpected extracted paths: %q", got)
+	}
+
+	for name, want := range map[string]string{
+		"playerdata/b.dat": "REGION",
+		"playerdata/c.dat": "player-C",
+	} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("unexpected content of %s: want %q, got %q", name, want, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "region")); !os.IsNotExist(err) {
+		t.Fatalf("expected region not to be extracted, got %v", err)
+	}
+	if fi, _ := os.Stat(filepath.Join(out, "playerdata/b.dat")); fi.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected mode: %v", fi.Mode())
+	}
+}
+
+func TestExtractor_RejectsCloneFromChangedParentFile(t *testing.T) {
+	full := buildStream(1,
+		Command{Type: CmdSubvol, Payload: payload(path("gt100"), tlv(AttrUUID, uuidOf(1)), tlv(AttrCtransid, u64(1)))},
+		Command{Type: CmdMkfile, Payload: path("a.dat")},
+		Command{Type: CmdWrite, Payload: payload(path("a.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("OLD")))},
+		Command{Type: CmdEnd},
+	)
+	// b.dat was a reflink copy of a.dat, which was written afterwards
+	incremental := buildStream(1,
+		Command{Type: CmdSnapshot, Payload: payload(path("gt200"), tlv(AttrUUID, uuidOf(2)), tlv(AttrCtransid, u64(2)), tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)))},
+		Command{Type: CmdWrite, Payload: payload(path("a.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrData, []byte("NEW")))},
+		Command{Type: CmdMkfile, Payload: path("b.dat")},
+		Command{Type: CmdClone, Payload: payload(path("b.dat"), tlv(AttrFileOffset, u64(0)), tlv(AttrCloneLen, u64(3)),
+			tlv(AttrCloneUUID, uuidOf(1)), tlv(AttrCloneCtransid, u64(1)), tlv(AttrClonePath, []byte("a.dat")), tlv(AttrCloneOffset, u64(0)))},
+		Command{Type: CmdEnd},
+	)
+
+	x := NewExtractor(t.TempDir(), func(p string) bool { return p == "b.dat" })
+	if err := x.Scan(bytes.NewReader(full)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := x.Scan(bytes.NewReader(incremental))
+	if err == nil || !strings.Contains(err.Error(), "already changed") {
+		t.Fatalf("expected the clone from the changed file to be refused, got %v", err)
+	}
+}
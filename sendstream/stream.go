@@ -0,0 +1,146 @@
+// Package sendstream reads the stream format produced by btrfs send.
+//
+// A stream starts with a header holding the magic "btrfs-stream\0" and a
+// little-endian 32-bit version. It is followed by commands, each with a
+// 10-byte header (32-bit payload length, 16-bit command type and a CRC32C
+// of the command computed with the CRC field zeroed) and its payload. The
+// stream ends with an END command. The payload of a command is a list of
+// attributes.
+package sendstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Magic is the start of every send stream.
+const Magic = "btrfs-stream\x00"
+
+const (
+	headerSize        = len(Magic) + 4
+	commandHeaderSize = 10
+
+	// maxCommandSize bounds the payload of a single command. btrfs send
+	// uses 64KiB buffers for version 1 and somewhat larger ones for
+	// encoded writes in version 2, so anything near this is garbage.
+	maxCommandSize = 16 * 1024 * 1024
+
+	// MaxVersion is the newest stream version this package understands.
+	MaxVersion = 2
+)
+
+// CmdEnd is the type of the command that terminates a stream.
+const CmdEnd = 21
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInvalidStream is wrapped by every error about malformed stream data.
+var ErrInvalidStream = errors.New("invalid send stream")
+
+// Command is a single command of a send stream. Payload and Attrs are
+// only valid until the next call to Next.
+type Command struct {
+	Type    uint16
+	Payload []byte
+	Attrs   Attributes
+}
+
+// Name returns the btrfs name of the command.
+func (c *Command) Name() string {
+	return CommandName(c.Type)
+}
+
+// Reader reads the commands of a send stream.
+type Reader struct {
+	r       io.Reader
+	version uint32
+	offset  int64
+	header  [commandHeaderSize]byte
+	buf     []byte
+	ended   bool
+}
+
+// NewReader reads the stream header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, invalidf("failed to read stream header: %v", err)
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, invalidf("bad magic %q", header[:len(Magic)])
+	}
+	version := binary.LittleEndian.Uint32(header[len(Magic):])
+	if version < 1 || version > MaxVersion {
+		return nil, invalidf("unsupported stream version %d", version)
+	}
+	return &Reader{r: r, version: version, offset: int64(headerSize)}, nil
+}
+
+// Version returns the stream version from the header.
+func (r *Reader) Version() uint32 {
+	return r.version
+}
+
+// Next returns the next command after checking its CRC. It returns io.EOF
+// after the END command if the stream ends there.
+func (r *Reader) Next() (*Command, error) {
+	if r.ended {
+		// Data after END is not part of this stream
+		var b [1]byte
+		if n, _ := io.ReadFull(r.r, b[:]); n != 0 {
+			return nil, invalidf("unexpected data after END command at offset %d", r.offset)
+		}
+		return nil, io.EOF
+	}
+
+	offset := r.offset
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if err == io.EOF {
+			return nil, invalidf("stream ended without END command at offset %d", offset)
+		}
+		return nil, invalidf("truncated command header at offset %d: %v", offset, err)
+	}
+	length := binary.LittleEndian.Uint32(r.header[0:4])
+	cmdType := binary.LittleEndian.Uint16(r.header[4:6])
+	wantCRC := binary.LittleEndian.Uint32(r.header[6:10])
+	if length > maxCommandSize {
+		return nil, invalidf("command at offset %d is too large (%d bytes)", offset, length)
+	}
+
+	if cap(r.buf) < int(length) {
+		r.buf = make([]byte, length)
+	}
+	payload := r.buf[:length]
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, invalidf("truncated command at offset %d: %v", offset, err)
+	}
+	r.offset += int64(commandHeaderSize) + int64(length)
+
+	if gotCRC := commandCRC(r.header, payload); gotCRC != wantCRC {
+		return nil, invalidf("CRC mismatch in command %d at offset %d: want %08x, got %08x", cmdType, offset, wantCRC, gotCRC)
+	}
+	attrs, err := parseAttributes(r.version, cmdType, payload)
+	if err != nil {
+		return nil, fmt.Errorf("command at offset %d: %w", offset, err)
+	}
+	if cmdType == CmdEnd {
+		r.ended = true
+	}
+	return &Command{Type: cmdType, Payload: payload, Attrs: attrs}, nil
+}
+
+// commandCRC computes the checksum btrfs stores in a command header. btrfs
+// uses CRC32C seeded with 0 and without the final inversion.
+func commandCRC(header [commandHeaderSize]byte, payload []byte) uint32 {
+	binary.LittleEndian.PutUint32(header[6:10], 0)
+	crc := crc32.Update(0xffffffff, castagnoli, header[:])
+	crc = crc32.Update(crc, castagnoli, payload)
+	return ^crc
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidStream, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,175 @@
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// buildStream encodes commands the way btrfs send does.
+func buildStream(version uint32, commands ...Command) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(Magic)
+	binary.Write(&buf, binary.LittleEndian, version)
+	for _, c := range commands {
+		var header [commandHeaderSize]byte
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(c.Payload)))
+		binary.LittleEndian.PutUint16(header[4:6], c.Type)
+		binary.LittleEndian.PutUint32(header[6:10], commandCRC(header, c.Payload))
+		buf.Write(header[:])
+		buf.Write(c.Payload)
+	}
+	return buf.Bytes()
+}
+
+// tlv encodes an attribute with its length.
+func tlv(attr uint16, value []byte) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, attr)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func u64(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func payload(attrs ...[]byte) []byte {
+	return bytes.Join(attrs, nil)
+}
+
+func validStream() []byte {
+	return buildStream(1,
+		Command{Type: CmdSubvol, Payload: payload(tlv(AttrPath, []byte("gt100")), tlv(AttrUUID, make([]byte, 16)), tlv(AttrCtransid, u64(7)))},
+		Command{Type: CmdWrite, Payload: payload(tlv(AttrPath, []byte("level.dat")), tlv(AttrFileOffset, u64(0)), tlv(AttrData, bytes.Repeat([]byte{0xab}, 4096)))},
+		Command{Type: CmdEnd},
+	)
+}
+
+func TestVerify(t *testing.T) {
+	valid := validStream()
+
+	garbled := bytes.Clone(valid)
+	garbled[headerSize+commandHeaderSize+3] ^= 0xff
+
+	badMagic := bytes.Clone(valid)
+	badMagic[0] = 'B'
+
+	tests := []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{"valid", valid, true},
+		{"version 2", buildStream(2, Command{Type: CmdEnd}), true},
+		{"unsupported version", buildStream(3, Command{Type: CmdEnd}), false},
+		{"bad magic", badMagic, false},
+		{"garbled payload", garbled, false},
+		{"truncated", valid[:len(valid)-20], false},
+		{"truncated header", valid[:5], false},
+		{"missing END", buildStream(1, Command{Type: CmdMkdir, Payload: tlv(AttrPath, []byte("x"))}), false},
+		{"data after END", append(bytes.Clone(valid), 0), false},
+		{"overrunning attribute", buildStream(1, Command{Type: CmdMkdir, Payload: tlv(AttrPath, []byte("x"))[:4]}, Command{Type: CmdEnd}), false},
+	}
+	for _, tt := range tests {
+		err := Verify(bytes.NewReader(tt.data))
+		if tt.valid && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidStream) {
+			t.Fatalf("%s: expected ErrInvalidStream, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidatingReader_PassesThrough(t *testing.T) {
+	valid := validStream()
+	v := NewValidatingReader(bytes.NewReader(valid), nil)
+	got, err := io.ReadAll(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, valid) {
+		t.Fatalf("stream was modified")
+	}
+	if err := v.Result(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A garbled stream is still passed through in full
+	garbled := bytes.Clone(valid)
+	garbled[len(garbled)-1] ^= 0xff
+	v = NewValidatingReader(bytes.NewReader(garbled), nil)
+	if got, _ := io.ReadAll(v); len(got) != len(garbled) {
+		t.Fatalf("unexpected length: want %d, got %d", len(garbled), len(got))
+	}
+	if err := v.Result(); !errors.Is(err, ErrInvalidStream) {
+		t.Fatalf("expected ErrInvalidStream, got %v", err)
+	}
+}
+
+func TestReader_Attributes(t *testing.T) {
+	// In version 2 the data attribute has no length and may exceed 64KiB
+	data := bytes.Repeat([]byte{0xcd}, 100000)
+	mtime := append(u64(1700000000), binary.LittleEndian.AppendUint32(nil, 5)...)
+	stream := buildStream(2,
+		Command{Type: CmdUtimes, Payload: payload(tlv(AttrPath, []byte("a")), tlv(AttrMtime, mtime))},
+		Command{Type: CmdWrite, Payload: payload(tlv(AttrPath, []byte("region/r.0.0.mca")), tlv(AttrFileOffset, u64(8192)), binary.LittleEndian.AppendUint16(nil, AttrData), data)},
+		Command{Type: CmdEnd},
+	)
+
+	r, err := NewReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Version() != 2 {
+		t.Fatalf("unexpected version: want 2, got %d", r.Version())
+	}
+
+	cmd, err := r.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := cmd.Attrs.Time(AttrMtime); !got.Equal(time.Unix(1700000000, 5)) {
+		t.Fatalf("unexpected mtime: got %v", got)
+	}
+
+	cmd, err = r.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cmd.Name() != "write" {
+		t.Fatalf("unexpected command: want %q, got %q", "write", cmd.Name())
+	}
+	path, _ := cmd.Attrs.String(AttrPath)
+	offset, _ := cmd.Attrs.Uint64(AttrFileOffset)
+	got, _ := cmd.Attrs.Bytes(AttrData)
+	if path != "region/r.0.0.mca" || offset != 8192 || !bytes.Equal(got, data) {
+		t.Fatalf("unexpected write: path %q, offset %d, %d bytes", path, offset, len(got))
+	}
+	if _, err := cmd.Attrs.Uint64(AttrSize); !errors.Is(err, ErrInvalidStream) {
+		t.Fatalf("expected missing attribute error, got %v", err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	stream := buildStream(1,
+		Command{Type: CmdMkfile, Payload: tlv(AttrPath, []byte("o257-7-0"))},
+		Command{Type: CmdRename, Payload: payload(tlv(AttrPath, []byte("o257-7-0")), tlv(AttrPathTo, []byte("world/level dat")))},
+		Command{Type: CmdChmod, Payload: payload(tlv(AttrPath, []byte("a")), tlv(AttrMode, u64(0o644)))},
+		Command{Type: CmdEnd},
+	)
+	var out bytes.Buffer
+	if err := Dump(&out, bytes.NewReader(stream)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "mkfile          o257-7-0\n" +
+		"rename          o257-7-0 dest=\"world/level dat\"\n" +
+		"chmod           a mode=644\n" +
+		"end\n"
+	if out.String() != want {
+		t.Fatalf("unexpected dump: want %q, got %q", want, out.String())
+	}
+}
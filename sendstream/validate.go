@@ -0,0 +1,89 @@
+package sendstream
+
+import (
+	"errors"
+	"io"
+)
+
+// Verify reads a whole stream from r and checks that it is well formed:
+// a valid header, commands with matching CRCs and an END command followed
+// by nothing else.
+func Verify(r io.Reader) error {
+	return Walk(r, nil)
+}
+
+// Walk verifies a stream like Verify and calls fn, if not nil, for every
+// command.
+func Walk(r io.Reader, fn func(*Command)) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		cmd, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if fn != nil {
+			fn(cmd)
+		}
+	}
+}
+
+// ValidatingReader passes a stream through unchanged while verifying it in
+// the background, so it can sit in front of the compressor without another
+// copy of the stream.
+type ValidatingReader struct {
+	r    io.Reader
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// errAborted ends verification of a stream that was not read to the end.
+var errAborted = errors.New("stream was not read to the end")
+
+// NewValidatingReader returns a reader that reads from r and verifies what
+// it reads. If fn is not nil, it is called for every command from another
+// goroutine.
+func NewValidatingReader(r io.Reader, fn func(*Command)) *ValidatingReader {
+	pr, pw := io.Pipe()
+	v := &ValidatingReader{r: r, pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(v.done)
+		v.err = Walk(pr, fn)
+		// Keep consuming so a malformed stream does not stall the reader
+		io.Copy(io.Discard, pr)
+	}()
+	return v
+}
+
+func (v *ValidatingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if n > 0 {
+		v.pw.Write(p[:n])
+	}
+	if err == io.EOF {
+		v.pw.Close()
+	} else if err != nil {
+		v.pw.CloseWithError(err)
+	}
+	return n, err
+}
+
+// Close stops verification if the stream is abandoned before its end. It
+// does not close the underlying reader.
+func (v *ValidatingReader) Close() error {
+	v.pw.CloseWithError(errAborted)
+	return nil
+}
+
+// Result waits for verification to finish and returns its outcome. The
+// stream must have been read to the end or the reader closed.
+func (v *ValidatingReader) Result() error {
+	<-v.done
+	return v.err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,39 +9,65 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
 	"strings"
+	"time"
 )
 
 type SnapshotInfo struct {
 	Path       string
 	Name       string
 	HasDone    bool
-	BackupType string // "full" or "incremental"
+	BackupType string // "full", "incremental" or "alias"
 	Size       int64  // Size in bytes after zstd compression
+	Failure    *FailureRecord // Content of the .failed marker, if any
+	Done       *DoneFileContent // Content of the .done file, if any
 }
 
 type DoneFileContent struct {
-	Type string `json:"type"` // "full" or "incremental"
+	Type string `json:"type"` // "full", "incremental" or "alias"
 	Size int64  `json:"size"` // Size in bytes after zstd compression
+	Key  string `json:"key,omitempty"` // Object key, the same on every destination
+	// Upload state per destination name. Missing in .done files written
+	// before multiple destinations were supported.
+	Destinations map[string]*DestinationState `json:"destinations,omitempty"`
+	// Result of the region file check, missing if it was disabled
+	Integrity *IntegrityReport `json:"integrity,omitempty"`
+	// State of the world from level.dat, missing if it could not be read
+	World *WorldInfo `json:"world,omitempty"`
+	// UUID of the snapshot subvolume, checked before it is used as a parent
+	SubvolumeUUID string `json:"subvolumeUUID,omitempty"`
+	// How the stream was sent, missing if with the btrfs defaults
+	Format *StreamFormat `json:"format,omitempty"`
+	// Snapshot an alias was not uploaded in favour of
+	AliasOf string `json:"aliasOf,omitempty"`
+	// Set while the snapshot is pinned, it is never pruned then
+	Pin *Pin `json:"pin,omitempty"`
 }
 
-func ReadDoneFile(doneFile string) (backupType string, size int64, err error) {
+// DestinationState is the upload state of a snapshot on one destination.
+type DestinationState struct {
+	Done       bool       `json:"done"`
+	UploadedAt *time.Time `json:"uploadedAt,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+func ReadDoneFile(doneFile string) (*DoneFileContent, error) {
 	data, err := os.ReadFile(doneFile)
 	if err != nil {
-		return "", 0, err
+		return nil, err
 	}
 
 	var content DoneFileContent
 	if err := json.Unmarshal(data, &content); err != nil {
-		// Try to handle old format for backwards compatibility
-		return "", 0, err
+		return nil, err
 	}
 	
-	return content.Type, content.Size, nil
+	return &content, nil
 }
 
-func FindSnapshots(watchDir string) ([]SnapshotInfo, error) {
+// FindSnapshots returns the snapshots in watchDir in chronological order.
+// layout is the time layout of snapshot names, see ParseSnapshotName.
+func FindSnapshots(watchDir string, layout string) ([]SnapshotInfo, error) {
 	entries, err := os.ReadDir(watchDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read directory: %w", err)
@@ -63,21 +90,33 @@ func FindSnapshots(watchDir string) ([]SnapshotInfo, error) {
 		if _, err := os.Stat(doneFile); err == nil {
 			info.HasDone = true
 			// Read backup type and size from .done file
-			if backupType, size, err := ReadDoneFile(doneFile); err == nil {
-				info.BackupType = backupType
-				info.Size = size
+			if content, err := ReadDoneFile(doneFile); err == nil {
+				info.BackupType = content.Type
+				info.Size = content.Size
+				info.Done = content
 			}
 		}
 
+		if record, err := ReadFailedFile(snapshotPath); err != nil {
+			log.Printf("Failed to read .failed file of %s: %v", entry.Name(), err)
+		} else {
+			info.Failure = record
+		}
+
 		snapshots = append(snapshots, info)
 	}
 
-	// Sort by name (assuming names are sortable chronologically)
-	sort.Slice(snapshots, func(i, j int) bool {
-		return snapshots[i].Name < snapshots[j].Name
-	})
+	// Names like gt99999 and gt100000 do not sort as strings
+	keys := make([]orderKey, len(snapshots))
+	for i := range snapshots {
+		keys[i] = orderKey{name: ParseSnapshotName(snapshots[i].Name, layout), created: creationTime(snapshots[i].Path)}
+	}
+	sorted := make([]SnapshotInfo, len(snapshots))
+	for i, j := range chronologicalOrder(keys) {
+		sorted[i] = snapshots[j]
+	}
 
-	return snapshots, nil
+	return sorted, nil
 }
 
 // FindLatestFullParent returns the most recent FULL backup with a .done file
@@ -93,14 +132,15 @@ func FindLatestFullParent(snapshots []SnapshotInfo) *SnapshotInfo {
 // FindLatestDoneSnapshot returns the most recent completed snapshot (full or incremental)
 func FindLatestDoneSnapshot(snapshots []SnapshotInfo) *SnapshotInfo {
     for i := len(snapshots) - 1; i >= 0; i-- {
-        if snapshots[i].HasDone {
+        // Aliases were never uploaded, nothing can be sent on top of them
+        if snapshots[i].HasDone && snapshots[i].BackupType != BackupTypeAlias {
             return &snapshots[i]
         }
     }
     return nil
 }
 
-func ShouldCreateFullBackup(parent *SnapshotInfo, snapshots []SnapshotInfo) bool {
+func ShouldCreateFullBackup(parent *SnapshotInfo, snapshots []SnapshotInfo, policy BackupPolicy) bool {
 	if parent == nil {
 		// No parent means first backup, should be full
 		return true
@@ -132,17 +172,17 @@ func ShouldCreateFullBackup(parent *SnapshotInfo, snapshots []SnapshotInfo) bool
 		}
 	}
 	
-	// If there are 990 or more incremental backups, create a new full backup
-	if incrementalCount >= 990 {
-		log.Printf("Creating full backup due to reaching 990 incremental backups (count = %d)", incrementalCount)
+	// If there are too many incremental backups, create a new full backup
+	if incrementalCount >= policy.MaxIncrementals {
+		log.Printf("Creating full backup due to reaching %d incremental backups (count = %d)", policy.MaxIncrementals, incrementalCount)
 		return true
 	}
 	
     // Removed: threshold based on last incremental size vs full size.
 	
-	// If cumulative incremental size since the last full exceeds the size of the last full,
-	// the next backup should be a full backup
-	if cumulativeIncrementalSize > 0 && parent.Size > 0 && cumulativeIncrementalSize > parent.Size {
+	// If cumulative incremental size since the last full exceeds the size of the last full
+	// (scaled by the policy ratio), the next backup should be a full backup
+	if cumulativeIncrementalSize > 0 && parent.Size > 0 && float64(cumulativeIncrementalSize) > float64(parent.Size)*policy.MaxCumulativeRatio {
 		log.Printf(
 			"Creating full backup due to cumulative incremental size exceeding full: cumulative = %d bytes (%.2f MB), parent full = %d bytes (%.2f MB), ratio = %.2f%%",
 			cumulativeIncrementalSize, float64(cumulativeIncrementalSize)/1024/1024,
@@ -155,8 +195,8 @@ func ShouldCreateFullBackup(parent *SnapshotInfo, snapshots []SnapshotInfo) bool
 	return false
 }
 
-func CreateBtrfsSendDiff(snapshotPath string, parentPath *string) (*exec.Cmd, io.ReadCloser, error) {
-	args := []string{"send"}
+func CreateBtrfsSendDiff(ctx context.Context, snapshotPath string, parentPath *string, format *StreamFormat) (*exec.Cmd, io.ReadCloser, error) {
+	args := append([]string{"send"}, format.Args(snapshotPath)...)
 	
 	if parentPath != nil {
 		args = append(args, "-p", *parentPath)
@@ -164,7 +204,7 @@ func CreateBtrfsSendDiff(snapshotPath string, parentPath *string) (*exec.Cmd, io
 	
 	args = append(args, snapshotPath)
 	
-	cmd := exec.Command("btrfs", args...)
+	cmd := exec.CommandContext(ctx, "btrfs", args...)
 	
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -183,12 +223,19 @@ func CreateBtrfsSendDiff(snapshotPath string, parentPath *string) (*exec.Cmd, io
 	} else {
 		log.Printf("  No parent (full backup)")
 	}
+	if format != nil {
+		log.Printf("  Send options: %s", strings.Join(format.Args(snapshotPath), " "))
+	}
 	
 	return cmd, stdout, nil
 }
 
-func CompressWithZstd(input io.Reader) (*exec.Cmd, io.ReadCloser, error) {
-	cmd := exec.Command("zstd", "--ultra", "-22", "-T1")
+func CompressWithZstd(ctx context.Context, input io.Reader, level int, threads int) (*exec.Cmd, io.ReadCloser, error) {
+	args := []string{fmt.Sprintf("-%d", level), fmt.Sprintf("-T%d", threads)}
+	if level > 19 {
+		args = append([]string{"--ultra"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "zstd", args...)
 	
 	cmd.Stdin = input
 	
@@ -203,29 +250,29 @@ func CompressWithZstd(input io.Reader) (*exec.Cmd, io.ReadCloser, error) {
 		return nil, nil, fmt.Errorf("failed to start zstd: %w", err)
 	}
 	
-	log.Printf("Started zstd compression with level 22")
+	log.Printf("Started zstd compression with level %d", level)
 	
 	return cmd, stdout, nil
 }
 
-func CreateDoneFile(snapshotPath string, backupType string, size int64) error {
+func WriteDoneFile(snapshotPath string, content *DoneFileContent) error {
 	doneFile := snapshotPath + ".done"
 	
-	content := DoneFileContent{
-		Type: backupType,
-		Size: size,
-	}
-	
 	data, err := json.MarshalIndent(content, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal done file content: %w", err)
 	}
 	
-	if err := os.WriteFile(doneFile, data, 0644); err != nil {
+	// Write through a temporary file, .done is updated after catch-up
+	tmpFile := doneFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write .done file: %w", err)
+	}
+	if err := os.Rename(tmpFile, doneFile); err != nil {
 		return fmt.Errorf("failed to write .done file: %w", err)
 	}
 	
-	log.Printf("Created .done file in %s (type: %s, size: %d bytes)", snapshotPath, backupType, size)
+	log.Printf("Wrote .done file for %s (type: %s, size: %d bytes)", snapshotPath, content.Type, content.Size)
 	
 	return nil
 }
@@ -239,12 +286,13 @@ func CreateDoneFile(snapshotPath string, backupType string, size int64) error {
 // - snapshotPath: the full path to the current snapshot directory
 // - snapshots: the result of FindSnapshots for the watch directory
 // - prefix: the snapshot prefix to be used for S3 key generation
+// - policy: thresholds deciding when to start a new full backup
 //
 // Outputs:
 // - key: the S3 object key to upload to
 // - parentPath: path to parent snapshot when incremental; nil for full
 // - error when snapshots is empty
-func DecideUpload(snapshotPath string, snapshots []SnapshotInfo, prefix string) (key string, parentPath *string, err error) {
+func DecideUpload(snapshotPath string, snapshots []SnapshotInfo, prefix string, policy BackupPolicy) (key string, parentPath *string, err error) {
     if len(snapshots) == 0 {
         return "", nil, fmt.Errorf("no snapshots found to decide upload plan")
     }
@@ -261,7 +309,7 @@ func DecideUpload(snapshotPath string, snapshots []SnapshotInfo, prefix string)
     }
     // Determine the latest full for policy checks, and whether a new full is needed
     latestFull := FindLatestFullParent(snapshots)
-    shouldCreateFull := ShouldCreateFullBackup(latestFull, snapshots)
+    shouldCreateFull := ShouldCreateFullBackup(latestFull, snapshots, policy)
 
     var parentName string
     var fromName string
@@ -293,7 +341,7 @@ func DecideUpload(snapshotPath string, snapshots []SnapshotInfo, prefix string)
     // Inline GetSnapshotKey logic
     snapshotName := filepath.Base(snapshotPath)
     if parentName == "" {
-        key = fmt.Sprintf("backup/%s/full.zst", snapshotName)
+        return FullBackupKey(snapshotPath, prefix), nil, nil
     } else {
         // Use base full name as directory, and optionally include from.<source>
         if fromName != "" {
@@ -307,3 +355,12 @@ func DecideUpload(snapshotPath string, snapshots []SnapshotInfo, prefix string)
     }
     return key, parentPath, nil
 }
+
+// FullBackupKey returns the key of a full backup of snapshotPath.
+func FullBackupKey(snapshotPath string, prefix string) string {
+    key := fmt.Sprintf("backup/%s/full.zst", filepath.Base(snapshotPath))
+    if prefix != "" {
+        key = strings.TrimSuffix(prefix, "/") + "/" + key
+    }
+    return key
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDecideUpload_FullWhenNoFullParent(t *testing.T) {
@@ -15,7 +18,7 @@ func TestDecideUpload_FullWhenNoFullParent(t *testing.T) {
     snapshots := []SnapshotInfo{current}
     snapPath := current.Path
 
-    key, parentPath, err := DecideUpload(snapPath, snapshots, "")
+    key, parentPath, err := DecideUpload(snapPath, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -46,7 +49,7 @@ func TestDecideUpload_IncrementalWithParent(t *testing.T) {
     snapshots := []SnapshotInfo{parent, current}
 
     snapPath := current.Path
-    key, parentPath, err := DecideUpload(snapPath, snapshots, "")
+    key, parentPath, err := DecideUpload(snapPath, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -89,7 +92,7 @@ func TestDecideUpload_NoLongerFullOnLargeLastIncremental(t *testing.T) {
     snapshots := []SnapshotInfo{parent, lastIncr, current}
 
     snapPath := current.Path
-    key, parentPath, err := DecideUpload(snapPath, snapshots, "")
+    key, parentPath, err := DecideUpload(snapPath, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -122,7 +125,7 @@ func TestDecideUpload_PrefixHandling(t *testing.T) {
     snapPath := current.Path
 
     // Prefix without trailing slash
-    key, _, err := DecideUpload(snapPath, snapshots, "prefix")
+    key, _, err := DecideUpload(snapPath, snapshots, "prefix", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -132,7 +135,7 @@ func TestDecideUpload_PrefixHandling(t *testing.T) {
     }
 
     // Prefix with trailing slash
-    key2, _, err := DecideUpload(snapPath, snapshots, "prefix/")
+    key2, _, err := DecideUpload(snapPath, snapshots, "prefix/", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -151,7 +154,7 @@ func TestDecideUpload_ErrorWhenNoSnapshots(t *testing.T) {
     // No snapshots should result in error
     var snapshots []SnapshotInfo
     snapPath := "/watch/snap-0001"
-    _, _, err := DecideUpload(snapPath, snapshots, "")
+    _, _, err := DecideUpload(snapPath, snapshots, "", DefaultBackupPolicy)
     if err == nil {
         t.Fatalf("expected error when no snapshots, got nil")
     }
@@ -167,7 +170,7 @@ func TestDecideUpload_ErrorWhenCurrentNotInList(t *testing.T) {
         Size: 100,
     }}
     snapPath := "/watch/snap-9999" // not included
-    _, _, err := DecideUpload(snapPath, snapshots, "")
+    _, _, err := DecideUpload(snapPath, snapshots, "", DefaultBackupPolicy)
     if err == nil {
         t.Fatalf("expected error when current snapshot not in list, got nil")
     }
@@ -189,7 +192,7 @@ func TestDecideUpload_SnapshotsIncludeCurrent_Incremental(t *testing.T) {
     }
     snapshots := []SnapshotInfo{parent, current}
 
-    key, parentPath, err := DecideUpload(current.Path, snapshots, "")
+    key, parentPath, err := DecideUpload(current.Path, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -225,7 +228,7 @@ func TestDecideUpload_SnapshotsIncludeCurrent_NoFullOnLargeIncremental(t *testin
     }
     snapshots := []SnapshotInfo{parent, lastIncr, current}
 
-    key, parentPath, err := DecideUpload(current.Path, snapshots, "")
+    key, parentPath, err := DecideUpload(current.Path, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -261,7 +264,7 @@ func TestDecideUpload_ThirdBackupIncremental(t *testing.T) {
     }
     snapshots := []SnapshotInfo{parent, incr1, current}
 
-    key, parentPath, err := DecideUpload(current.Path, snapshots, "")
+    key, parentPath, err := DecideUpload(current.Path, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
@@ -303,7 +306,7 @@ func TestDecideUpload_FullDueToCumulativeIncrementals(t *testing.T) {
         current := SnapshotInfo{Path: incrs[i].Path, Name: incrs[i].Name, HasDone: false}
         snapshots := append(append([]SnapshotInfo{}, prev...), current)
 
-        key, parentPath, err := DecideUpload(current.Path, snapshots, "")
+        key, parentPath, err := DecideUpload(current.Path, snapshots, "", DefaultBackupPolicy)
         if err != nil {
             t.Fatalf("unexpected error at incr %d: %v", i+1, err)
         }
@@ -330,7 +333,7 @@ func TestDecideUpload_FullDueToCumulativeIncrementals(t *testing.T) {
     // Now after 5 incrementals are done, the next snapshot should be full due to cumulative size
     next := SnapshotInfo{Path: "/watch/snap-0007", Name: "snap-0007", HasDone: false}
     snapshots := append(prev, next)
-    key, parentPath, err := DecideUpload(next.Path, snapshots, "")
+    key, parentPath, err := DecideUpload(next.Path, snapshots, "", DefaultBackupPolicy)
     if err != nil {
         t.Fatalf("unexpected error on next snapshot: %v", err)
     }
@@ -342,3 +345,102 @@ func TestDecideUpload_FullDueToCumulativeIncrementals(t *testing.T) {
         t.Fatalf("unexpected key for full due to cumulative: want %q, got %q", expectedFull, key)
     }
 }
+
+func TestFindSnapshots_OrdersByGameTime(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"gt100000", "gt99999", "gt5"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	snapshots, err := FindSnapshots(dir, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	if want := []string{"gt5", "gt99999", "gt100000"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected order: want %q, got %q", want, names)
+	}
+	if names := UnorderableSnapshots(snapshots, ""); len(names) != 0 {
+		t.Fatalf("unexpected unorderable snapshots: %q", names)
+	}
+}
+
+func TestChronologicalOrder(t *testing.T) {
+	layout := "2006-01-02T15-04-05-"
+	names := func(keys []orderKey) []string {
+		var names []string
+		for _, i := range chronologicalOrder(keys) {
+			names = append(names, keys[i].name.Name)
+		}
+		return names
+	}
+	created := func(minute int) time.Time {
+		return time.Date(2026, 10, 18, 21, minute, 0, 0, time.UTC)
+	}
+
+	// The time prefix wins over the game time, which restarts with a new world
+	keys := []orderKey{
+		{name: ParseSnapshotName("2026-10-18T22-00-00-gt10", layout)},
+		{name: ParseSnapshotName("2026-10-18T21-00-00-gt99999", layout)},
+	}
+	if got, want := names(keys), []string{"2026-10-18T21-00-00-gt99999", "2026-10-18T22-00-00-gt10"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected order: want %q, got %q", want, got)
+	}
+
+	// A name without a game time comes first, the others keep their order
+	keys = []orderKey{
+		{name: ParseSnapshotName("gt200", ""), created: created(3)},
+		{name: ParseSnapshotName("manual", ""), created: created(4)},
+		{name: ParseSnapshotName("gt1000", ""), created: created(1)},
+	}
+	if got, want := names(keys), []string{"manual", "gt200", "gt1000"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected order: want %q, got %q", want, got)
+	}
+
+	// Names without a game time are ordered by creation time among
+	// themselves, or as strings without creation times
+	keys = []orderKey{
+		{name: ParseSnapshotName("pre-upgrade", ""), created: created(1)},
+		{name: ParseSnapshotName("manual", ""), created: created(2)},
+		{name: ParseSnapshotName("gt5", "")},
+	}
+	if got, want := names(keys), []string{"pre-upgrade", "manual", "gt5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected order: want %q, got %q", want, got)
+	}
+	keys[1].created = time.Time{}
+	if got, want := names(keys), []string{"manual", "pre-upgrade", "gt5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected order: want %q, got %q", want, got)
+	}
+}
+
+func TestFindSnapshots_OddNameKeepsGameTimeOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"gt100000", "pre-upgrade", "gt99999", "gt5"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".done"), []byte(`{"type":"incremental","size":1}`), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	snapshots, err := FindSnapshots(dir, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	if want := []string{"pre-upgrade", "gt5", "gt99999", "gt100000"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected order: want %q, got %q", want, names)
+	}
+	if latest := FindLatestDoneSnapshot(snapshots); latest == nil || latest.Name != "gt100000" {
+		t.Fatalf("expected gt100000 to be the latest snapshot, got %+v", latest)
+	}
+}
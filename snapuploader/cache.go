@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StreamCache keeps compressed streams on local disk so restores do not
+// have to download them. It takes part in uploads like a destination, but
+// its state is not tracked in .done files: a stream missing from the cache
+// is simply read from a destination.
+//
+// When the cache grows beyond its size limit, incrementals are evicted
+// before fulls, each least recently used first. Reading a stream from the
+// cache counts as a use.
+type StreamCache struct {
+	LocalDestination
+	maxBytes int64
+}
+
+// NewStreamCache returns the cache configured in cfg, or nil when caching
+// is disabled.
+func NewStreamCache(cfg *Config) *StreamCache {
+	if cfg.CacheDir == "" {
+		return nil
+	}
+	return &StreamCache{
+		LocalDestination: LocalDestination{name: "cache", root: cfg.CacheDir},
+		maxBytes:         cfg.CacheMaxBytes,
+	}
+}
+
+// Open returns the cached stream for key and marks it as recently used.
+func (c *StreamCache) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := c.LocalDestination.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(c.path(key), now, now); err != nil {
+		log.Printf("Warning: failed to update access time of cached %s: %v", key, err)
+	}
+	return f, nil
+}
+
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+	full     bool
+}
+
+// Evict removes streams until the cache fits its size limit.
+func (c *StreamCache) Evict() error {
+	var entries []cacheEntry
+	var total int64
+	err := filepath.WalkDir(c.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Streams still being written are not evictable
+		if d.IsDir() || !strings.HasSuffix(p, ".zst") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, cacheEntry{
+			path:     p,
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+			full:     path.Base(filepath.ToSlash(p)) == "full.zst",
+		})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan cache: %w", err)
+	}
+
+	sortEvictionOrder(entries)
+	for _, entry := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(entry.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to evict %s: %w", entry.path, err)
+		}
+		total -= entry.size
+		log.Printf("Evicted %s from the stream cache (%d bytes)", entry.path, entry.size)
+	}
+	return nil
+}
+
+// sortEvictionOrder sorts entries in the order they should be evicted.
+func sortEvictionOrder(entries []cacheEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].full != entries[j].full {
+			return !entries[i].full
+		}
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+}
+
+// OpenStream returns the stream for key from the cache if it has it, and
+// from the first destination that has it otherwise.
+func OpenStream(ctx context.Context, key string, cache *StreamCache, destinations []Destination) (io.ReadCloser, error) {
+	if cache != nil {
+		if r, err := cache.Open(ctx, key); err == nil {
+			log.Printf("Reading %s from the stream cache", key)
+			return r, nil
+		}
+	}
+
+	var errs []error
+	for _, destination := range destinations {
+		r, err := destination.Open(ctx, key)
+		if err == nil {
+			return r, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", destination.Name(), err))
+	}
+	return nil, fmt.Errorf("stream %s not found: %w", key, errors.Join(errs...))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamCache_EvictsIncrementalsBeforeFulls(t *testing.T) {
+	cache := &StreamCache{LocalDestination: LocalDestination{name: "cache", root: t.TempDir()}, maxBytes: 25}
+
+	// Oldest first: the old full must survive the newer incrementals
+	keys := []string{
+		"backup/a/full.zst",
+		"backup/a/incremental.b.zst",
+		"backup/a/incremental.c.zst",
+	}
+	base := time.Now().Add(-time.Hour)
+	for i, key := range keys {
+		if err := cache.UploadStream(context.Background(), key, strings.NewReader("0123456789")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		used := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(cache.path(key), used, used); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Reading c makes b the least recently used incremental
+	r, err := cache.Open(context.Background(), keys[2])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.Close()
+	if err := cache.UploadStream(context.Background(), StagingKey("backup/a/incremental.d.zst"), strings.NewReader("0123456789")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := cache.Evict(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for key, want := range map[string]bool{
+		keys[0]:                                  true,
+		keys[1]:                                  false,
+		keys[2]:                                  true,
+		StagingKey("backup/a/incremental.d.zst"): true,
+	} {
+		_, err := os.Stat(filepath.Join(cache.root, filepath.FromSlash(key)))
+		if got := err == nil; got != want {
+			t.Fatalf("unexpected presence of %s: want %v, got %v", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CatalogEntry is a stream stored under the key layout of DecideUpload.
+type CatalogEntry struct {
+	Key      string
+	Full     string // Snapshot name of the full backup the chain starts with
+	Snapshot string
+	Parent   string // Empty for a full backup
+}
+
+// IsFull reports whether the entry is a full backup.
+func (e *CatalogEntry) IsFull() bool {
+	return e.Parent == ""
+}
+
+// backupKeyPrefix returns the key prefix all backups are stored under.
+func backupKeyPrefix(prefix string) string {
+	if prefix == "" {
+		return "backup/"
+	}
+	return strings.TrimSuffix(prefix, "/") + "/backup/"
+}
+
+// ParseBackupKey parses a key created by DecideUpload. It returns false for
+// keys of other objects.
+func ParseBackupKey(key string, prefix string) (*CatalogEntry, bool) {
+	rest, ok := strings.CutPrefix(key, backupKeyPrefix(prefix))
+	if !ok || strings.Count(rest, "/") != 1 || strings.HasPrefix(rest, "/") {
+		return nil, false
+	}
+	return parseStreamKey(key)
+}
+
+// parseStreamKey parses the last two segments of a stream key, the full
+// backup directory and the file name.
+func parseStreamKey(key string) (*CatalogEntry, bool) {
+	full, file := path.Base(path.Dir(key)), path.Base(key)
+	if full == "." || full == "/" {
+		return nil, false
+	}
+	if file == "full.zst" {
+		return &CatalogEntry{Key: key, Full: full, Snapshot: full}, true
+	}
+
+	name, ok := strings.CutPrefix(file, "incremental.")
+	if !ok {
+		return nil, false
+	}
+	name, ok = strings.CutSuffix(name, ".zst")
+	if !ok || name == "" {
+		return nil, false
+	}
+	// Without a source, the parent is the full backup itself
+	entry := &CatalogEntry{Key: key, Full: full, Snapshot: name, Parent: full}
+	if i := strings.LastIndex(name, ".from."); i > 0 {
+		entry.Snapshot, entry.Parent = name[:i], name[i+len(".from."):]
+	}
+	return entry, true
+}
+
+// Catalog lists the streams stored on a destination.
+type Catalog struct {
+	entries map[string]*CatalogEntry
+	aliases map[string]string // Snapshots restored by the stream of another one
+}
+
+// LoadCatalog lists the backups stored on destination, with the aliases
+// recorded in the manifests of their chains.
+func LoadCatalog(ctx context.Context, destination Destination, prefix string) (*Catalog, error) {
+	keys, err := destination.List(ctx, backupKeyPrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+	c := NewCatalog(keys, prefix)
+	for _, key := range keys {
+		if path.Base(key) != "manifest.json" {
+			continue
+		}
+		manifest, err := LoadManifest(ctx, destination, key)
+		if err != nil {
+			return nil, err
+		}
+		for snapshot, aliasOf := range manifest.Aliases {
+			c.AddAlias(snapshot, aliasOf)
+		}
+	}
+	return c, nil
+}
+
+// NewCatalog builds a catalog from stored keys, ignoring keys that are not
+// streams.
+func NewCatalog(keys []string, prefix string) *Catalog {
+	c := &Catalog{entries: make(map[string]*CatalogEntry), aliases: make(map[string]string)}
+	for _, key := range keys {
+		if entry, ok := ParseBackupKey(key, prefix); ok {
+			c.entries[entry.Snapshot] = entry
+		}
+	}
+	return c
+}
+
+// Entries returns all streams in chronological order of their snapshot
+// names.
+func (c *Catalog) Entries() []*CatalogEntry {
+	return c.EntriesByTime("")
+}
+
+// EntriesByTime returns all streams in chronological order of their
+// snapshot names, parsing their time prefix with layout.
+func (c *Catalog) EntriesByTime(layout string) []*CatalogEntry {
+	entries := make([]*CatalogEntry, 0, len(c.entries))
+	keys := make([]orderKey, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+		keys = append(keys, orderKey{name: ParseSnapshotName(entry.Snapshot, layout)})
+	}
+	sorted := make([]*CatalogEntry, len(entries))
+	for i, j := range chronologicalOrder(keys) {
+		sorted[i] = entries[j]
+	}
+	return sorted
+}
+
+// Unorderable returns the snapshot names that cannot be ordered by time,
+// which ExpireCandidates cannot place among the others.
+func (c *Catalog) Unorderable(layout string) []string {
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return unorderableNames(names, layout)
+}
+
+// AddAlias records that snapshot was not uploaded and is restored by the
+// stream of aliasOf.
+func (c *Catalog) AddAlias(snapshot string, aliasOf string) {
+	c.aliases[snapshot] = aliasOf
+}
+
+// resolve returns the snapshot whose stream restores snapshot.
+func (c *Catalog) resolve(snapshot string) string {
+	if _, ok := c.entries[snapshot]; !ok {
+		if aliasOf, ok := c.aliases[snapshot]; ok {
+			return aliasOf
+		}
+	}
+	return snapshot
+}
+
+// Lookup returns the stream of a snapshot, or of the snapshot it is an
+// alias of.
+func (c *Catalog) Lookup(snapshot string) (*CatalogEntry, bool) {
+	entry, ok := c.entries[c.resolve(snapshot)]
+	return entry, ok
+}
+
+// Chain returns the streams needed to restore snapshot, starting with its
+// full backup. An alias is restored by the chain of its snapshot.
+func (c *Catalog) Chain(snapshot string) ([]*CatalogEntry, error) {
+	var chain []*CatalogEntry
+	seen := make(map[string]bool)
+	snapshot = c.resolve(snapshot)
+	for name := snapshot; ; {
+		entry, ok := c.entries[name]
+		if !ok {
+			if name == snapshot {
+				return nil, fmt.Errorf("no backup of snapshot %s found", snapshot)
+			}
+			return nil, fmt.Errorf("chain of %s is broken: parent %s is missing", snapshot, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("chain of %s contains a loop at %s", snapshot, name)
+		}
+		seen[name] = true
+		chain = append(chain, entry)
+		if entry.IsFull() {
+			break
+		}
+		name = entry.Parent
+	}
+
+	// Reverse to apply order
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCatalog_Chain(t *testing.T) {
+	keys := []string{
+		"mc/backup/gt100/full.zst",
+		"mc/backup/gt100/incremental.gt200.zst",
+		"mc/backup/gt100/incremental.gt300.from.gt200.zst",
+		"mc/backup/gt100/incremental.gt400.from.gt300.zst.uploading",
+		"mc/backup/gt500/full.zst",
+		"mc/backup/gt500/incremental.gt700.from.gt600.zst",
+		"mc/other/file",
+	}
+	catalog := NewCatalog(keys, "mc/")
+
+	if got := len(catalog.Entries()); got != 5 {
+		t.Fatalf("unexpected number of entries: want 5, got %d", got)
+	}
+
+	chain, err := catalog.Chain("gt300")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, entry := range chain {
+		names = append(names, entry.Snapshot)
+	}
+	if got := strings.Join(names, ","); got != "gt100,gt200,gt300" {
+		t.Fatalf("unexpected chain: want %q, got %q", "gt100,gt200,gt300", got)
+	}
+	if chain[2].Key != "mc/backup/gt100/incremental.gt300.from.gt200.zst" {
+		t.Fatalf("unexpected key: got %q", chain[2].Key)
+	}
+
+	if _, err := catalog.Chain("gt400"); err == nil {
+		t.Fatalf("expected error for a snapshot without a backup")
+	}
+	if _, err := catalog.Chain("gt700"); err == nil || !strings.Contains(err.Error(), "gt600") {
+		t.Fatalf("expected broken chain error naming gt600, got %v", err)
+	}
+}
+
+func TestLoadCatalog_Aliases(t *testing.T) {
+	ctx := context.Background()
+	destination := &LocalDestination{name: PrimaryDestination, root: t.TempDir()}
+	storeChains(t, destination)
+	if err := RecordAlias(ctx, destination, "backup/gt100/incremental.gt200.zst", "gt250", "gt200"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	catalog, err := LoadCatalog(ctx, destination, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry, ok := catalog.Lookup("gt250"); !ok || entry.Snapshot != "gt200" {
+		t.Fatalf("expected gt250 to resolve to the stream of gt200, got %+v", entry)
+	}
+	chain, err := catalog.Chain("gt250")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(chain) != 2 || chain[1].Snapshot != "gt200" {
+		t.Fatalf("unexpected chain of alias: %+v", chain)
+	}
+	// Recording the alias keeps the links of the chain
+	manifest, err := LoadManifest(ctx, destination, "backup/gt100/manifest.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manifest.Links) != 3 || manifest.Aliases["gt250"] != "gt200" {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rinsuki-lab/mc1218c/anvil"
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+// orphanName matches the temporary names btrfs send gives new inodes
+// before renaming them into place.
+var orphanName = regexp.MustCompile(`^o\d+-\d+-\d+$`)
+
+// regionFile is a region file followed through a chain of streams.
+type regionFile struct {
+	header anvil.Header
+	// writes of the stream being read, as offset and length
+	writes [][2]int64
+}
+
+// ChunkReport maps writes to region files to the chunks they changed. The
+// headers of region files are tracked through the whole chain, since a
+// write only identifies a chunk by the location table of its file.
+type ChunkReport struct {
+	// Decode decodes encoded writes to region file headers.
+	Decode func(compression uint64, data []byte, unencodedLen uint64) ([]byte, error)
+
+	files map[string]*regionFile
+
+	// Recording is set while reading the streams to report on
+	Recording bool
+	// Changes holds the bytes written per changed chunk by dimension
+	Changes map[string]map[anvil.ChunkPos]int64
+}
+
+// NewChunkReport returns an empty report.
+func NewChunkReport() *ChunkReport {
+	return &ChunkReport{
+		files:   make(map[string]*regionFile),
+		Changes: make(map[string]map[anvil.ChunkPos]int64),
+	}
+}
+
+// tracked reports whether p is or may become a region file.
+func tracked(p string) bool {
+	if _, ok := anvil.DimensionOf(p); ok {
+		_, _, ok := anvil.ParseRegionName(path.Base(p))
+		return ok
+	}
+	for _, name := range strings.Split(p, "/") {
+		if orphanName.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records a command of the stream.
+func (r *ChunkReport) Add(cmd *sendstream.Command) error {
+	p, _ := cmd.Attrs.String(sendstream.AttrPath)
+	switch cmd.Type {
+	case sendstream.CmdMkfile:
+		if tracked(p) {
+			r.files[p] = &regionFile{}
+		}
+	case sendstream.CmdRename:
+		to, err := cmd.Attrs.String(sendstream.AttrPathTo)
+		if err != nil {
+			return err
+		}
+		r.rename(p, to)
+	case sendstream.CmdLink:
+		existing, err := cmd.Attrs.String(sendstream.AttrPathLink)
+		if err != nil {
+			return err
+		}
+		if file, ok := r.files[existing]; ok {
+			r.files[p] = file
+		}
+	case sendstream.CmdUnlink:
+		delete(r.files, p)
+	case sendstream.CmdWrite:
+		file := r.file(p)
+		if file == nil {
+			return nil
+		}
+		offset, err := cmd.Attrs.Uint64(sendstream.AttrFileOffset)
+		if err != nil {
+			return err
+		}
+		data, err := cmd.Attrs.Bytes(sendstream.AttrData)
+		if err != nil {
+			return err
+		}
+		file.write(int64(offset), data)
+	case sendstream.CmdEncodedWrite:
+		file := r.file(p)
+		if file == nil {
+			return nil
+		}
+		offset, err := cmd.Attrs.Uint64(sendstream.AttrFileOffset)
+		if err != nil {
+			return err
+		}
+		length, err := cmd.Attrs.Uint64(sendstream.AttrUnencodedFileLen)
+		if err != nil {
+			return err
+		}
+		if offset >= anvil.HeaderSize {
+			// Only the header needs the data itself
+			file.writes = append(file.writes, [2]int64{int64(offset), int64(length)})
+			return nil
+		}
+		data, _, err := sendstream.DecodeEncodedWrite(cmd.Attrs, r.Decode)
+		if err != nil {
+			return err
+		}
+		file.write(int64(offset), data)
+	case sendstream.CmdClone:
+		file := r.file(p)
+		if file == nil {
+			return nil
+		}
+		offset, err := cmd.Attrs.Uint64(sendstream.AttrFileOffset)
+		if err != nil {
+			return err
+		}
+		length, err := cmd.Attrs.Uint64(sendstream.AttrCloneLen)
+		if err != nil {
+			return err
+		}
+		file.writes = append(file.writes, [2]int64{int64(offset), int64(length)})
+		if offset < anvil.HeaderSize {
+			// Copy the header bytes if the source is a tracked file too
+			var source anvil.Header
+			sourcePath, _ := cmd.Attrs.String(sendstream.AttrClonePath)
+			sourceOffset, _ := cmd.Attrs.Uint64(sendstream.AttrCloneOffset)
+			if from, ok := r.files[sourcePath]; ok {
+				source = from.header
+			}
+			for i := int64(0); i < int64(length) && int64(offset)+i < anvil.HeaderSize; i++ {
+				if s := int64(sourceOffset) + i; s < anvil.HeaderSize {
+					file.header[int64(offset)+i] = source[s]
+				}
+			}
+		}
+	case sendstream.CmdTruncate:
+		file := r.file(p)
+		if file == nil {
+			return nil
+		}
+		size, err := cmd.Attrs.Uint64(sendstream.AttrSize)
+		if err != nil {
+			return err
+		}
+		if size < anvil.HeaderSize {
+			clear(file.header[size:])
+		}
+	case sendstream.CmdEnd:
+		r.settle()
+	}
+	return nil
+}
+
+// file returns the tracked file at p, starting to track it if needed.
+// Files that existed before the first stream read are unknown.
+func (r *ChunkReport) file(p string) *regionFile {
+	if file, ok := r.files[p]; ok {
+		return file
+	}
+	if !tracked(p) {
+		return nil
+	}
+	file := &regionFile{}
+	r.files[p] = file
+	return file
+}
+
+func (f *regionFile) write(offset int64, data []byte) {
+	f.writes = append(f.writes, [2]int64{offset, int64(len(data))})
+	if offset < anvil.HeaderSize {
+		copy(f.header[offset:], data)
+	}
+}
+
+// rename moves the files at from, and below it, to to.
+func (r *ChunkReport) rename(from string, to string) {
+	moved := make(map[string]*regionFile)
+	for p, file := range r.files {
+		switch {
+		case p == from:
+			moved[to] = file
+		case strings.HasPrefix(p, from+"/"):
+			moved[to+p[len(from):]] = file
+		default:
+			continue
+		}
+		delete(r.files, p)
+	}
+	for p, file := range moved {
+		r.files[p] = file
+	}
+}
+
+// settle maps the writes of a finished stream to chunks. The location
+// table is read after the whole stream, as btrfs send writes it before the
+// chunk data that follows it in the file.
+func (r *ChunkReport) settle() {
+	for p, file := range r.files {
+		writes := file.writes
+		file.writes = nil
+		if !r.Recording || len(writes) == 0 {
+			continue
+		}
+		dimension, ok := anvil.DimensionOf(p)
+		if !ok {
+			continue
+		}
+		regionX, regionZ, ok := anvil.ParseRegionName(path.Base(p))
+		if !ok {
+			continue
+		}
+		changes := r.Changes[dimension]
+		if changes == nil {
+			changes = make(map[anvil.ChunkPos]int64)
+			r.Changes[dimension] = changes
+		}
+		for _, write := range writes {
+			chunks := file.header.ChunksInRange(write[0], write[1])
+			for _, i := range chunks {
+				changes[anvil.ChunkAt(regionX, regionZ, i)] += write[1] / int64(len(chunks))
+			}
+		}
+	}
+}
+
+// WriteChunkReport prints the changed chunks of each dimension.
+func WriteChunkReport(w io.Writer, report *ChunkReport) {
+	dimensions := make([]string, 0, len(report.Changes))
+	for dimension := range report.Changes {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	for _, dimension := range dimensions {
+		changes := report.Changes[dimension]
+		positions := make([]anvil.ChunkPos, 0, len(changes))
+		for pos := range changes {
+			positions = append(positions, pos)
+		}
+		sort.Slice(positions, func(i, j int) bool {
+			if positions[i].Z != positions[j].Z {
+				return positions[i].Z < positions[j].Z
+			}
+			return positions[i].X < positions[j].X
+		})
+		fmt.Fprintf(w, "%s: %d chunks changed\n", dimension, len(positions))
+		for _, pos := range positions {
+			fmt.Fprintf(w, "  %d,%d\t%d bytes\n", pos.X, pos.Z, changes[pos])
+		}
+	}
+}
+
+func chunksCommand(args []string) error {
+	flags := flag.NewFlagSet("chunks", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to read from")
+	since := flags.String("since", "", "report changes after this snapshot instead of the parent")
+	pngPrefix := flags.String("png", "", "write a heatmap per dimension to <prefix>-<dimension>.png")
+	scale := flags.Int("scale", 4, "heatmap pixels per chunk")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *scale < 1 {
+		return fmt.Errorf("usage: snapuploader chunks [-from <destination>] [-since <snapshot>] [-png <prefix>] [-scale <n>] <snapshot>")
+	}
+	snapshot := flags.Arg(0)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	source, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, source, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	chain, err := catalog.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	// Report on the last stream, or on every stream after since
+	first := len(chain) - 1
+	if *since != "" {
+		first = -1
+		for i, entry := range chain {
+			if entry.Snapshot == *since {
+				first = i + 1
+			}
+		}
+		if first < 0 {
+			return fmt.Errorf("%s is not in the chain of %s", *since, snapshot)
+		}
+	}
+
+	report := NewChunkReport()
+	report.Decode = decodeExtent
+	cache := NewStreamCache(cfg)
+	for i, entry := range chain {
+		report.Recording = i >= first
+		if err := scanStoredStream(ctx, entry.Key, cache, source, report.Add); err != nil {
+			return fmt.Errorf("failed to read %s: %w", entry.Key, err)
+		}
+	}
+
+	WriteChunkReport(os.Stdout, report)
+	if *pngPrefix != "" {
+		for dimension, changes := range report.Changes {
+			name := fmt.Sprintf("%s-%s.png", *pngPrefix, strings.ReplaceAll(dimension, ":", "_"))
+			if err := writePNG(name, changes, *scale); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", name)
+		}
+	}
+	return nil
+}
+
+// scanStoredStream calls fn for every command of a stored stream.
+func scanStoredStream(ctx context.Context, key string, cache *StreamCache, source Destination, fn func(*sendstream.Command) error) error {
+	r, err := OpenStream(ctx, key, cache, []Destination{source})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	stream, err := DecompressStream(ctx, r)
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	err = sendstream.Walk(stream, func(cmd *sendstream.Command) {
+		if fnErr == nil {
+			fnErr = fn(cmd)
+		}
+	})
+	if err == nil {
+		err = fnErr
+	}
+	if cerr := stream.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writePNG(name string, changes map[anvil.ChunkPos]int64, scale int) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, anvil.Heatmap(changes, scale)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/rinsuki-lab/mc1218c/anvil"
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+func writeCommand(p string, offset uint64, data []byte) *sendstream.Command {
+	return &sendstream.Command{Type: sendstream.CmdWrite, Attrs: sendstream.Attributes{
+		sendstream.AttrPath:       []byte(p),
+		sendstream.AttrFileOffset: binary.LittleEndian.AppendUint64(nil, offset),
+		sendstream.AttrData:       data,
+	}}
+}
+
+func pathCommand(cmdType uint16, p string, attrs sendstream.Attributes) *sendstream.Command {
+	if attrs == nil {
+		attrs = sendstream.Attributes{}
+	}
+	attrs[sendstream.AttrPath] = []byte(p)
+	return &sendstream.Command{Type: cmdType, Attrs: attrs}
+}
+
+func TestChunkReport(t *testing.T) {
+	// Chunk 0 in sectors 2-3, chunk 33 in sector 4
+	header := make([]byte, anvil.HeaderSize)
+	binary.BigEndian.PutUint32(header[0:], 2<<8|2)
+	binary.BigEndian.PutUint32(header[4*33:], 4<<8|1)
+
+	full := []*sendstream.Command{
+		pathCommand(sendstream.CmdMkfile, "o260-5-0", nil),
+		pathCommand(sendstream.CmdRename, "o260-5-0", sendstream.Attributes{sendstream.AttrPathTo: []byte("world_nether/DIM-1/region/r.-1.0.mca")}),
+		writeCommand("world_nether/DIM-1/region/r.-1.0.mca", 0, header),
+		writeCommand("world_nether/DIM-1/region/r.-1.0.mca", 2*anvil.SectorSize, make([]byte, 3*anvil.SectorSize)),
+		{Type: sendstream.CmdEnd},
+	}
+	// The incremental only rewrites the data of chunk 33
+	incremental := []*sendstream.Command{
+		writeCommand("world_nether/DIM-1/region/r.-1.0.mca", 4*anvil.SectorSize+10, make([]byte, 100)),
+		writeCommand("world/level.dat", 0, make([]byte, 100)),
+		{Type: sendstream.CmdEnd},
+	}
+
+	report := NewChunkReport()
+	for i, stream := range [][]*sendstream.Command{full, incremental} {
+		report.Recording = i == 1
+		for _, cmd := range stream {
+			if err := report.Add(cmd); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	changes := report.Changes[anvil.Nether]
+	if len(report.Changes) != 1 || len(changes) != 1 {
+		t.Fatalf("unexpected changes: %v", report.Changes)
+	}
+	if got := changes[anvil.ChunkPos{X: -31, Z: 1}]; got != 100 {
+		t.Fatalf("unexpected bytes for chunk -31,1: want 100, got %d", got)
+	}
+}
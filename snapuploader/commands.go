@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+const usage = `Usage: snapuploader [command] [arguments]
+
+Without a command, snapuploader watches the snapshot directory and uploads
+new snapshots.
+
+Commands:
+  status                show the processing state of every local snapshot
+  retry <snapshot>      clear the failure record so the snapshot is retried
+  discard <snapshot>    stop trying to upload a failing snapshot
+  config check [file]   validate the configuration and print the effective
+                        values with secrets masked
+  list [-from <destination>]
+                        list the stored backups with the in-game day and
+                        Minecraft version of each
+  dump <stream>         print the operations in a stored send stream; the
+                        stream is an s3:// URL, a local file or a key
+  restore [-from <destination>] <snapshot> <directory>
+                        restore a snapshot into an empty ordinary directory
+                        by applying its full and incremental streams
+  restore [-from <destination>] [-yes] -at <time>|-tick <game time> <directory>
+                        restore the latest snapshot taken at or before a
+                        time like "2026-10-18 21:40" or a game time
+  extract [-from <destination>] <snapshot> <path> <directory>
+                        write a single file or directory of a snapshot
+                        below directory
+  chunks [-from <destination>] [-since <snapshot>] [-png <prefix>] [-scale <n>] <snapshot>
+                        list the chunks of each dimension a snapshot changed,
+                        optionally with a heatmap image per dimension drawn
+                        with n pixels per chunk (default 4)
+  player stage [-from <destination>] <player> <snapshot> <directory>
+                        extract the data, statistics and advancements of a
+                        player, given by name or UUID, and show their
+                        inventory and position
+  player apply [-offline] <directory>
+                        put staged player files in place once the player
+                        is offline, keeping the replaced files
+  query [-from <destination>] <path>
+                        list the backups that changed a path, for example
+                        "r.3.-2.mca" or "playerdata/*.dat"
+  pin [-label <text>] <snapshot>
+                        keep a backup forever, with every stream it
+                        depends on, locally and on every destination
+  unpin <snapshot>      let retention delete a pinned backup again
+  prune [-keep <n>] [-dry-run]
+                        delete uploaded local snapshots except the latest,
+                        the current chain and pinned ones
+  expire [-from <destination>] [-keep <n>] [-dry-run]
+                        delete all but the latest chains from a destination,
+                        keeping chains with a pinned backup
+
+The configuration is read from the JSON file named by SNAPUPLOADER_CONFIG,
+if set, and environment variables, which take precedence over the file.
+`
+
+// runCommand runs an operator command and returns the process exit code.
+func runCommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "status":
+		err = statusCommand(args)
+	case "retry":
+		err = retryCommand(args)
+	case "discard":
+		err = discardCommand(args)
+	case "config":
+		err = configCommand(args)
+	case "list":
+		err = listCommand(args)
+	case "dump":
+		err = dumpCommand(args)
+	case "restore":
+		err = restoreCommand(args)
+	case "extract":
+		err = extractCommand(args)
+	case "player":
+		err = playerCommand(args)
+	case "query":
+		err = queryCommand(args)
+	case "chunks":
+		err = chunksCommand(args)
+	case "pin":
+		err = pinCommand(args)
+	case "unpin":
+		err = unpinCommand(args)
+	case "prune":
+		err = pruneCommand(args)
+	case "expire":
+		err = expireCommand(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapuploader %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func statusCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("status takes no arguments")
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	snapshots, err := FindSnapshots(cfg.WatchDir, cfg.SnapshotTimeLayout)
+	if err != nil {
+		return err
+	}
+	if err := WriteStatus(os.Stdout, snapshots, cfg.MaxAttempts, cfg.DestinationNames()); err != nil {
+		return err
+	}
+	if names := UnorderableSnapshots(snapshots, cfg.SnapshotTimeLayout); len(names) > 0 {
+		fmt.Fprintf(os.Stderr, "\nCannot tell the time of these snapshots from their names, so they are ordered before all others: %s\n", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// snapshotArgPath resolves the single snapshot name argument of a command
+// to its path in the watch directory.
+func snapshotArgPath(cfg *Config, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected exactly one snapshot name")
+	}
+	name := args[0]
+	if name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	snapshotPath := filepath.Join(cfg.WatchDir, name)
+	if fi, err := os.Stat(snapshotPath); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("snapshot %q not found in %s", name, cfg.WatchDir)
+	}
+	return snapshotPath, nil
+}
+
+func retryCommand(args []string) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	snapshotPath, err := snapshotArgPath(cfg, args)
+	if err != nil {
+		return err
+	}
+	if err := ClearFailure(snapshotPath); err != nil {
+		return err
+	}
+	fmt.Printf("Cleared failure record of %s; it will be retried\n", filepath.Base(snapshotPath))
+	return nil
+}
+
+func discardCommand(args []string) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	snapshotPath, err := snapshotArgPath(cfg, args)
+	if err != nil {
+		return err
+	}
+	if err := DiscardSnapshot(snapshotPath); err != nil {
+		return err
+	}
+	fmt.Printf("Discarded %s; it will not be uploaded\n", filepath.Base(snapshotPath))
+	return nil
+}
+
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		return fmt.Errorf("usage: snapuploader config check [file]")
+	}
+	path := os.Getenv("SNAPUPLOADER_CONFIG")
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	masked, err := cfg.Masked()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(masked, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	for _, warning := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	fmt.Fprintln(os.Stderr, "Configuration is valid")
+	return nil
+}
+
+func dumpCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: snapuploader dump <stream>")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stream, err := OpenSendStream(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := sendstream.Dump(os.Stdout, stream); err != nil {
+		stream.Close()
+		return err
+	}
+	return stream.Close()
+}
@@ -1,54 +1,542 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"time"
 )
 
+// Config is the effective snapuploader configuration. Values are taken from
+// the defaults, then the optional JSON config file named by
+// SNAPUPLOADER_CONFIG, then the environment variables in the env tags.
 type Config struct {
-	WatchDir       string
-	S3Hostname     string
-	S3Bucket       string
-	S3AccessKey    string
-	S3SecretKey    string
-	S3Region       string
-	SnapshotPrefix string
+	WatchDir       string `json:"watchDir" env:"WATCH_DIR"`
+	SnapshotPrefix string `json:"snapshotPrefix" env:"SNAPSHOT_PREFIX"`
+
+	// The primary S3 destination
+	S3Config
+
+	// Destinations is the list of additional destinations every backup
+	// is replicated to. They can only be set in the config file.
+	Destinations []DestinationConfig `json:"destinations"`
+
+	ZstdLevel   int `json:"zstdLevel" env:"ZSTD_LEVEL"`
+	ZstdThreads int `json:"zstdThreads" env:"ZSTD_THREADS"`
+
+	Policy BackupPolicy `json:"policy"`
+
+	Send SendOptions `json:"send"` // Options of btrfs send, recorded in .done files
+
+	CacheDir      string `json:"cacheDir" env:"STREAM_CACHE_DIR"`            // Local copy of uploaded streams for restores, disabled when empty
+	CacheMaxBytes int64  `json:"cacheMaxBytes" env:"STREAM_CACHE_MAX_BYTES"` // Size limit of the stream cache
+
+	IntegrityCheck string `json:"integrityCheck" env:"INTEGRITY_CHECK"` // Region file check before upload: "off", "flag" or "refuse"
+
+	LevelDat string `json:"levelDat" env:"LEVEL_DAT"` // Path of level.dat below a snapshot, searched for when empty
+
+	// Go time layout of the time prefix of snapshot names, as in the
+	// snapshotter's SNAPSHOT_PREFIX. Empty if names carry no time.
+	SnapshotTimeLayout string `json:"snapshotTimeLayout" env:"SNAPSHOT_TIME_LAYOUT"`
+
+	// The live server, used to roll back player files
+	SnapshotSource string `json:"snapshotSource" env:"SNAPSHOT_SRC"` // Subvolume the snapshots are taken of
+	UserCache      string `json:"userCache" env:"USERCACHE_PATH"`    // usercache.json mapping player names to UUIDs
+	RCONAddress    string `json:"rconAddress" env:"RCON_ADDRESS"`
+	RCONPassword   string `json:"rconPassword" env:"RCON_PASSWORD" secret:"true"`
+
+	MaxAttempts         int      `json:"maxAttempts" env:"MAX_SNAPSHOT_ATTEMPTS"`         // Failed attempts before a snapshot is quarantined
+	MetricsAddr         string   `json:"metricsAddr" env:"METRICS_ADDR"`                  // Listen address for the metrics endpoint, disabled when empty
+	ReadyTimeout        Duration `json:"readyTimeout" env:"SNAPSHOT_READY_TIMEOUT"`       // How long to wait for a new snapshot to become ready
+	RescanInterval      Duration `json:"rescanInterval" env:"RESCAN_INTERVAL"`            // Interval of the fallback rescan, disabled when zero
+	ShutdownGracePeriod Duration `json:"shutdownGracePeriod" env:"SHUTDOWN_GRACE_PERIOD"` // How long an upload may continue after SIGTERM
+}
+
+// S3Config configures an S3 bucket backups are uploaded to.
+type S3Config struct {
+	S3Hostname string `json:"s3Hostname" env:"S3_HOSTNAME"` // Host of an HTTPS endpoint
+	S3Endpoint string `json:"s3Endpoint" env:"S3_ENDPOINT"` // Full endpoint URL, alternative to S3Hostname
+	S3Bucket   string `json:"s3Bucket" env:"S3_BUCKET"`
+	S3Region   string `json:"s3Region" env:"S3_REGION"`
+
+	// Static credentials, given directly or as files that are re-read when
+	// they change. Without them the default AWS credential chain is used.
+	S3AccessKey        string `json:"s3AccessKey" env:"S3_ACCESS_KEY" secret:"true"`
+	S3AccessKeyFile    string `json:"s3AccessKeyFile" env:"S3_ACCESS_KEY_FILE"`
+	S3SecretKey        string `json:"s3SecretKey" env:"S3_SECRET_KEY" secret:"true"`
+	S3SecretKeyFile    string `json:"s3SecretKeyFile" env:"S3_SECRET_KEY_FILE"`
+	S3SessionToken     string `json:"s3SessionToken" env:"S3_SESSION_TOKEN" secret:"true"`
+	S3SessionTokenFile string `json:"s3SessionTokenFile" env:"S3_SESSION_TOKEN_FILE"`
+
+	// Options for self-hosted S3-compatible storage
+	S3UsePathStyle          bool   `json:"s3UsePathStyle" env:"S3_USE_PATH_STYLE"`                   // Address buckets as endpoint/bucket/key
+	S3CABundle              string `json:"s3CABundle" env:"S3_CA_BUNDLE"`                            // PEM file with additional trusted CAs
+	S3DisablePayloadSigning bool   `json:"s3DisablePayloadSigning" env:"S3_DISABLE_PAYLOAD_SIGNING"` // Send UNSIGNED-PAYLOAD instead of the body hash
+
+	S3PartSize    int64 `json:"s3PartSize" env:"S3_PART_SIZE"`       // Multipart upload part size in bytes
+	S3Concurrency int   `json:"s3Concurrency" env:"S3_CONCURRENCY"`  // Parts uploaded in parallel
+	S3MaxAttempts int   `json:"s3MaxAttempts" env:"S3_MAX_ATTEMPTS"` // Attempts per S3 request
+}
+
+// Destination types
+const (
+	DestinationS3    = "s3"
+	DestinationLocal = "local"
+)
+
+// PrimaryDestination is the name of the destination configured by the
+// top-level S3 settings.
+const PrimaryDestination = "primary"
+
+// DestinationConfig configures an additional backup destination.
+type DestinationConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "s3" or "local"
+	Path string `json:"path"` // Root directory of a local destination
+
+	// Settings of an S3 destination, defaults as for the primary
+	S3Config
+}
+
+// BackupPolicy controls when a new full backup is started.
+type BackupPolicy struct {
+	// MaxIncrementals is the number of incrementals after which the next
+	// backup is a full one.
+	MaxIncrementals int `json:"maxIncrementals" env:"POLICY_MAX_INCREMENTALS"`
+	// MaxCumulativeRatio is the ratio of the cumulative incremental size
+	// to the size of the last full above which the next backup is a full
+	// one.
+	MaxCumulativeRatio float64 `json:"maxCumulativeRatio" env:"POLICY_MAX_CUMULATIVE_RATIO"`
+	// SkipEmptyBelow skips incrementals that only change or replace files,
+	// like level.dat on every save, and write less than this many bytes.
+	// They are recorded as aliases of their parent. Zero uploads every
+	// incremental, one skips those that change nothing but timestamps.
+	SkipEmptyBelow int64 `json:"skipEmptyBelow" env:"POLICY_SKIP_EMPTY_BELOW"`
+}
+
+// SendOptions configures the btrfs send stream.
+type SendOptions struct {
+	// Protocol is the send stream version, 0 for the btrfs default.
+	Protocol int `json:"protocol" env:"SEND_PROTOCOL"`
+	// CompressedData passes compressed extents through as they are
+	// instead of decompressing them. It requires protocol 2.
+	CompressedData bool `json:"compressedData" env:"SEND_COMPRESSED_DATA"`
+	// CloneSources is the number of earlier snapshots of the chain passed
+	// to incrementals as clone sources, so reflinked data is not resent.
+	// Such chains can only be restored with btrfs receive: restore,
+	// including point-in-time restores, extract and player stage refuse
+	// them, so config check and startup warn when it is set.
+	CloneSources int `json:"cloneSources" env:"SEND_CLONE_SOURCES"`
+}
+
+// DefaultBackupPolicy is the policy used when none is configured.
+var DefaultBackupPolicy = BackupPolicy{
+	MaxIncrementals:    990,
+	MaxCumulativeRatio: 1.0,
 }
 
+// Duration is a time.Duration written as a string like "90s" in the config
+// file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// DefaultConfig returns the configuration used before the config file and
+// the environment are applied.
+func DefaultConfig() *Config {
+	return &Config{
+		S3Config:            DefaultS3Config(),
+		ZstdLevel:           22,
+		ZstdThreads:         1,
+		Policy:              DefaultBackupPolicy,
+		MaxAttempts:         3,
+		ReadyTimeout:        Duration(time.Minute),
+		RescanInterval:      Duration(10 * time.Minute),
+		ShutdownGracePeriod: Duration(20 * time.Second),
+		CacheMaxBytes:       50 * 1024 * 1024 * 1024, // 50GB
+		IntegrityCheck:      IntegrityOff,
+		UserCache:           "/minecraft/usercache.json",
+		RCONAddress:         "127.0.0.1:25575",
+	}
+}
+
+// DefaultS3Config returns the defaults of an S3 destination.
+func DefaultS3Config() S3Config {
+	return S3Config{
+		S3Region:      "auto",
+		S3PartSize:    16 * 1024 * 1024, // 16MB parts
+		S3Concurrency: 3,
+		S3MaxAttempts: 10,
+	}
+}
+
+// UnmarshalJSON applies the S3 defaults before decoding a destination.
+func (d *DestinationConfig) UnmarshalJSON(data []byte) error {
+	// The alias type drops this method to avoid recursion
+	type destinationConfig DestinationConfig
+	decoded := destinationConfig{S3Config: DefaultS3Config()}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+	*d = DestinationConfig(decoded)
+	return nil
+}
+
+// LoadConfig loads the configuration from the file named by
+// SNAPUPLOADER_CONFIG, if set, and the environment.
 func LoadConfig() (*Config, error) {
-	config := &Config{
-		WatchDir:       os.Getenv("WATCH_DIR"),
-		S3Hostname:     os.Getenv("S3_HOSTNAME"),
-		S3Bucket:       os.Getenv("S3_BUCKET"),
-		S3AccessKey:    os.Getenv("S3_ACCESS_KEY"),
-		S3SecretKey:    os.Getenv("S3_SECRET_KEY"),
-		S3Region:       os.Getenv("S3_REGION"),
-		SnapshotPrefix: os.Getenv("SNAPSHOT_PREFIX"),
+	return LoadConfigFile(os.Getenv("SNAPUPLOADER_CONFIG"))
+}
+
+// LoadConfigFile loads the configuration from path, if not empty, and the
+// environment, and validates the result.
+func LoadConfigFile(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := decodeConfig(data, config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(config).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decodeConfig decodes a JSON config file over config, rejecting unknown
+// keys.
+func decodeConfig(data []byte, config *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return err
 	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the config object")
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnv overrides the fields of v with the environment variables named
+// in their env tags.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok || env == "" {
+			continue
+		}
+
+		if err := setFromString(value, env); err != nil {
+			return fmt.Errorf("invalid %s environment variable %q: %w", name, env, err)
+		}
+	}
+	return nil
+}
 
-	if config.WatchDir == "" {
-		return nil, fmt.Errorf("WATCH_DIR environment variable is required")
+func setFromString(value reflect.Value, s string) error {
+	if value.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+		return nil
 	}
 
-	if config.S3Hostname == "" {
-		return nil, fmt.Errorf("S3_HOSTNAME environment variable is required")
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported config field type %s", value.Type())
 	}
+	return nil
+}
 
-	if config.S3Bucket == "" {
-		return nil, fmt.Errorf("S3_BUCKET environment variable is required")
+// Validate checks the configuration and returns all problems found.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.WatchDir == "" {
+		errs = append(errs, fmt.Errorf("watchDir (WATCH_DIR) is required"))
 	}
+	errs = append(errs, c.S3Config.validate("")...)
 
-	if config.S3AccessKey == "" {
-		return nil, fmt.Errorf("S3_ACCESS_KEY environment variable is required")
+	names := map[string]bool{PrimaryDestination: true}
+	for i := range c.Destinations {
+		d := &c.Destinations[i]
+		field := fmt.Sprintf("destinations[%d]", i)
+		switch {
+		case d.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name is required", field))
+		case names[d.Name]:
+			errs = append(errs, fmt.Errorf("%s.name %q is not unique", field, d.Name))
+		}
+		names[d.Name] = true
+
+		switch d.Type {
+		case DestinationS3:
+			errs = append(errs, d.S3Config.validate(field+".")...)
+		case DestinationLocal:
+			if d.Path == "" {
+				errs = append(errs, fmt.Errorf("%s.path is required for local destinations", field))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.type must be %q or %q, got %q", field, DestinationS3, DestinationLocal, d.Type))
+		}
 	}
 
-	if config.S3SecretKey == "" {
-		return nil, fmt.Errorf("S3_SECRET_KEY environment variable is required")
+	if c.ZstdLevel < 1 || c.ZstdLevel > 22 {
+		errs = append(errs, fmt.Errorf("zstdLevel must be between 1 and 22, got %d", c.ZstdLevel))
+	}
+	if c.ZstdThreads < 0 {
+		errs = append(errs, fmt.Errorf("zstdThreads must not be negative (0 uses all cores), got %d", c.ZstdThreads))
+	}
+	if c.Policy.MaxIncrementals < 1 {
+		errs = append(errs, fmt.Errorf("policy.maxIncrementals must be at least 1, got %d", c.Policy.MaxIncrementals))
+	}
+	if c.Policy.MaxCumulativeRatio <= 0 {
+		errs = append(errs, fmt.Errorf("policy.maxCumulativeRatio must be positive, got %g", c.Policy.MaxCumulativeRatio))
+	}
+	if c.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("maxAttempts must be at least 1, got %d", c.MaxAttempts))
 	}
+	if c.ReadyTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("readyTimeout must be positive, got %s", time.Duration(c.ReadyTimeout)))
+	}
+	if c.RescanInterval < 0 {
+		errs = append(errs, fmt.Errorf("rescanInterval must not be negative (0 disables), got %s", time.Duration(c.RescanInterval)))
+	}
+	if c.ShutdownGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("shutdownGracePeriod must not be negative, got %s", time.Duration(c.ShutdownGracePeriod)))
+	}
+	if c.CacheDir != "" && c.CacheMaxBytes <= 0 {
+		errs = append(errs, fmt.Errorf("cacheMaxBytes must be positive, got %d", c.CacheMaxBytes))
+	}
+	if c.Policy.SkipEmptyBelow < 0 {
+		errs = append(errs, fmt.Errorf("policy.skipEmptyBelow must not be negative, got %d", c.Policy.SkipEmptyBelow))
+	}
+	if c.Send.Protocol < 0 || c.Send.Protocol > 2 {
+		errs = append(errs, fmt.Errorf("send.protocol must be 0, 1 or 2, got %d", c.Send.Protocol))
+	}
+	if c.Send.CompressedData && c.Send.Protocol != 2 {
+		errs = append(errs, fmt.Errorf("send.compressedData requires send.protocol 2"))
+	}
+	if c.Send.CloneSources < 0 {
+		errs = append(errs, fmt.Errorf("send.cloneSources must not be negative, got %d", c.Send.CloneSources))
+	}
+	switch c.IntegrityCheck {
+	case IntegrityOff, IntegrityFlag, IntegrityRefuse:
+	default:
+		errs = append(errs, fmt.Errorf("integrityCheck must be %q, %q or %q, got %q", IntegrityOff, IntegrityFlag, IntegrityRefuse, c.IntegrityCheck))
+	}
+
+	return errors.Join(errs...)
+}
 
-	if config.S3Region == "" {
-		config.S3Region = "auto"
+// Warnings returns settings that are valid but limit what can be done with
+// the uploaded backups.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.Send.CloneSources > 0 {
+		warnings = append(warnings, "send.cloneSources is set: chains uploaded with clone sources can only be restored with btrfs receive, not with restore, extract or player stage")
 	}
+	return warnings
+}
 
-	return config, nil
-}
\ No newline at end of file
+// validate checks the S3 settings. prefix is prepended to the key names in
+// error messages.
+func (c *S3Config) validate(prefix string) []error {
+	var errs []error
+	if c.S3Bucket == "" {
+		errs = append(errs, fmt.Errorf("%ss3Bucket (S3_BUCKET) is required", prefix))
+	}
+
+	switch {
+	case c.S3Hostname == "" && c.S3Endpoint == "":
+		errs = append(errs, fmt.Errorf("%ss3Hostname (S3_HOSTNAME) or %ss3Endpoint (S3_ENDPOINT) is required", prefix, prefix))
+	case c.S3Hostname != "" && c.S3Endpoint != "":
+		errs = append(errs, fmt.Errorf("%ss3Hostname and %ss3Endpoint must not both be set", prefix, prefix))
+	case c.S3Endpoint != "":
+		u, err := url.Parse(c.S3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%ss3Endpoint must be an http:// or https:// URL, got %q", prefix, c.S3Endpoint))
+		}
+	}
+	if c.S3CABundle != "" {
+		if _, err := os.Stat(c.S3CABundle); err != nil {
+			errs = append(errs, fmt.Errorf("%ss3CABundle: %w", prefix, err))
+		}
+	}
+
+	// Credentials are optional, but must be complete when given
+	exclusive := func(value string, file string, key string) {
+		if value != "" && file != "" {
+			errs = append(errs, fmt.Errorf("%s%s and %s%sFile must not both be set", prefix, key, prefix, key))
+		}
+	}
+	exclusive(c.S3AccessKey, c.S3AccessKeyFile, "s3AccessKey")
+	exclusive(c.S3SecretKey, c.S3SecretKeyFile, "s3SecretKey")
+	exclusive(c.S3SessionToken, c.S3SessionTokenFile, "s3SessionToken")
+	hasAccessKey := c.S3AccessKey != "" || c.S3AccessKeyFile != ""
+	hasSecretKey := c.S3SecretKey != "" || c.S3SecretKeyFile != ""
+	hasSessionToken := c.S3SessionToken != "" || c.S3SessionTokenFile != ""
+	if hasAccessKey != hasSecretKey {
+		errs = append(errs, fmt.Errorf("%ss3AccessKey and %ss3SecretKey (or their File variants) must be set together", prefix, prefix))
+	}
+	if hasSessionToken && !hasAccessKey {
+		errs = append(errs, fmt.Errorf("%ss3SessionToken requires s3AccessKey and s3SecretKey", prefix))
+	}
+
+	// S3 allows 5MiB to 5GiB per part
+	if c.S3PartSize < 5*1024*1024 || c.S3PartSize > 5*1024*1024*1024 {
+		errs = append(errs, fmt.Errorf("%ss3PartSize must be between 5MiB and 5GiB, got %d", prefix, c.S3PartSize))
+	}
+	if c.S3Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("%ss3Concurrency must be at least 1, got %d", prefix, c.S3Concurrency))
+	}
+	if c.S3MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("%ss3MaxAttempts must be at least 1, got %d", prefix, c.S3MaxAttempts))
+	}
+	return errs
+}
+
+// DestinationNames returns the names of all destinations, the primary one
+// first.
+func (c *Config) DestinationNames() []string {
+	names := []string{PrimaryDestination}
+	for _, d := range c.Destinations {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+// S3EndpointURL returns the URL of the S3 endpoint.
+func (c *S3Config) S3EndpointURL() string {
+	if c.S3Endpoint != "" {
+		return c.S3Endpoint
+	}
+	return "https://" + c.S3Hostname
+}
+
+// Masked returns a copy of the configuration as a generic JSON object with
+// the values of secret fields replaced.
+func (c *Config) Masked() (map[string]any, error) {
+	return maskedValue(reflect.ValueOf(c).Elem())
+}
+
+func maskedValue(v reflect.Value) (map[string]any, error) {
+	out := make(map[string]any)
+	if err := maskInto(out, v); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// maskInto adds the fields of the struct v to out. Fields of embedded
+// structs are added to out directly, like encoding/json does.
+func maskInto(out map[string]any, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("json")
+		value := v.Field(i)
+
+		switch {
+		case field.Anonymous:
+			if err := maskInto(out, value); err != nil {
+				return err
+			}
+		case field.Type.Kind() == reflect.Struct:
+			nested, err := maskedValue(value)
+			if err != nil {
+				return err
+			}
+			out[name] = nested
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			items := make([]any, value.Len())
+			for j := 0; j < value.Len(); j++ {
+				item, err := maskedValue(value.Index(j))
+				if err != nil {
+					return err
+				}
+				items[j] = item
+			}
+			out[name] = items
+		case field.Tag.Get("secret") == "true":
+			if value.String() != "" {
+				out[name] = "********"
+			} else {
+				out[name] = ""
+			}
+		default:
+			out[name] = value.Interface()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setRequiredEnv sets the variables every valid configuration needs.
+func setRequiredEnv(t *testing.T) {
+	t.Setenv("WATCH_DIR", "/watch")
+	t.Setenv("S3_HOSTNAME", "s3.example.com")
+	t.Setenv("S3_BUCKET", "bucket")
+	t.Setenv("S3_ACCESS_KEY", "access")
+	t.Setenv("S3_SECRET_KEY", "secret")
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile_EnvOnlyDefaults(t *testing.T) {
+	setRequiredEnv(t)
+	cfg, err := LoadConfigFile("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.S3Region != "auto" || cfg.ZstdLevel != 22 || cfg.S3PartSize != 16*1024*1024 {
+		t.Fatalf("unexpected defaults: %+v", cfg)
+	}
+	if cfg.Policy != DefaultBackupPolicy {
+		t.Fatalf("unexpected policy: %+v", cfg.Policy)
+	}
+}
+
+func TestLoadConfigFile_EnvOverridesFile(t *testing.T) {
+	setRequiredEnv(t)
+	path := writeConfigFile(t, `{
+		"s3Bucket": "from-file",
+		"zstdLevel": 19,
+		"readyTimeout": "90s",
+		"policy": {"maxIncrementals": 100}
+	}`)
+	t.Setenv("ZSTD_LEVEL", "")
+
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.S3Bucket != "bucket" {
+		t.Fatalf("expected environment to override file, got %q", cfg.S3Bucket)
+	}
+	if cfg.ZstdLevel != 19 {
+		t.Fatalf("expected zstd level from file, got %d", cfg.ZstdLevel)
+	}
+	if time.Duration(cfg.ReadyTimeout) != 90*time.Second {
+		t.Fatalf("unexpected ready timeout: %s", time.Duration(cfg.ReadyTimeout))
+	}
+	if cfg.Policy.MaxIncrementals != 100 || cfg.Policy.MaxCumulativeRatio != 1.0 {
+		t.Fatalf("unexpected policy: %+v", cfg.Policy)
+	}
+}
+
+func TestLoadConfigFile_UnknownKey(t *testing.T) {
+	setRequiredEnv(t)
+	path := writeConfigFile(t, `{"zstdLevl": 3}`)
+	_, err := LoadConfigFile(path)
+	if err == nil || !strings.Contains(err.Error(), "zstdLevl") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestLoadConfigFile_ValidationErrors(t *testing.T) {
+	path := writeConfigFile(t, `{"zstdLevel": 30, "s3Concurrency": 0}`)
+	t.Setenv("WATCH_DIR", "")
+	_, err := LoadConfigFile(path)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"watchDir", "zstdLevel", "s3Concurrency"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to mention %s, got %v", want, err)
+		}
+	}
+}
+
+func TestConfigMasked(t *testing.T) {
+	setRequiredEnv(t)
+	cfg, err := LoadConfigFile("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	masked, err := cfg.Masked()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if masked["s3SecretKey"] != "********" || masked["s3AccessKey"] != "********" {
+		t.Fatalf("expected secrets to be masked, got %v", masked)
+	}
+	if masked["s3Bucket"] != "bucket" {
+		t.Fatalf("expected bucket to be shown, got %v", masked["s3Bucket"])
+	}
+}
+
+func TestLoadConfigFile_Endpoint(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("S3_HOSTNAME", "")
+	t.Setenv("S3_ENDPOINT", "http://127.0.0.1:9000")
+	t.Setenv("S3_USE_PATH_STYLE", "true")
+
+	cfg, err := LoadConfigFile("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.S3EndpointURL() != "http://127.0.0.1:9000" || !cfg.S3UsePathStyle {
+		t.Fatalf("unexpected endpoint config: %q, path-style %v", cfg.S3EndpointURL(), cfg.S3UsePathStyle)
+	}
+
+	t.Setenv("S3_HOSTNAME", "s3.example.com")
+	if _, err := LoadConfigFile(""); err == nil {
+		t.Fatalf("expected error when both hostname and endpoint are set")
+	}
+
+	t.Setenv("S3_HOSTNAME", "")
+	t.Setenv("S3_ENDPOINT", "127.0.0.1:9000")
+	if _, err := LoadConfigFile(""); err == nil {
+		t.Fatalf("expected error for endpoint without scheme")
+	}
+}
+
+func TestLoadConfigFile_Destinations(t *testing.T) {
+	setRequiredEnv(t)
+	path := writeConfigFile(t, `{
+		"destinations": [
+			{"name": "nas", "type": "local", "path": "/mnt/nas"},
+			{"name": "second", "type": "s3", "s3Endpoint": "https://s3.example.net", "s3Bucket": "b2", "s3SecretKey": "x", "s3AccessKey": "y"}
+		]
+	}`)
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := cfg.DestinationNames(); strings.Join(names, ",") != "primary,nas,second" {
+		t.Fatalf("unexpected destination names: %v", names)
+	}
+	if cfg.Destinations[1].S3PartSize != 16*1024*1024 || cfg.Destinations[1].S3Region != "auto" {
+		t.Fatalf("expected S3 defaults for destination, got %+v", cfg.Destinations[1].S3Config)
+	}
+
+	masked, err := cfg.Masked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := masked["destinations"].([]any)[1].(map[string]any)
+	if second["s3SecretKey"] != "********" {
+		t.Fatalf("expected destination secret to be masked, got %v", second["s3SecretKey"])
+	}
+
+	bad := writeConfigFile(t, `{"destinations": [{"name": "primary", "type": "ftp"}]}`)
+	if _, err := LoadConfigFile(bad); err == nil || !strings.Contains(err.Error(), "not unique") || !strings.Contains(err.Error(), "type") {
+		t.Fatalf("expected name and type errors, got %v", err)
+	}
+}
+
+func TestLoadConfigFile_Send(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("SEND_PROTOCOL", "2")
+	t.Setenv("SEND_COMPRESSED_DATA", "true")
+	t.Setenv("SEND_CLONE_SOURCES", "3")
+
+	cfg, err := LoadConfigFile("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (SendOptions{Protocol: 2, CompressedData: true, CloneSources: 3}); cfg.Send != want {
+		t.Fatalf("unexpected send options: want %+v, got %+v", want, cfg.Send)
+	}
+	if warnings := cfg.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "btrfs receive") {
+		t.Fatalf("expected a warning about clone sources, got %q", warnings)
+	}
+
+	t.Setenv("SEND_PROTOCOL", "1")
+	if _, err := LoadConfigFile(""); err == nil || !strings.Contains(err.Error(), "requires send.protocol 2") {
+		t.Fatalf("expected compressed data to require protocol 2, got %v", err)
+	}
+}
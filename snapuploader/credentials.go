@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// fileCredentialsRefresh is how long credentials read from files are used
+// before the files are read again. Mounted Kubernetes secrets are updated
+// in place, so re-reading them picks up rotated keys without a restart.
+const fileCredentialsRefresh = time.Minute
+
+// credentialValue is a credential given either directly or as a path to a
+// file containing it.
+type credentialValue struct {
+	value string
+	file  string
+}
+
+func (v credentialValue) isSet() bool {
+	return v.value != "" || v.file != ""
+}
+
+func (v credentialValue) read() (string, error) {
+	if v.file == "" {
+		return v.value, nil
+	}
+	data, err := os.ReadFile(v.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read credential file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fileCredentialsProvider provides credentials of which at least one part
+// is read from a file on every retrieval.
+type fileCredentialsProvider struct {
+	accessKey    credentialValue
+	secretKey    credentialValue
+	sessionToken credentialValue
+}
+
+func (p *fileCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	accessKey, err := p.accessKey.read()
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	secretKey, err := p.secretKey.read()
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	sessionToken, err := p.sessionToken.read()
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if accessKey == "" || secretKey == "" {
+		return aws.Credentials{}, fmt.Errorf("credential files contain an empty access key or secret key")
+	}
+	return aws.Credentials{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    sessionToken,
+		Source:          "snapuploader credential files",
+		CanExpire:       true,
+		Expires:         time.Now().Add(fileCredentialsRefresh),
+	}, nil
+}
+
+// CredentialsProvider returns the provider for the configured static or
+// file-based credentials, or nil when none are configured and the default
+// AWS credential chain (environment, web identity, shared profiles, IMDS)
+// should be used.
+func CredentialsProvider(cfg *S3Config) aws.CredentialsProvider {
+	p := &fileCredentialsProvider{
+		accessKey:    credentialValue{cfg.S3AccessKey, cfg.S3AccessKeyFile},
+		secretKey:    credentialValue{cfg.S3SecretKey, cfg.S3SecretKeyFile},
+		sessionToken: credentialValue{cfg.S3SessionToken, cfg.S3SessionTokenFile},
+	}
+	if !p.accessKey.isSet() && !p.secretKey.isSet() {
+		return nil
+	}
+	if p.accessKey.file == "" && p.secretKey.file == "" && p.sessionToken.file == "" {
+		return credentials.NewStaticCredentialsProvider(cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3SessionToken)
+	}
+	return aws.NewCredentialsCache(p)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentialsProvider_DefaultChainWithoutCredentials(t *testing.T) {
+	if provider := CredentialsProvider(&S3Config{}); provider != nil {
+		t.Fatalf("expected nil provider to fall back to the default chain, got %T", provider)
+	}
+}
+
+func TestFileCredentialsProvider_ReadsRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("secret-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fileCredentialsProvider{
+		accessKey: credentialValue{value: "access"},
+		secretKey: credentialValue{file: secretFile},
+	}
+	creds, err := p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.AccessKeyID != "access" || creds.SecretAccessKey != "secret-1" {
+		t.Fatalf("unexpected credentials: %+v", creds)
+	}
+	if !creds.CanExpire {
+		t.Fatalf("expected file credentials to expire so they are re-read")
+	}
+
+	// Kubernetes replaces the file content in place on rotation
+	if err := os.WriteFile(secretFile, []byte("secret-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err = p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.SecretAccessKey != "secret-2" {
+		t.Fatalf("expected rotated secret, got %q", creds.SecretAccessKey)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destination is a storage backups are uploaded to. Streams are uploaded
+// under a staging key and promoted to their final key once complete.
+type Destination interface {
+	Name() string
+	UploadStream(ctx context.Context, key string, reader io.Reader) error
+	Promote(ctx context.Context, stagingKey string, key string) error
+	DiscardStaged(ctx context.Context, stagingKey string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// NewDestinations creates the primary S3 destination followed by the
+// additional configured destinations.
+func NewDestinations(cfg *Config) ([]Destination, error) {
+	primary, err := NewS3Uploader(PrimaryDestination, &cfg.S3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 uploader: %w", err)
+	}
+	destinations := []Destination{primary}
+
+	for i := range cfg.Destinations {
+		d := &cfg.Destinations[i]
+		switch d.Type {
+		case DestinationS3:
+			uploader, err := NewS3Uploader(d.Name, &d.S3Config)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create S3 uploader for %s: %w", d.Name, err)
+			}
+			destinations = append(destinations, uploader)
+		case DestinationLocal:
+			destinations = append(destinations, &LocalDestination{name: d.Name, root: d.Path})
+		default:
+			return nil, fmt.Errorf("unknown destination type %q", d.Type)
+		}
+	}
+	return destinations, nil
+}
+
+// LocalDestination stores backups as files below a directory, for example
+// a mounted NAS share.
+type LocalDestination struct {
+	name string
+	root string
+}
+
+func (d *LocalDestination) Name() string {
+	return d.name
+}
+
+func (d *LocalDestination) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+func (d *LocalDestination) UploadStream(ctx context.Context, key string, reader io.Reader) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	// Make sure the data is on disk before the stream is reported complete
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+	log.Printf("Successfully wrote %s", path)
+	return nil
+}
+
+func (d *LocalDestination) Promote(ctx context.Context, stagingKey string, key string) error {
+	if err := os.Rename(d.path(stagingKey), d.path(key)); err != nil {
+		return fmt.Errorf("failed to promote %s: %w", stagingKey, err)
+	}
+	log.Printf("Promoted %s to %s", d.path(stagingKey), d.path(key))
+	return nil
+}
+
+func (d *LocalDestination) DiscardStaged(ctx context.Context, stagingKey string) error {
+	if err := os.Remove(d.path(stagingKey)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", stagingKey, err)
+	}
+	return nil
+}
+
+func (d *LocalDestination) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(d.path(key))
+}
+
+// Delete removes the file of key.
+func (d *LocalDestination) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", key, err)
+	}
+	log.Printf("Deleted %s", d.path(key))
+	return nil
+}
+
+func (d *LocalDestination) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", d.root, err)
+	}
+	return keys, nil
+}
+
+// MetadataDestination is implemented by destinations that can store user
+// metadata with an object. The metadata is kept when the object is
+// promoted.
+type MetadataDestination interface {
+	UploadStreamWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error
+}
+
+// TaggingDestination is implemented by destinations that can tag objects,
+// so lifecycle rules of the bucket can tell pinned streams apart.
+type TaggingDestination interface {
+	SetTags(ctx context.Context, key string, tags map[string]string) error
+}
+
+// DeletingDestination is implemented by destinations backups can be
+// expired from.
+type DeletingDestination interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// UploadToAll streams reader to every destination at once, so the stream
+// is produced only once. A destination that fails does not stop the
+// others. metadata is stored by destinations that support it. The returned
+// slice holds the error of each destination.
+func UploadToAll(ctx context.Context, destinations []Destination, key string, reader io.Reader, metadata map[string]string) []error {
+	errs := make([]error, len(destinations))
+	writers := make([]*io.PipeWriter, len(destinations))
+
+	var wg sync.WaitGroup
+	for i, destination := range destinations {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if md, ok := destination.(MetadataDestination); ok && len(metadata) > 0 {
+				err = md.UploadStreamWithMetadata(ctx, key, pr, metadata)
+			} else {
+				err = destination.UploadStream(ctx, key, pr)
+			}
+			errs[i] = err
+			// Unblock the writer if the destination stopped reading early
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+			pr.CloseWithError(err)
+		}()
+	}
+
+	buf := make([]byte, 1024*1024)
+	active := len(writers)
+	for active > 0 {
+		n, rerr := reader.Read(buf)
+		if n > 0 {
+			for i, w := range writers {
+				if w == nil {
+					continue
+				}
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					log.Printf("Destination %s stopped receiving the stream: %v", destinations[i].Name(), werr)
+					writers[i] = nil
+					active--
+				}
+			}
+		}
+		if rerr != nil {
+			for _, w := range writers {
+				if w == nil {
+					continue
+				}
+				if rerr == io.EOF {
+					w.Close()
+				} else {
+					w.CloseWithError(rerr)
+				}
+			}
+			break
+		}
+	}
+
+	wg.Wait()
+	for i := range errs {
+		if errs[i] == nil && writers[i] == nil {
+			errs[i] = fmt.Errorf("destination %s did not receive the whole stream", destinations[i].Name())
+		}
+	}
+	return errs
+}
+
+// CatchUpDestinations copies the streams of completed snapshots to
+// destinations that missed them, from a destination that has them. The
+// stream is not produced again, so the other destinations are untouched.
+func CatchUpDestinations(ctx context.Context, snapshots []SnapshotInfo, destinations []Destination) {
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		done := snapshot.Done
+		// Older .done files do not record the key, nothing to copy from
+		if done == nil || done.Key == "" {
+			continue
+		}
+
+		// Prefer destinations in configuration order, the primary first
+		var source Destination
+		for _, destination := range destinations {
+			if state := done.Destinations[destination.Name()]; state != nil && state.Done {
+				source = destination
+				break
+			}
+		}
+		if source == nil {
+			continue
+		}
+
+		changed := false
+		for _, destination := range destinations {
+			state := done.Destinations[destination.Name()]
+			if state != nil && state.Done {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("Catching up %s on %s from %s", destination.Name(), snapshot.Name, source.Name())
+			var metadata map[string]string
+			if done.World != nil {
+				metadata = done.World.S3Metadata()
+			}
+			err := copyBetween(ctx, source, destination, done.Key, metadata)
+			if err != nil {
+				log.Printf("Failed to catch up %s on %s: %v", destination.Name(), snapshot.Name, err)
+			} else if perr := CatchUpStreamExtras(ctx, source, destination, snapshot.Name, done); perr != nil {
+				log.Printf("Warning: failed to publish index of %s on %s: %v", snapshot.Name, destination.Name(), perr)
+			}
+			done.SetDestinationResult(destination.Name(), err)
+			changed = true
+		}
+
+		if changed {
+			// Keep a pin set while the streams were copied
+			if current, err := ReadDoneFile(snapshot.Path + ".done"); err == nil {
+				done.Pin = current.Pin
+			}
+			if err := WriteDoneFile(snapshot.Path, done); err != nil {
+				log.Printf("Failed to update .done file of %s: %v", snapshot.Name, err)
+			}
+		}
+	}
+}
+
+func copyBetween(ctx context.Context, source Destination, destination Destination, key string, metadata map[string]string) (err error) {
+	reader, err := source.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	stagingKey := StagingKey(key)
+	defer func() {
+		if err != nil {
+			if derr := destination.DiscardStaged(context.Background(), stagingKey); derr != nil {
+				log.Printf("Warning: failed to clean up incomplete upload: %v", derr)
+			}
+		}
+	}()
+	if md, ok := destination.(MetadataDestination); ok && len(metadata) > 0 {
+		err = md.UploadStreamWithMetadata(ctx, stagingKey, reader, metadata)
+	} else {
+		err = destination.UploadStream(ctx, stagingKey, reader)
+	}
+	if err != nil {
+		return err
+	}
+	return destination.Promote(ctx, stagingKey, key)
+}
+
+// SetDestinationResult records the outcome of an upload to a destination.
+func (c *DoneFileContent) SetDestinationResult(name string, err error) {
+	if c.Destinations == nil {
+		c.Destinations = make(map[string]*DestinationState)
+	}
+	if err != nil {
+		c.Destinations[name] = &DestinationState{Done: false, LastError: err.Error()}
+		return
+	}
+	now := time.Now()
+	c.Destinations[name] = &DestinationState{Done: true, UploadedAt: &now}
+}
+
+// LaggingDestinations returns the names of the destinations that do not
+// have the snapshot yet.
+func (c *DoneFileContent) LaggingDestinations(names []string) []string {
+	if c == nil || c.Destinations == nil {
+		// Older .done files only know about the primary destination
+		return nil
+	}
+	var lagging []string
+	for _, name := range names {
+		if state := c.Destinations[name]; state == nil || !state.Done {
+			lagging = append(lagging, name)
+		}
+	}
+	return lagging
+}
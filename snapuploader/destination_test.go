@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingDestination fails after reading a few bytes of the stream.
+type failingDestination struct {
+	LocalDestination
+}
+
+func (d *failingDestination) UploadStream(ctx context.Context, key string, reader io.Reader) error {
+	buf := make([]byte, 10)
+	io.ReadFull(reader, buf)
+	return errors.New("connection reset")
+}
+
+func TestUploadToAll_TeesAndToleratesFailure(t *testing.T) {
+	a := &LocalDestination{name: "a", root: t.TempDir()}
+	b := &LocalDestination{name: "b", root: t.TempDir()}
+	bad := &failingDestination{LocalDestination{name: "bad", root: t.TempDir()}}
+
+	content := bytes.Repeat([]byte("btrfs-stream"), 300000)
+	errs := UploadToAll(context.Background(), []Destination{a, bad, b}, "backup/x/full.zst", bytes.NewReader(content), nil)
+	if errs[0] != nil || errs[2] != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if errs[1] == nil {
+		t.Fatalf("expected failing destination to report an error")
+	}
+
+	for _, d := range []*LocalDestination{a, b} {
+		got, err := os.ReadFile(d.path("backup/x/full.zst"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("destination %s got %d bytes, want %d", d.name, len(got), len(content))
+		}
+	}
+}
+
+func TestCatchUpDestinations(t *testing.T) {
+	watchDir := t.TempDir()
+	snapPath := filepath.Join(watchDir, "snap-0001")
+	if err := os.Mkdir(snapPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := &LocalDestination{name: PrimaryDestination, root: t.TempDir()}
+	nas := &LocalDestination{name: "nas", root: t.TempDir()}
+	key := "backup/snap-0001/full.zst"
+	if err := primary.UploadStream(context.Background(), key, strings.NewReader("stream")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := &DoneFileContent{Type: "full", Size: 6, Key: key}
+	done.SetDestinationResult(PrimaryDestination, nil)
+	done.SetDestinationResult("nas", errors.New("nas offline"))
+	if err := WriteDoneFile(snapPath, done); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := FindSnapshots(watchDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{PrimaryDestination, "nas"}
+	if lagging := snapshots[0].Done.LaggingDestinations(names); len(lagging) != 1 || lagging[0] != "nas" {
+		t.Fatalf("expected nas to lag, got %v", lagging)
+	}
+
+	CatchUpDestinations(context.Background(), snapshots, []Destination{primary, nas})
+
+	got, err := os.ReadFile(nas.path(key))
+	if err != nil || string(got) != "stream" {
+		t.Fatalf("expected stream to be copied to nas, got %q, %v", got, err)
+	}
+	updated, err := ReadDoneFile(snapPath + ".done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lagging := updated.LaggingDestinations(names); len(lagging) != 0 {
+		t.Fatalf("expected no lagging destinations after catch-up, got %v", lagging)
+	}
+}
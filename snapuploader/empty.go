@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+// BackupTypeAlias is the type of a snapshot whose incremental was too small
+// to upload. It is recorded as an alias of its parent, and the next
+// incremental carries its changes.
+const BackupTypeAlias = "alias"
+
+// contentOps are the commands that only change the data or attributes of
+// existing files. btrfs send --no-data reports writes as update_extent.
+var contentOps = map[string]bool{
+	sendstream.CommandName(sendstream.CmdWrite):        true,
+	sendstream.CommandName(sendstream.CmdEncodedWrite): true,
+	sendstream.CommandName(sendstream.CmdUpdateExtent): true,
+	sendstream.CommandName(sendstream.CmdClone):        true,
+	sendstream.CommandName(sendstream.CmdTruncate):     true,
+	sendstream.CommandName(sendstream.CmdFallocate):    true,
+	sendstream.CommandName(sendstream.CmdChmod):        true,
+	sendstream.CommandName(sendstream.CmdChown):        true,
+	sendstream.CommandName(sendstream.CmdSetXattr):     true,
+	sendstream.CommandName(sendstream.CmdRemoveXattr):  true,
+	sendstream.CommandName(sendstream.CmdFileattr):     true,
+}
+
+// replaceOps are the commands btrfs send uses for a file that was replaced
+// by writing a temporary file and renaming it over the old one, the way
+// Minecraft saves level.dat and player data. The new inode is created under
+// a temporary name and renamed into place, and the inode that lost its
+// name is renamed to a temporary name and unlinked, or onto the name of a
+// backup like level.dat_old. Such changes count by the data written as
+// long as every real name of the parent still exists and no new one
+// appears.
+var replaceOps = map[string]bool{
+	sendstream.CommandName(sendstream.CmdMkfile): true,
+	sendstream.CommandName(sendstream.CmdRename): true,
+	sendstream.CommandName(sendstream.CmdUnlink): true,
+}
+
+// IncrementalSize is what an incremental would change.
+type IncrementalSize struct {
+	Files      int
+	Bytes      int64 // File data written or cloned
+	Structural bool  // Whether files, directories, links or special files are added, removed or renamed
+}
+
+// changeMeter measures an incremental from its commands.
+type changeMeter struct {
+	changes *sendstream.ChangeIndex
+	// Whether a real name existed in the parent, judged by whether the
+	// first command using it removes or adds it, and whether it exists
+	// after the commands so far. Temporary names are left out.
+	existed map[string]bool
+	exists  map[string]bool
+}
+
+func newChangeMeter() *changeMeter {
+	return &changeMeter{
+		changes: sendstream.NewChangeIndex(),
+		existed: make(map[string]bool),
+		exists:  make(map[string]bool),
+	}
+}
+
+// Add records a command of the stream.
+func (m *changeMeter) Add(cmd *sendstream.Command) {
+	m.changes.Add(cmd)
+	p, err := cmd.Attrs.String(sendstream.AttrPath)
+	if err != nil {
+		return
+	}
+	switch cmd.Type {
+	case sendstream.CmdMkfile, sendstream.CmdMkdir, sendstream.CmdMknod, sendstream.CmdMkfifo,
+		sendstream.CmdMksock, sendstream.CmdSymlink, sendstream.CmdLink:
+		m.name(p, true)
+	case sendstream.CmdUnlink, sendstream.CmdRmdir:
+		m.name(p, false)
+	case sendstream.CmdRename:
+		m.name(p, false)
+		if to, err := cmd.Attrs.String(sendstream.AttrPathTo); err == nil {
+			m.name(to, true)
+		}
+	}
+}
+
+func (m *changeMeter) name(p string, exists bool) {
+	if orphanName.MatchString(path.Base(p)) {
+		return
+	}
+	if _, ok := m.exists[p]; !ok {
+		m.existed[p] = !exists
+	}
+	m.exists[p] = exists
+}
+
+// Size sums up the changes recorded so far.
+func (m *changeMeter) Size() *IncrementalSize {
+	changes := m.changes.Changes()
+	size := &IncrementalSize{Files: len(changes)}
+	for _, change := range changes {
+		size.Bytes += change.Bytes
+		for _, op := range change.Ops {
+			if !contentOps[op] && !replaceOps[op] {
+				size.Structural = true
+			}
+		}
+	}
+	for p, exists := range m.exists {
+		if exists != m.existed[p] {
+			size.Structural = true
+		}
+	}
+	return size
+}
+
+// MeasureChanges sums up the changes of a stream from its commands.
+func MeasureChanges(cmds []*sendstream.Command) *IncrementalSize {
+	m := newChangeMeter()
+	for _, cmd := range cmds {
+		m.Add(cmd)
+	}
+	return m.Size()
+}
+
+// NearEmpty reports whether the incremental only changes or replaces files,
+// and writes less than maxBytes of data. It is never near empty if
+// maxBytes is zero.
+func (s *IncrementalSize) NearEmpty(maxBytes int64) bool {
+	return !s.Structural && s.Bytes < maxBytes
+}
+
+// MeasureIncremental runs btrfs send --no-data, which only sends metadata
+// and is cheap, to find out what an incremental would change.
+func MeasureIncremental(ctx context.Context, snapshotPath string, parentPath string) (*IncrementalSize, error) {
+	cmd := exec.CommandContext(ctx, "btrfs", "send", "--no-data", "-p", parentPath, snapshotPath)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start btrfs send --no-data: %w", err)
+	}
+
+	meter := newChangeMeter()
+	walkErr := sendstream.Walk(stdout, meter.Add)
+	if walkErr != nil {
+		cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil && walkErr == nil {
+		return nil, fmt.Errorf("btrfs send --no-data failed: %w", err)
+	}
+	if walkErr != nil {
+		return nil, fmt.Errorf("btrfs send --no-data produced an invalid stream: %w", walkErr)
+	}
+	return meter.Size(), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+// sendCommand returns a command with the given attribute values.
+func sendCommand(cmdType uint16, values map[uint16]any) *sendstream.Command {
+	attrs := sendstream.Attributes{}
+	for attr, value := range values {
+		switch v := value.(type) {
+		case string:
+			attrs[attr] = []byte(v)
+		case uint64:
+			attrs[attr] = binary.LittleEndian.AppendUint64(nil, v)
+		}
+	}
+	return &sendstream.Command{Type: cmdType, Attrs: attrs}
+}
+
+// replaceLevelDat returns the commands of btrfs send --no-data for an idle
+// save: Minecraft writes level.dat to a temporary file, renames level.dat
+// to level.dat_old and the temporary file to level.dat.
+func replaceLevelDat() []*sendstream.Command {
+	const p, to uint16 = sendstream.AttrPath, sendstream.AttrPathTo
+	return []*sendstream.Command{
+		sendCommand(sendstream.CmdSnapshot, map[uint16]any{p: "gt300"}),
+		// The old level.dat_old is in the way of the old level.dat
+		sendCommand(sendstream.CmdRename, map[uint16]any{p: "level.dat_old", to: "o259-17-0"}),
+		sendCommand(sendstream.CmdRename, map[uint16]any{p: "level.dat", to: "level.dat_old"}),
+		sendCommand(sendstream.CmdUtimes, map[uint16]any{p: ""}),
+		sendCommand(sendstream.CmdUnlink, map[uint16]any{p: "o259-17-0"}),
+		// The new level.dat
+		sendCommand(sendstream.CmdMkfile, map[uint16]any{p: "o300-42-0"}),
+		sendCommand(sendstream.CmdRename, map[uint16]any{p: "o300-42-0", to: "level.dat"}),
+		sendCommand(sendstream.CmdUpdateExtent, map[uint16]any{p: "level.dat", sendstream.AttrFileOffset: uint64(0), sendstream.AttrSize: uint64(1536)}),
+		sendCommand(sendstream.CmdChown, map[uint16]any{p: "level.dat", sendstream.AttrUID: uint64(1000), sendstream.AttrGID: uint64(1000)}),
+		sendCommand(sendstream.CmdChmod, map[uint16]any{p: "level.dat", sendstream.AttrMode: uint64(0o644)}),
+		sendCommand(sendstream.CmdUtimes, map[uint16]any{p: "level.dat"}),
+		sendCommand(sendstream.CmdEnd, nil),
+	}
+}
+
+func TestMeasureChanges(t *testing.T) {
+	const p, to uint16 = sendstream.AttrPath, sendstream.AttrPathTo
+	size := MeasureChanges([]*sendstream.Command{
+		sendCommand(sendstream.CmdUpdateExtent, map[uint16]any{p: "level.dat", sendstream.AttrSize: uint64(1500)}),
+		sendCommand(sendstream.CmdUpdateExtent, map[uint16]any{p: "level.dat_old", sendstream.AttrSize: uint64(1500)}),
+		sendCommand(sendstream.CmdTruncate, map[uint16]any{p: "level.dat_old", sendstream.AttrSize: uint64(1500)}),
+	})
+	if size.Files != 2 || size.Bytes != 3000 || size.Structural {
+		t.Fatalf("unexpected size: %+v", size)
+	}
+	if !size.NearEmpty(4096) || size.NearEmpty(3000) || size.NearEmpty(0) {
+		t.Fatalf("unexpected near-empty verdict for %d bytes", size.Bytes)
+	}
+	if size := MeasureChanges(nil); !size.NearEmpty(1) || size.NearEmpty(0) {
+		t.Fatalf("unexpected near-empty verdict for no changes")
+	}
+
+	// Adding, removing or renaming names is never near empty, however small
+	for name, cmds := range map[string][]*sendstream.Command{
+		"unlink": {
+			sendCommand(sendstream.CmdUnlink, map[uint16]any{p: "playerdata/x.dat"}),
+		},
+		"new region file": {
+			sendCommand(sendstream.CmdMkfile, map[uint16]any{p: "o300-42-0"}),
+			sendCommand(sendstream.CmdRename, map[uint16]any{p: "o300-42-0", to: "region/r.1.1.mca"}),
+			sendCommand(sendstream.CmdUpdateExtent, map[uint16]any{p: "region/r.1.1.mca", sendstream.AttrSize: uint64(100)}),
+		},
+		"renamed file": {
+			sendCommand(sendstream.CmdRename, map[uint16]any{p: "playerdata/x.dat", to: "playerdata/y.dat"}),
+		},
+		"file replaced onto a new name": {
+			sendCommand(sendstream.CmdRename, map[uint16]any{p: "level.dat", to: "level.dat_old"}),
+			sendCommand(sendstream.CmdMkfile, map[uint16]any{p: "o300-42-0"}),
+			sendCommand(sendstream.CmdRename, map[uint16]any{p: "o300-42-0", to: "level.dat"}),
+		},
+	} {
+		if size := MeasureChanges(cmds); !size.Structural || size.NearEmpty(4096) {
+			t.Fatalf("expected %s to be structural: %+v", name, size)
+		}
+	}
+}
+
+func TestMeasureChanges_ReplacedLevelDat(t *testing.T) {
+	size := MeasureChanges(replaceLevelDat())
+	if size.Structural || size.Bytes != 1536 {
+		t.Fatalf("unexpected size of a level.dat save: %+v", size)
+	}
+	if !size.NearEmpty(4096) || size.NearEmpty(1024) {
+		t.Fatalf("unexpected near-empty verdict for %d bytes", size.Bytes)
+	}
+}
+
+func TestDecideUpload_SkipsAliases(t *testing.T) {
+	snapshots := []SnapshotInfo{
+		{Path: "/watch/snap-0001", Name: "snap-0001", HasDone: true, BackupType: "full", Size: 1000},
+		{Path: "/watch/snap-0002", Name: "snap-0002", HasDone: true, BackupType: "incremental", Size: 10},
+		{Path: "/watch/snap-0003", Name: "snap-0003", HasDone: true, BackupType: BackupTypeAlias},
+		{Path: "/watch/snap-0004", Name: "snap-0004", HasDone: true, BackupType: BackupTypeAlias},
+		{Path: "/watch/snap-0005", Name: "snap-0005"},
+	}
+	// Aliases do not count towards the chain length
+	policy := DefaultBackupPolicy
+	policy.MaxIncrementals = 2
+	key, parentPath, err := DecideUpload("/watch/snap-0005", snapshots, "", policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parentPath == nil || *parentPath != "/watch/snap-0002" {
+		t.Fatalf("unexpected parentPath: want /watch/snap-0002, got %v", parentPath)
+	}
+	if want := "backup/snap-0001/incremental.snap-0005.from.snap-0002.zst"; key != want {
+		t.Fatalf("unexpected key: want %q, got %q", want, key)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+// FetchChain makes the streams of chain available as local files, as they
+// are read twice. They are kept in the stream cache if it is enabled and in
+// tmp otherwise.
+func FetchChain(ctx context.Context, chain []*CatalogEntry, cache *StreamCache, source Destination, tmp string) ([]string, error) {
+	paths := make([]string, len(chain))
+	for i, entry := range chain {
+		if cache != nil {
+			if r, err := cache.Open(ctx, entry.Key); err == nil {
+				r.Close()
+			} else {
+				log.Printf("Downloading %s to the stream cache", entry.Key)
+				if err := copyBetween(ctx, source, cache, entry.Key, nil); err != nil {
+					return nil, fmt.Errorf("failed to download %s: %w", entry.Key, err)
+				}
+			}
+			paths[i] = cache.path(entry.Key)
+			continue
+		}
+
+		log.Printf("Downloading %s", entry.Key)
+		paths[i] = filepath.Join(tmp, fmt.Sprintf("%d.zst", i))
+		if err := downloadTo(ctx, source, entry.Key, paths[i]); err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", entry.Key, err)
+		}
+	}
+	return paths, nil
+}
+
+func downloadTo(ctx context.Context, source Destination, key string, target string) error {
+	r, err := source.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readLocalStream calls fn with the uncompressed stream of a local file.
+func readLocalStream(ctx context.Context, file string, fn func(io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, err := DecompressStream(ctx, f)
+	if err != nil {
+		return err
+	}
+	if err := fn(stream); err != nil {
+		stream.Close()
+		return err
+	}
+	return stream.Close()
+}
+
+// ErrNoMatch is returned when no file of a snapshot matches what is to be
+// extracted.
+var ErrNoMatch = errors.New("no matching files")
+
+// ExtractPaths writes target, a file or directory of the snapshot at the
+// end of chain, below out. Only operations on the selected files are
+// replayed.
+func ExtractPaths(ctx context.Context, chain []*CatalogEntry, target string, out string, cache *StreamCache, source Destination) ([]string, error) {
+	target = strings.Trim(path.Clean("/"+target), "/")
+	match := func(p string) bool {
+		return target == "" || p == target || strings.HasPrefix(p, target+"/")
+	}
+	extracted, err := ExtractMatching(ctx, chain, match, out, cache, source)
+	if errors.Is(err, ErrNoMatch) {
+		return nil, fmt.Errorf("%s does not exist in %s", target, chain[len(chain)-1].Snapshot)
+	}
+	return extracted, err
+}
+
+// ExtractMatching writes the files of the snapshot at the end of chain
+// whose paths match below out.
+func ExtractMatching(ctx context.Context, chain []*CatalogEntry, match func(string) bool, out string, cache *StreamCache, source Destination) ([]string, error) {
+	tmp, err := os.MkdirTemp("", "snapuploader-extract-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	files, err := FetchChain(ctx, chain, cache, source, tmp)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		defer func() {
+			if err := cache.Evict(); err != nil {
+				log.Printf("Warning: failed to evict from the stream cache: %v", err)
+			}
+		}()
+	}
+
+	work := filepath.Join(tmp, "data")
+	if err := os.Mkdir(work, 0700); err != nil {
+		return nil, err
+	}
+	extractor := sendstream.NewExtractor(work, match)
+	extractor.Decode = decodeExtent
+	for i, file := range files {
+		if err := readLocalStream(ctx, file, extractor.Scan); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", chain[i].Key, err)
+		}
+	}
+	if extractor.Select() == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoMatch, chain[len(chain)-1].Snapshot)
+	}
+	for i, file := range files {
+		if err := readLocalStream(ctx, file, extractor.Apply); err != nil {
+			return nil, fmt.Errorf("failed to apply %s: %w", chain[i].Key, err)
+		}
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return nil, err
+	}
+	return extractor.Finish(out)
+}
+
+func extractCommand(args []string) error {
+	flags := flag.NewFlagSet("extract", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to extract from")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		return fmt.Errorf("usage: snapuploader extract [-from <destination>] <snapshot> <path> <directory>")
+	}
+	snapshot, target, out := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	source, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, source, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	chain, err := catalog.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := CheckChainApplicable(ctx, chain, source); err != nil {
+		return err
+	}
+	extracted, err := ExtractPaths(ctx, chain, target, out, NewStreamCache(cfg), source)
+	if err != nil {
+		return err
+	}
+	for _, p := range extracted {
+		fmt.Println(filepath.Join(out, filepath.FromSlash(p)))
+	}
+	return nil
+}
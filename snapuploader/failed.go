@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// FailureRecord is the content of the <snapshot>.failed marker. It keeps
+// track of how many times processing a snapshot has failed so that a
+// snapshot which keeps failing can be quarantined instead of being retried
+// on every event forever.
+type FailureRecord struct {
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	// Discarded is set by the operator ("snapuploader discard") to give up
+	// on the snapshot permanently.
+	Discarded bool `json:"discarded,omitempty"`
+}
+
+// Quarantined reports whether the snapshot should no longer be processed
+// automatically.
+func (r *FailureRecord) Quarantined(maxAttempts int) bool {
+	if r == nil {
+		return false
+	}
+	return r.Discarded || (maxAttempts > 0 && r.Attempts >= maxAttempts)
+}
+
+func failedFilePath(snapshotPath string) string {
+	return snapshotPath + ".failed"
+}
+
+// ReadFailedFile reads the .failed marker of the snapshot. It returns nil
+// without error when the marker does not exist.
+func ReadFailedFile(snapshotPath string) (*FailureRecord, error) {
+	data, err := os.ReadFile(failedFilePath(snapshotPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var record FailureRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse .failed file: %w", err)
+	}
+	return &record, nil
+}
+
+func writeFailedFile(snapshotPath string, record *FailureRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal failed file content: %w", err)
+	}
+	if err := os.WriteFile(failedFilePath(snapshotPath), data, 0644); err != nil {
+		return fmt.Errorf("failed to write .failed file: %w", err)
+	}
+	return nil
+}
+
+// RecordFailure increments the attempt count in the .failed marker of the
+// snapshot and stores the error that caused the failure.
+func RecordFailure(snapshotPath string, cause error) (*FailureRecord, error) {
+	record, err := ReadFailedFile(snapshotPath)
+	if err != nil {
+		// A broken marker should not prevent accounting, start over
+		log.Printf("Ignoring unreadable .failed file for %s: %v", snapshotPath, err)
+		record = nil
+	}
+	if record == nil {
+		record = &FailureRecord{}
+	}
+
+	record.Attempts++
+	record.LastError = cause.Error()
+	record.LastAttempt = time.Now()
+
+	if err := writeFailedFile(snapshotPath, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ClearFailure removes the .failed marker so the snapshot is retried from
+// scratch.
+func ClearFailure(snapshotPath string) error {
+	if err := os.Remove(failedFilePath(snapshotPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove .failed file: %w", err)
+	}
+	return nil
+}
+
+// DiscardSnapshot marks the snapshot as permanently skipped.
+func DiscardSnapshot(snapshotPath string) error {
+	record, err := ReadFailedFile(snapshotPath)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		record = &FailureRecord{LastAttempt: time.Now()}
+	}
+	record.Discarded = true
+	return writeFailedFile(snapshotPath, record)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordFailure_QuarantineAfterMaxAttempts(t *testing.T) {
+	dir := t.TempDir()
+	snapPath := filepath.Join(dir, "snap-0001")
+	if err := os.Mkdir(snapPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		record, err := RecordFailure(snapPath, errors.New("btrfs send failed"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record.Attempts != i {
+			t.Fatalf("unexpected attempts: want %d, got %d", i, record.Attempts)
+		}
+		if quarantined := record.Quarantined(3); quarantined != (i == 3) {
+			t.Fatalf("unexpected quarantine state after %d attempts: %v", i, quarantined)
+		}
+	}
+
+	snapshots, err := FindSnapshots(dir, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Failure == nil {
+		t.Fatalf("expected snapshot with failure record, got %+v", snapshots)
+	}
+	if state := SnapshotState(&snapshots[0], 3); state != StateQuarantined {
+		t.Fatalf("unexpected state: want %q, got %q", StateQuarantined, state)
+	}
+	if state := SnapshotState(&snapshots[0], 5); state != StateFailed {
+		t.Fatalf("unexpected state with higher limit: want %q, got %q", StateFailed, state)
+	}
+
+	if err := ClearFailure(snapPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	record, err := ReadFailedFile(snapPath)
+	if err != nil || record != nil {
+		t.Fatalf("expected no failure record after clear, got %+v, %v", record, err)
+	}
+}
+
+func TestDiscardSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapPath := filepath.Join(dir, "snap-0001")
+	if err := os.Mkdir(snapPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DiscardSnapshot(snapPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	record, err := ReadFailedFile(snapPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !record.Quarantined(3) {
+		t.Fatalf("expected discarded snapshot to be skipped")
+	}
+	info := SnapshotInfo{Path: snapPath, Name: "snap-0001", Failure: record}
+	if state := SnapshotState(&info, 3); state != StateDiscarded {
+		t.Fatalf("unexpected state: want %q, got %q", StateDiscarded, state)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+// ChangedFilesIndex lists the paths a stream touched. It is uploaded
+// gzip-compressed next to the stream.
+type ChangedFilesIndex struct {
+	Snapshot string              `json:"snapshot"`
+	Changes  []sendstream.Change `json:"changes"`
+}
+
+// IndexKey returns the key of the changed-files index of a stream.
+func IndexKey(streamKey string) string {
+	return strings.TrimSuffix(streamKey, ".zst") + ".index.json.gz"
+}
+
+// EncodeIndex returns the stored form of an index.
+func EncodeIndex(index *ChangedFilesIndex) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(index); err != nil {
+		return nil, fmt.Errorf("failed to encode index: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress index: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeIndex reads the stored form of an index.
+func DecodeIndex(r io.Reader) (*ChangedFilesIndex, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress index: %w", err)
+	}
+	defer zr.Close()
+	var index ChangedFilesIndex
+	if err := json.NewDecoder(zr).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+	return &index, nil
+}
+
+// LoadIndex reads the index stored at key on destination.
+func LoadIndex(ctx context.Context, destination Destination, key string) (*ChangedFilesIndex, error) {
+	r, err := destination.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return DecodeIndex(r)
+}
+
+// PublishStreamExtras uploads the changed-files index of a stream, if any,
+// and records the stream in the manifest of its chain. Both only help
+// browsing backups, so the caller treats failures as warnings.
+func PublishStreamExtras(ctx context.Context, destination Destination, link ManifestLink, index []byte) error {
+	if index != nil {
+		if err := putObject(ctx, destination, link.Index, index); err != nil {
+			return fmt.Errorf("failed to upload index: %w", err)
+		}
+	} else {
+		link.Index = ""
+	}
+	if err := RecordInManifest(ctx, destination, link); err != nil {
+		return fmt.Errorf("failed to update manifest: %w", err)
+	}
+	return nil
+}
+
+// CatchUpStreamExtras copies the index of a stream from source to a
+// destination that just received the stream and records it there.
+func CatchUpStreamExtras(ctx context.Context, source Destination, destination Destination, snapshot string, done *DoneFileContent) error {
+	link := ManifestLink{
+		Snapshot:   snapshot,
+		Type:       done.Type,
+		Key:        done.Key,
+		Size:       done.Size,
+		Index:      IndexKey(done.Key),
+		UploadedAt: time.Now(),
+		World:      done.World,
+		Format:     done.Format,
+		Pin:        done.Pin,
+	}
+	if entry, ok := parseStreamKey(done.Key); ok {
+		link.Parent = entry.Parent
+	}
+	index, err := readAllFrom(ctx, source, link.Index)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return PublishStreamExtras(ctx, destination, link, index)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InProgressRecord is the content of the <snapshot>.inprogress marker. It
+// exists while a snapshot is being uploaded, so that an upload interrupted
+// by a shutdown or crash can be cleaned up on the next start.
+type InProgressRecord struct {
+	StagingKey string    `json:"stagingKey"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+func inProgressFilePath(snapshotPath string) string {
+	return snapshotPath + ".inprogress"
+}
+
+// CreateInProgressFile records that snapshotPath is being uploaded to
+// stagingKey.
+func CreateInProgressFile(snapshotPath string, stagingKey string) error {
+	data, err := json.MarshalIndent(InProgressRecord{
+		StagingKey: stagingKey,
+		StartedAt:  time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal in-progress file content: %w", err)
+	}
+	if err := os.WriteFile(inProgressFilePath(snapshotPath), data, 0644); err != nil {
+		return fmt.Errorf("failed to write .inprogress file: %w", err)
+	}
+	return nil
+}
+
+// RemoveInProgressFile removes the .inprogress marker of the snapshot.
+func RemoveInProgressFile(snapshotPath string) {
+	if err := os.Remove(inProgressFilePath(snapshotPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to remove .inprogress file: %v", err)
+	}
+}
+
+// RecoverInterruptedUploads deletes from every destination the staged
+// objects of uploads that were interrupted before they could clean up after
+// themselves. The snapshots have no .done file, so they are uploaded again
+// from scratch afterwards.
+func RecoverInterruptedUploads(ctx context.Context, watchDir string, destinations []Destination) error {
+	markers, err := filepath.Glob(filepath.Join(watchDir, "*.inprogress"))
+	if err != nil {
+		return fmt.Errorf("failed to find .inprogress files: %w", err)
+	}
+
+	for _, marker := range markers {
+		snapshotPath := strings.TrimSuffix(marker, ".inprogress")
+		data, err := os.ReadFile(marker)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", marker, err)
+		}
+		var record InProgressRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("Removing unreadable %s: %v", marker, err)
+			RemoveInProgressFile(snapshotPath)
+			continue
+		}
+
+		log.Printf("Found interrupted upload of %s (started at %s), it will be uploaded again",
+			filepath.Base(snapshotPath), record.StartedAt.Format(time.RFC3339))
+		if record.StagingKey != "" {
+			for _, destination := range destinations {
+				if err := destination.DiscardStaged(ctx, record.StagingKey); err != nil {
+					return fmt.Errorf("%w: %s: %v", ErrS3Upload, destination.Name(), err)
+				}
+			}
+		}
+		RemoveInProgressFile(snapshotPath)
+	}
+	return nil
+}
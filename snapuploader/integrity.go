@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rinsuki-lab/mc1218c/anvil"
+)
+
+// Integrity check modes
+const (
+	IntegrityOff    = "off"    // Region files are not checked
+	IntegrityFlag   = "flag"   // Corrupt snapshots are uploaded and flagged
+	IntegrityRefuse = "refuse" // Corrupt snapshots are not uploaded
+)
+
+// maxRecordedProblems limits the problems kept in a .done file.
+const maxRecordedProblems = 50
+
+// ErrCorruptSnapshot is returned when a snapshot fails the integrity check
+// in refuse mode.
+var ErrCorruptSnapshot = errors.New("snapshot contains corrupt region files")
+
+// IntegrityReport is the result of checking the region files of a snapshot.
+type IntegrityReport struct {
+	CheckedAt    time.Time `json:"checkedAt"`
+	Files        int       `json:"files"`              // Region files checked
+	Unchanged    int       `json:"unchanged"`          // Region files skipped as unchanged since the parent
+	ProblemCount int       `json:"problemCount"`       // Problems found
+	Problems     []string  `json:"problems,omitempty"` // The first problems found, as "path: problem"
+}
+
+// OK reports whether no problems were found.
+func (r *IntegrityReport) OK() bool {
+	return r.ProblemCount == 0
+}
+
+// Summary describes the result in a few words.
+func (r *IntegrityReport) Summary() string {
+	if r.OK() {
+		return "ok"
+	}
+	return fmt.Sprintf("%d problems", r.ProblemCount)
+}
+
+// CheckSnapshotIntegrity checks every region file of a snapshot. Files with
+// the same size and modification time as in parentPath are skipped, so
+// parentPath must only be given if the parent passed the check.
+func CheckSnapshotIntegrity(snapshotPath string, parentPath *string) (*IntegrityReport, error) {
+	report := &IntegrityReport{CheckedAt: time.Now()}
+	err := filepath.WalkDir(snapshotPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if _, _, ok := anvil.ParseRegionName(d.Name()); !ok {
+			return nil
+		}
+		rel, err := filepath.Rel(snapshotPath, p)
+		if err != nil {
+			return err
+		}
+		if parentPath != nil && unchangedSince(p, filepath.Join(*parentPath, rel)) {
+			report.Unchanged++
+			return nil
+		}
+
+		result, err := anvil.CheckFile(p)
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", rel, err)
+		}
+		report.Files++
+		report.ProblemCount += len(result.Problems)
+		for _, problem := range result.Problems {
+			if len(report.Problems) < maxRecordedProblems {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s: %s", filepath.ToSlash(rel), problem))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// unchangedSince reports whether the file at p has the same size and
+// modification time as the one at previous.
+func unchangedSince(p string, previous string) bool {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	pfi, err := os.Stat(previous)
+	if err != nil {
+		return false
+	}
+	return fi.Size() == pfi.Size() && fi.ModTime().Equal(pfi.ModTime())
+}
+
+// checkIntegrity runs the configured integrity check on a snapshot about to
+// be uploaded. It returns nil if checking is disabled.
+func checkIntegrity(mode string, snapshotPath string, parent *SnapshotInfo) (*IntegrityReport, error) {
+	if mode == IntegrityOff || mode == "" {
+		return nil, nil
+	}
+	// Files unchanged since a parent that passed need no second look
+	var parentPath *string
+	if parent != nil && parent.Done != nil && parent.Done.Integrity != nil && parent.Done.Integrity.OK() {
+		parentPath = &parent.Path
+	}
+
+	report, err := CheckSnapshotIntegrity(snapshotPath, parentPath)
+	if err != nil {
+		return nil, fmt.Errorf("integrity check failed: %w", err)
+	}
+	if report.OK() {
+		log.Printf("Integrity check passed: %d region files checked, %d unchanged", report.Files, report.Unchanged)
+		return report, nil
+	}
+
+	for _, problem := range report.Problems {
+		log.Printf("Integrity problem in %s: %s", filepath.Base(snapshotPath), problem)
+	}
+	if mode == IntegrityRefuse {
+		shown := report.Problems
+		if len(shown) > 3 {
+			shown = shown[:3]
+		}
+		return nil, fmt.Errorf("%w: %d problems, first: %s", ErrCorruptSnapshot, report.ProblemCount, strings.Join(shown, "; "))
+	}
+	log.Printf("Warning: uploading %s despite %d integrity problems", filepath.Base(snapshotPath), report.ProblemCount)
+	return report, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	parent := filepath.Join(dir, "parent")
+	snapshot := filepath.Join(dir, "snapshot")
+	mtime := time.Unix(1_700_000_000, 0)
+	for _, root := range []string{parent, snapshot} {
+		region := filepath.Join(root, "world", "region")
+		if err := os.MkdirAll(region, 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// A truncated header and an empty file, which is valid
+		for name, size := range map[string]int{"r.0.0.mca": 100, "r.1.0.mca": 0} {
+			p := filepath.Join(region, name)
+			if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			os.Chtimes(p, mtime, mtime)
+		}
+	}
+
+	report, err := checkIntegrity(IntegrityFlag, snapshot, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Files != 2 || report.ProblemCount != 1 || report.Summary() != "1 problems" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if want := "world/region/r.0.0.mca: file is 100 bytes, shorter than the header"; report.Problems[0] != want {
+		t.Fatalf("unexpected problem: want %q, got %q", want, report.Problems[0])
+	}
+
+	if _, err := checkIntegrity(IntegrityRefuse, snapshot, nil); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Fatalf("expected the snapshot to be refused, got %v", err)
+	}
+	if report, err := checkIntegrity(IntegrityOff, snapshot, nil); report != nil || err != nil {
+		t.Fatalf("expected no check when disabled, got %+v, %v", report, err)
+	}
+
+	// Files unchanged since a parent that passed are skipped
+	passed := &SnapshotInfo{Path: parent, Done: &DoneFileContent{Integrity: &IntegrityReport{}}}
+	report, err = checkIntegrity(IntegrityRefuse, snapshot, passed)
+	if err != nil || report.Unchanged != 2 || report.Files != 0 {
+		t.Fatalf("unexpected report: %+v, %v", report, err)
+	}
+	passed.Done.Integrity.ProblemCount = 1
+	if _, err := checkIntegrity(IntegrityRefuse, snapshot, passed); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Fatalf("expected files of a flagged parent to be checked, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// StoredBackup is a stream on a destination with its manifest link, which
+// is nil for streams uploaded before manifests existed.
+type StoredBackup struct {
+	*CatalogEntry
+	Link *ManifestLink
+}
+
+// ListBackups returns the backups stored on destination with their
+// manifest links.
+func ListBackups(ctx context.Context, catalog *Catalog, destination Destination) ([]StoredBackup, error) {
+	manifests := make(map[string]*ChainManifest)
+	var backups []StoredBackup
+	for _, entry := range catalog.Entries() {
+		key := ManifestKey(entry.Key)
+		manifest, ok := manifests[key]
+		if !ok {
+			var err error
+			if manifest, err = LoadManifest(ctx, destination, key); err != nil {
+				return nil, err
+			}
+			manifests[key] = manifest
+		}
+		link, _ := manifest.Lookup(entry.Snapshot)
+		backups = append(backups, StoredBackup{CatalogEntry: entry, Link: link})
+	}
+	return backups, nil
+}
+
+// WriteBackupList prints a table of stored backups.
+func WriteBackupList(w io.Writer, backups []StoredBackup) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tTYPE\tSIZE\tUPLOADED\tWORLD\tPINNED")
+	for _, backup := range backups {
+		backupType := "incremental"
+		if backup.IsFull() {
+			backupType = "full"
+		}
+		size, uploaded, world, pinned := "-", "-", "-", "-"
+		if backup.Link != nil {
+			size = fmt.Sprintf("%d", backup.Link.Size)
+			uploaded = backup.Link.UploadedAt.Local().Format(time.DateTime)
+			if backup.Link.World != nil {
+				world = backup.Link.World.Summary()
+			}
+			if backup.Link.Pin != nil {
+				pinned = backup.Link.Pin.Summary()
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", backup.Snapshot, backupType, size, uploaded, world, pinned)
+	}
+	return tw.Flush()
+}
+
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to list")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("usage: snapuploader list [-from <destination>]")
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	source, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, source, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	backups, err := ListBackups(ctx, catalog, source)
+	if err != nil {
+		return err
+	}
+	return WriteBackupList(os.Stdout, backups)
+}
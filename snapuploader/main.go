@@ -6,9 +6,15 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
+	// Operator commands
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	// Load configuration
 	cfg, err := LoadConfig()
 	if err != nil {
@@ -17,7 +23,7 @@ func main() {
 
 	log.Printf("Starting snapuploader")
 	log.Printf("Watch directory: %s", cfg.WatchDir)
-	log.Printf("S3 hostname: %s", cfg.S3Hostname)
+	log.Printf("S3 endpoint: %s (path-style: %v)", cfg.S3EndpointURL(), cfg.S3UsePathStyle)
 	log.Printf("S3 bucket: %s", cfg.S3Bucket)
 	log.Printf("S3 region: %s", cfg.S3Region)
 
@@ -26,21 +32,44 @@ func main() {
 		log.Fatalf("Watch directory does not exist: %v", err)
 	}
 
-	// Create S3 uploader
-	uploader, err := NewS3Uploader(cfg)
+	if cfg.MetricsAddr != "" {
+		go ServeMetrics(cfg.MetricsAddr, cfg)
+	}
+
+	// Create S3 uploader and additional destinations
+	destinations, err := NewDestinations(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create S3 uploader: %v", err)
+		log.Fatalf("Failed to create destinations: %v", err)
+	}
+	for _, destination := range destinations[1:] {
+		log.Printf("Replicating to destination: %s", destination.Name())
+	}
+
+	if cfg.CacheDir != "" {
+		log.Printf("Caching streams in %s (up to %d bytes)", cfg.CacheDir, cfg.CacheMaxBytes)
+	}
+	if cfg.IntegrityCheck != IntegrityOff {
+		log.Printf("Checking region files before upload (mode: %s)", cfg.IntegrityCheck)
+	}
+	if cfg.Send != (SendOptions{}) {
+		log.Printf("Send options: protocol %d, compressed data %v, %d clone sources", cfg.Send.Protocol, cfg.Send.CompressedData, cfg.Send.CloneSources)
+	}
+	for _, warning := range cfg.Warnings() {
+		log.Printf("Warning: %s", warning)
 	}
 
 	// Create directory watcher
-	watcher, err := NewDirectoryWatcher(cfg, uploader)
+	watcher, err := NewDirectoryWatcher(cfg, destinations)
 	if err != nil {
 		log.Fatalf("Failed to create directory watcher: %v", err)
 	}
 	defer watcher.Close()
 
-	// Create context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
+	// Create contexts for graceful shutdown: ctx stops accepting new work,
+	// workCtx aborts the snapshot currently being uploaded
+	workCtx, abortWork := context.WithCancel(context.Background())
+	defer abortWork()
+	ctx, cancel := context.WithCancel(workCtx)
 	defer cancel()
 
 	// Handle signals for graceful shutdown
@@ -49,16 +78,25 @@ func main() {
 
 	go func() {
 		sig := <-sigChan
-		log.Printf("Received signal %v, shutting down...", sig)
+		log.Printf("Received signal %v, shutting down (grace period %s)...", sig, time.Duration(cfg.ShutdownGracePeriod))
 		cancel()
+
+		// Give the current upload a chance to finish
+		select {
+		case sig = <-sigChan:
+			log.Printf("Received signal %v again, aborting current upload", sig)
+		case <-time.After(time.Duration(cfg.ShutdownGracePeriod)):
+			log.Printf("Grace period expired, aborting current upload")
+		}
+		abortWork()
 	}()
 
 	// Start watching
-	if err := watcher.Start(ctx); err != nil {
+	if err := watcher.Start(ctx, workCtx); err != nil {
 		if err != context.Canceled {
 			log.Fatalf("Watcher error: %v", err)
 		}
 	}
 
 	log.Printf("Snapuploader stopped")
-}
\ No newline at end of file
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// ChainManifest describes the streams of one backup chain. It is stored as
+// manifest.json next to the streams, so the chain can be understood
+// without listing the bucket.
+type ChainManifest struct {
+	Full  string         `json:"full"`
+	Links []ManifestLink `json:"links"`
+	// Snapshots that were not uploaded as near-empty incrementals, mapped
+	// to the snapshot whose stream restores them
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// ManifestLink is one stream of a chain.
+type ManifestLink struct {
+	Snapshot   string        `json:"snapshot"`
+	Parent     string        `json:"parent,omitempty"`
+	Type       string        `json:"type"`
+	Key        string        `json:"key"`
+	Size       int64         `json:"size"`
+	Index      string        `json:"index,omitempty"` // Key of the changed-files index
+	UploadedAt time.Time     `json:"uploadedAt"`
+	World      *WorldInfo    `json:"world,omitempty"`
+	Format     *StreamFormat `json:"format,omitempty"`
+	Pin        *Pin          `json:"pin,omitempty"` // Set while pinned, the chain is never expired then
+}
+
+// ManifestKey returns the key of the manifest of the chain a stream key
+// belongs to.
+func ManifestKey(streamKey string) string {
+	return path.Join(path.Dir(streamKey), "manifest.json")
+}
+
+// LoadManifest reads a manifest from destination. A missing manifest is
+// returned as an empty one.
+func LoadManifest(ctx context.Context, destination Destination, key string) (*ChainManifest, error) {
+	r, err := destination.Open(ctx, key)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &ChainManifest{Full: path.Base(path.Dir(key))}, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest ChainManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", key, err)
+	}
+	return &manifest, nil
+}
+
+// Put adds link to the manifest, replacing an earlier link of the same
+// snapshot. A pin of the earlier link is kept.
+func (m *ChainManifest) Put(link ManifestLink) {
+	for i := range m.Links {
+		if m.Links[i].Snapshot == link.Snapshot {
+			if link.Pin == nil {
+				link.Pin = m.Links[i].Pin
+			}
+			m.Links[i] = link
+			return
+		}
+	}
+	m.Links = append(m.Links, link)
+}
+
+// Lookup returns the link of a snapshot.
+func (m *ChainManifest) Lookup(snapshot string) (*ManifestLink, bool) {
+	for i := range m.Links {
+		if m.Links[i].Snapshot == snapshot {
+			return &m.Links[i], true
+		}
+	}
+	return nil, false
+}
+
+// Pinned returns the links of the chain that are pinned.
+func (m *ChainManifest) Pinned() []*ManifestLink {
+	var pinned []*ManifestLink
+	for i := range m.Links {
+		if m.Links[i].Pin != nil {
+			pinned = append(pinned, &m.Links[i])
+		}
+	}
+	return pinned
+}
+
+// RecordInManifest adds link to the manifest of its chain on destination.
+// The manifest is replaced through a staging key, so readers never see a
+// partial one.
+func RecordInManifest(ctx context.Context, destination Destination, link ManifestLink) error {
+	key := ManifestKey(link.Key)
+	manifest, err := LoadManifest(ctx, destination, key)
+	if err != nil {
+		return err
+	}
+	manifest.Put(link)
+	return SaveManifest(ctx, destination, key, manifest)
+}
+
+// RecordAlias records in the manifest of the chain of streamKey on
+// destination that snapshot is an alias of the snapshot aliasOf, whose
+// stream is at streamKey.
+func RecordAlias(ctx context.Context, destination Destination, streamKey string, snapshot string, aliasOf string) error {
+	key := ManifestKey(streamKey)
+	manifest, err := LoadManifest(ctx, destination, key)
+	if err != nil {
+		return err
+	}
+	if manifest.Aliases == nil {
+		manifest.Aliases = make(map[string]string)
+	}
+	manifest.Aliases[snapshot] = aliasOf
+	return SaveManifest(ctx, destination, key, manifest)
+}
+
+// SaveManifest replaces the manifest at key on destination.
+func SaveManifest(ctx context.Context, destination Destination, key string, manifest *ChainManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return putObject(ctx, destination, key, data)
+}
+
+// putObject stores a small object through a staging key.
+func putObject(ctx context.Context, destination Destination, key string, data []byte) error {
+	stagingKey := StagingKey(key)
+	if err := destination.UploadStream(ctx, stagingKey, bytes.NewReader(data)); err != nil {
+		destination.DiscardStaged(context.Background(), stagingKey)
+		return err
+	}
+	return destination.Promote(ctx, stagingKey, key)
+}
+
+// readAllFrom reads the object at key from destination.
+func readAllFrom(ctx context.Context, destination Destination, key string) ([]byte, error) {
+	r, err := destination.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
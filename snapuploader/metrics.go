@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics holds the process-wide counters exposed on the metrics endpoint.
+type Metrics struct {
+	uploadsTotal       atomic.Int64
+	uploadedBytesTotal atomic.Int64
+	failuresTotal      atomic.Int64
+}
+
+var metrics Metrics
+
+// ServeMetrics exposes counters and snapshot states in the Prometheus text
+// format on addr. Snapshot states are computed from the watch directory on
+// every scrape.
+func ServeMetrics(addr string, cfg *Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		snapshots, err := FindSnapshots(cfg.WatchDir, cfg.SnapshotTimeLayout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		counts := CountSnapshotStates(snapshots, cfg.MaxAttempts)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP snapuploader_snapshots Number of local snapshots by processing state.")
+		fmt.Fprintln(w, "# TYPE snapuploader_snapshots gauge")
+		for _, state := range allStates {
+			fmt.Fprintf(w, "snapuploader_snapshots{state=%q} %d\n", state, counts[state])
+		}
+		destinations := cfg.DestinationNames()
+		lagging := CountLaggingSnapshots(snapshots, destinations)
+		fmt.Fprintln(w, "# HELP snapuploader_lagging_snapshots Number of completed snapshots a destination does not have yet.")
+		fmt.Fprintln(w, "# TYPE snapuploader_lagging_snapshots gauge")
+		for _, name := range destinations {
+			fmt.Fprintf(w, "snapuploader_lagging_snapshots{destination=%q} %d\n", name, lagging[name])
+		}
+		fmt.Fprintln(w, "# HELP snapuploader_uploads_total Number of snapshots uploaded successfully.")
+		fmt.Fprintln(w, "# TYPE snapuploader_uploads_total counter")
+		fmt.Fprintf(w, "snapuploader_uploads_total %d\n", metrics.uploadsTotal.Load())
+		fmt.Fprintln(w, "# HELP snapuploader_uploaded_bytes_total Compressed bytes uploaded.")
+		fmt.Fprintln(w, "# TYPE snapuploader_uploaded_bytes_total counter")
+		fmt.Fprintf(w, "snapuploader_uploaded_bytes_total %d\n", metrics.uploadedBytesTotal.Load())
+		fmt.Fprintln(w, "# HELP snapuploader_failures_total Number of failed snapshot processing attempts.")
+		fmt.Fprintln(w, "# TYPE snapuploader_failures_total counter")
+		fmt.Fprintf(w, "snapuploader_failures_total %d\n", metrics.failuresTotal.Load())
+	})
+
+	log.Printf("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Metrics server stopped: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckParent checks that parent can be used as the parent of an
+// incremental of current. recordedUUID is the UUID recorded when the parent
+// was uploaded, empty for .done files written before it was recorded.
+func CheckParent(current *SubvolumeInfo, parent *SubvolumeInfo, recordedUUID string) error {
+	if !parent.ReadOnly {
+		return fmt.Errorf("it is not read-only")
+	}
+	// A received subvolume keeps the UUID it was sent with as received UUID
+	if recordedUUID != "" && parent.UUID != recordedUUID && parent.ReceivedUUID != recordedUUID {
+		return fmt.Errorf("its UUID %s differs from %s recorded at upload, it was replaced", parent.UUID, recordedUUID)
+	}
+	if current.ParentUUID != "" && parent.ParentUUID != "" && current.ParentUUID != parent.ParentUUID {
+		return fmt.Errorf("it is a snapshot of a different subvolume %s, not of %s", parent.ParentUUID, current.ParentUUID)
+	}
+	return nil
+}
+
+// ValidateParent checks that the parent snapshot chosen by DecideUpload is
+// still the subvolume that was uploaded, so btrfs send -p can use it.
+func ValidateParent(current *SubvolumeInfo, parent *SnapshotInfo) error {
+	isSubvolume, err := IsSubvolume(parent.Path)
+	if err != nil {
+		return err
+	}
+	if !isSubvolume {
+		return ErrNotSubvolume
+	}
+	info, err := ShowSubvolume(parent.Path)
+	if err != nil {
+		return err
+	}
+	recordedUUID := ""
+	if parent.Done != nil {
+		recordedUUID = parent.Done.SubvolumeUUID
+	}
+	return CheckParent(current, info, recordedUUID)
+}
+
+// OrphanedDoneFiles returns the names of snapshots that were uploaded but
+// whose directory was deleted since. FindSnapshots does not list them.
+func OrphanedDoneFiles(watchDir string) ([]string, error) {
+	entries, err := os.ReadDir(watchDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".done")
+		if !ok || entry.IsDir() || name == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(watchDir, name)); os.IsNotExist(err) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// snapshotAfter reports whether snapshot a was taken after b, judging by
+// their names.
+func snapshotAfter(a string, b string, layout string) bool {
+	keys := []orderKey{
+		{name: ParseSnapshotName(a, layout)},
+		{name: ParseSnapshotName(b, layout)},
+	}
+	return chronologicalOrder(keys)[0] == 1
+}
+
+// parentProblem returns why the parent chosen by DecideUpload cannot be
+// used, or nil if it can. A newer uploaded snapshot that was deleted
+// locally means the parent is not the end of the uploaded chain.
+func (dw *DirectoryWatcher) parentProblem(current *SubvolumeInfo, parentPath string, snapshots []SnapshotInfo) error {
+	var parent *SnapshotInfo
+	for i := range snapshots {
+		if snapshots[i].Path == parentPath {
+			parent = &snapshots[i]
+		}
+	}
+	if parent == nil {
+		return fmt.Errorf("it no longer exists")
+	}
+
+	orphans, err := OrphanedDoneFiles(dw.watchDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range orphans {
+		// Deleting an alias does not affect the uploaded chain
+		if done, err := ReadDoneFile(filepath.Join(dw.watchDir, name+".done")); err == nil && done.Type == BackupTypeAlias {
+			continue
+		}
+		if snapshotAfter(name, parent.Name, dw.config.SnapshotTimeLayout) {
+			return fmt.Errorf("the newer uploaded snapshot %s was deleted locally", name)
+		}
+	}
+	return ValidateParent(current, parent)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckParent(t *testing.T) {
+	current := &SubvolumeInfo{UUID: "c", ParentUUID: "world"}
+	for _, tc := range []struct {
+		parent   SubvolumeInfo
+		recorded string
+		problem  string
+	}{
+		{SubvolumeInfo{UUID: "p", ParentUUID: "world", ReadOnly: true}, "p", ""},
+		// .done files written before the UUID was recorded
+		{SubvolumeInfo{UUID: "p", ParentUUID: "world", ReadOnly: true}, "", ""},
+		// Received back from a backup
+		{SubvolumeInfo{UUID: "r", ParentUUID: "world", ReceivedUUID: "p", ReadOnly: true}, "p", ""},
+		{SubvolumeInfo{UUID: "p", ParentUUID: "world"}, "p", "read-only"},
+		{SubvolumeInfo{UUID: "q", ParentUUID: "world", ReadOnly: true}, "p", "replaced"},
+		{SubvolumeInfo{UUID: "p", ParentUUID: "other", ReadOnly: true}, "p", "different subvolume"},
+	} {
+		err := CheckParent(current, &tc.parent, tc.recorded)
+		if tc.problem == "" && err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tc.parent, err)
+		}
+		if tc.problem != "" && (err == nil || !strings.Contains(err.Error(), tc.problem)) {
+			t.Fatalf("%+v: unexpected error: want %q, got %v", tc.parent, tc.problem, err)
+		}
+	}
+}
+
+func TestOrphanedDoneFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"gt100", "gt200"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"gt100.done", "gt150.done", "gt200.inprogress"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphans, err := OrphanedDoneFiles(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"gt150"}; !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("unexpected orphans: want %v, got %v", want, orphans)
+	}
+	if !snapshotAfter("gt150", "gt100", "") || snapshotAfter("gt150", "gt200", "") {
+		t.Fatalf("unexpected order of gt100, gt150 and gt200")
+	}
+}
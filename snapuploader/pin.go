@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// PinnedTag is the object tag set on every stream a pinned snapshot
+// depends on.
+const PinnedTag = "pinned"
+
+// Pin marks a backup that retention must keep, for example the last one
+// before a Minecraft version upgrade.
+type Pin struct {
+	Label    string    `json:"label,omitempty"`
+	PinnedAt time.Time `json:"pinnedAt"`
+}
+
+// Summary describes the pin in one line.
+func (p *Pin) Summary() string {
+	if p.Label == "" {
+		return "yes"
+	}
+	return p.Label
+}
+
+// SetPin pins snapshot on destination, or unpins it if pin is nil. The pin
+// is recorded in the manifest of its chain, and the streams it depends on
+// are tagged.
+func SetPin(ctx context.Context, destination Destination, catalog *Catalog, snapshot string, pin *Pin) error {
+	entry, ok := catalog.Lookup(snapshot)
+	if !ok {
+		return fmt.Errorf("no backup of snapshot %s found on %s", snapshot, destination.Name())
+	}
+	key := ManifestKey(entry.Key)
+	manifest, err := LoadManifest(ctx, destination, key)
+	if err != nil {
+		return err
+	}
+	link, ok := manifest.Lookup(snapshot)
+	if !ok {
+		// Streams uploaded before manifests existed
+		backupType := "incremental"
+		if entry.IsFull() {
+			backupType = "full"
+		}
+		manifest.Put(ManifestLink{Snapshot: entry.Snapshot, Parent: entry.Parent, Type: backupType, Key: entry.Key})
+		link, _ = manifest.Lookup(snapshot)
+	}
+	link.Pin = pin
+	if err := SaveManifest(ctx, destination, key, manifest); err != nil {
+		return err
+	}
+	return TagPinned(ctx, destination, catalog, manifest)
+}
+
+// PinnedKeys returns the keys of the streams the pinned links of a chain
+// depend on, which are the links from its full up to each of them.
+func PinnedKeys(catalog *Catalog, manifest *ChainManifest) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, link := range manifest.Pinned() {
+		chain, err := catalog.Chain(link.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range chain {
+			keys[entry.Key] = true
+		}
+	}
+	return keys, nil
+}
+
+// TagPinned tags the streams of a chain that pinned links depend on with
+// pinned=true and removes the tag from the others. Destinations that cannot
+// tag objects rely on the manifest alone.
+func TagPinned(ctx context.Context, destination Destination, catalog *Catalog, manifest *ChainManifest) error {
+	tagger, ok := destination.(TaggingDestination)
+	if !ok {
+		return nil
+	}
+	pinned, err := PinnedKeys(catalog, manifest)
+	if err != nil {
+		return err
+	}
+	for _, entry := range catalog.Entries() {
+		if entry.Full != manifest.Full {
+			continue
+		}
+		var tags map[string]string
+		if pinned[entry.Key] {
+			tags = map[string]string{PinnedTag: "true"}
+		}
+		if err := tagger.SetTags(ctx, entry.Key, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinLocal records pin in the .done file of a local snapshot and returns
+// its content. It returns nil if the snapshot was not uploaded from here.
+func pinLocal(watchDir string, snapshot string, pin *Pin) (*DoneFileContent, error) {
+	snapshotPath := filepath.Join(watchDir, snapshot)
+	done, err := ReadDoneFile(snapshotPath + ".done")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	done.Pin = pin
+	if err := WriteDoneFile(snapshotPath, done); err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+func pinCommand(args []string) error {
+	flags := flag.NewFlagSet("pin", flag.ContinueOnError)
+	label := flags.String("label", "", "why the snapshot is pinned")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("usage: snapuploader pin [-label <text>] <snapshot>")
+	}
+	return setPin(flags.Arg(0), &Pin{Label: *label, PinnedAt: time.Now()})
+}
+
+func unpinCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: snapuploader unpin <snapshot>")
+	}
+	return setPin(args[0], nil)
+}
+
+// setPin pins or unpins a snapshot locally and on every destination that
+// has it.
+func setPin(snapshot string, pin *Pin) error {
+	if snapshot != filepath.Base(snapshot) {
+		return fmt.Errorf("invalid snapshot name %q", snapshot)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	action := "Pinned"
+	if pin == nil {
+		action = "Unpinned"
+	}
+	done, err := pinLocal(cfg.WatchDir, snapshot, pin)
+	if err != nil {
+		return err
+	}
+	stored := snapshot
+	if done != nil {
+		fmt.Printf("%s %s in %s\n", action, snapshot, cfg.WatchDir)
+		// An alias was never uploaded, the stream of its parent holds it
+		if done.Type == BackupTypeAlias {
+			stored = done.AliasOf
+			fmt.Printf("%s is an alias of %s\n", snapshot, stored)
+		}
+	}
+
+	found := done != nil
+	var errs []error
+	for _, destination := range destinations {
+		catalog, err := LoadCatalog(ctx, destination, cfg.SnapshotPrefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", destination.Name(), err))
+			continue
+		}
+		if _, ok := catalog.Lookup(stored); !ok {
+			continue
+		}
+		found = true
+		if err := SetPin(ctx, destination, catalog, stored, pin); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", destination.Name(), err))
+			continue
+		}
+		fmt.Printf("%s %s on %s\n", action, stored, destination.Name())
+	}
+	if !found && len(errs) == 0 {
+		return fmt.Errorf("no backup of snapshot %s found", snapshot)
+	}
+	return errors.Join(errs...)
+}
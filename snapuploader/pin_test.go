@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// taggingDestination records the tags set on objects.
+type taggingDestination struct {
+	LocalDestination
+	tags map[string]map[string]string
+}
+
+func (d *taggingDestination) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	d.tags[key] = tags
+	return nil
+}
+
+// storeChains stores streams and manifests of two chains on destination.
+func storeChains(t *testing.T, destination Destination) *Catalog {
+	t.Helper()
+	keys := []string{
+		"backup/gt100/full.zst",
+		"backup/gt100/incremental.gt200.zst",
+		"backup/gt100/incremental.gt300.from.gt200.zst",
+		"backup/gt400/full.zst",
+		"backup/gt400/incremental.gt500.zst",
+	}
+	for _, key := range keys {
+		entry, _ := parseStreamKey(key)
+		if err := destination.UploadStream(context.Background(), key, strings.NewReader("stream")); err != nil {
+			t.Fatal(err)
+		}
+		backupType := "incremental"
+		if entry.IsFull() {
+			backupType = "full"
+		}
+		link := ManifestLink{Snapshot: entry.Snapshot, Parent: entry.Parent, Type: backupType, Key: key, UploadedAt: time.Now()}
+		if err := RecordInManifest(context.Background(), destination, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewCatalog(keys, "")
+}
+
+func TestSetPin(t *testing.T) {
+	ctx := context.Background()
+	destination := &taggingDestination{LocalDestination{name: PrimaryDestination, root: t.TempDir()}, map[string]map[string]string{}}
+	catalog := storeChains(t, destination)
+
+	if err := SetPin(ctx, destination, catalog, "gt200", &Pin{Label: "before 1.22", PinnedAt: time.Now()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pinned := map[string]string{PinnedTag: "true"}
+	want := map[string]map[string]string{
+		"backup/gt100/full.zst":                         pinned,
+		"backup/gt100/incremental.gt200.zst":            pinned,
+		"backup/gt100/incremental.gt300.from.gt200.zst": nil,
+	}
+	if !reflect.DeepEqual(destination.tags, want) {
+		t.Fatalf("unexpected tags:\nwant %v\ngot  %v", want, destination.tags)
+	}
+
+	// Publishing the link again keeps the pin
+	link := ManifestLink{Snapshot: "gt200", Parent: "gt100", Type: "incremental", Key: "backup/gt100/incremental.gt200.zst"}
+	if err := RecordInManifest(ctx, destination, link); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := LoadManifest(ctx, destination, "backup/gt100/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pins := manifest.Pinned(); len(pins) != 1 || pins[0].Pin.Summary() != "before 1.22" {
+		t.Fatalf("unexpected pins: %+v", pins)
+	}
+
+	if err := SetPin(ctx, destination, catalog, "gt200", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, tags := range destination.tags {
+		if tags != nil {
+			t.Fatalf("expected %s to be untagged, got %v", key, tags)
+		}
+	}
+	if err := SetPin(ctx, destination, catalog, "gt999", nil); err == nil {
+		t.Fatalf("expected an unknown snapshot to fail")
+	}
+}
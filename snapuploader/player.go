@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorcon/rcon"
+	"github.com/rinsuki-lab/mc1218c/nbt"
+)
+
+var uuidPattern = regexp.MustCompile(`^([0-9a-f]{8})-?([0-9a-f]{4})-?([0-9a-f]{4})-?([0-9a-f]{4})-?([0-9a-f]{12})$`)
+
+// Player is a player resolved from a name or UUID.
+type Player struct {
+	UUID string `json:"uuid"`           // Lowercase with dashes, as in file names
+	Name string `json:"name,omitempty"` // Empty if not in the user cache
+}
+
+func (p *Player) String() string {
+	if p.Name == "" {
+		return p.UUID
+	}
+	return fmt.Sprintf("%s (%s)", p.Name, p.UUID)
+}
+
+// usercacheEntry is an entry of the server's usercache.json.
+type usercacheEntry struct {
+	Name string `json:"name"`
+	UUID string `json:"uuid"`
+}
+
+// ResolvePlayer resolves a player name or UUID through the user cache. A
+// UUID is accepted without the cache, names are not.
+func ResolvePlayer(arg string, usercache string) (*Player, error) {
+	var player *Player
+	if m := uuidPattern.FindStringSubmatch(strings.ToLower(arg)); m != nil {
+		player = &Player{UUID: strings.Join(m[1:], "-")}
+	}
+
+	var entries []usercacheEntry
+	data, err := os.ReadFile(usercache)
+	if err == nil {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		if player != nil {
+			return player, nil
+		}
+		return nil, fmt.Errorf("failed to read user cache to resolve %s: %w", arg, err)
+	}
+
+	for _, entry := range entries {
+		if player != nil && strings.EqualFold(entry.UUID, player.UUID) {
+			player.Name = entry.Name
+			return player, nil
+		}
+		if player == nil && strings.EqualFold(entry.Name, arg) {
+			return &Player{UUID: strings.ToLower(entry.UUID), Name: entry.Name}, nil
+		}
+	}
+	if player != nil {
+		return player, nil
+	}
+	return nil, fmt.Errorf("player %s not found in %s", arg, usercache)
+}
+
+// playerFileMatcher matches the data, statistics and advancements files of
+// a player in any world directory.
+func playerFileMatcher(uuid string) func(string) bool {
+	return func(p string) bool {
+		dir, file := path.Split(p)
+		switch path.Base(dir) {
+		case "playerdata":
+			return file == uuid+".dat"
+		case "stats", "advancements":
+			return file == uuid+".json"
+		}
+		return false
+	}
+}
+
+// ItemStack is an item in a player's inventory.
+type ItemStack struct {
+	Slot  string
+	ID    string
+	Count int64
+}
+
+// PlayerSummary is what a player data file says about a player, shown
+// before a rollback.
+type PlayerSummary struct {
+	Dimension  string
+	Pos        [3]float64
+	Health     float64
+	XpLevel    int64
+	Inventory  []ItemStack
+	EnderItems []ItemStack
+}
+
+// equipmentSlots are the slots of the equipment compound, which holds armor
+// and the offhand item since Minecraft 1.21.5.
+var equipmentSlots = []string{"head", "chest", "legs", "feet", "offhand", "body", "saddle"}
+
+// ReadPlayerSummary reads a player data file.
+func ReadPlayerSummary(file string) (*PlayerSummary, error) {
+	root, err := nbt.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	summary := &PlayerSummary{}
+	summary.Dimension, _ = root.String("Dimension")
+	if pos, ok := root.List("Pos"); ok && len(pos) == 3 {
+		for i := range pos {
+			summary.Pos[i], _ = pos[i].(float64)
+		}
+	}
+	summary.Health, _ = root.Float("Health")
+	summary.XpLevel, _ = root.Int("XpLevel")
+
+	items, _ := root.List("Inventory")
+	summary.Inventory = readItems(items, inventorySlotName)
+	if equipment, ok := root.Compound("equipment"); ok {
+		for _, slot := range equipmentSlots {
+			if item, ok := equipment.Compound(slot); ok {
+				summary.Inventory = append(summary.Inventory, readItem(item, slot))
+			}
+		}
+	}
+	enderItems, _ := root.List("EnderItems")
+	summary.EnderItems = readItems(enderItems, func(slot int64) string {
+		return fmt.Sprintf("ender %d", slot)
+	})
+	return summary, nil
+}
+
+// inventorySlotName names a slot of the Inventory list.
+func inventorySlotName(slot int64) string {
+	switch {
+	case slot >= 0 && slot < 9:
+		return fmt.Sprintf("hotbar %d", slot+1)
+	case slot >= 9 && slot < 36:
+		return fmt.Sprintf("inventory %d", slot)
+	case slot >= 100 && slot <= 103:
+		// Armor before Minecraft 1.21.5
+		return equipmentSlots[3-(slot-100)]
+	case slot == -106:
+		return "offhand"
+	}
+	return fmt.Sprintf("slot %d", slot)
+}
+
+func readItems(list nbt.List, slotName func(int64) string) []ItemStack {
+	var items []ItemStack
+	for _, v := range list {
+		item, ok := v.(nbt.Compound)
+		if !ok {
+			continue
+		}
+		slot, _ := item.Int("Slot")
+		items = append(items, readItem(item, slotName(slot)))
+	}
+	return items
+}
+
+func readItem(item nbt.Compound, slot string) ItemStack {
+	stack := ItemStack{Slot: slot, Count: 1}
+	stack.ID, _ = item.String("id")
+	// The count is "count" since Minecraft 1.20.5 and "Count" before
+	if count, ok := item.Int("count"); ok {
+		stack.Count = count
+	} else if count, ok := item.Int("Count"); ok {
+		stack.Count = count
+	}
+	return stack
+}
+
+// WritePlayerSummary prints a player summary for confirmation.
+func WritePlayerSummary(w io.Writer, summary *PlayerSummary) error {
+	fmt.Fprintf(w, "Position: %s %.1f, %.1f, %.1f\n", summary.Dimension, summary.Pos[0], summary.Pos[1], summary.Pos[2])
+	fmt.Fprintf(w, "Health: %.1f, level %d\n", summary.Health, summary.XpLevel)
+	for _, section := range []struct {
+		title string
+		items []ItemStack
+	}{{"Inventory", summary.Inventory}, {"Ender chest", summary.EnderItems}} {
+		fmt.Fprintf(w, "%s (%d stacks):\n", section.title, len(section.items))
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, item := range section.items {
+			fmt.Fprintf(tw, "  %s\t%s\tx%d\n", item.Slot, item.ID, item.Count)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StagedRollback describes player files staged for replacement. It is
+// stored as rollback.json in the staging directory, next to the files.
+type StagedRollback struct {
+	Player   Player    `json:"player"`
+	Snapshot string    `json:"snapshot"`
+	Files    []string  `json:"files"` // Paths relative to the snapshot root
+	StagedAt time.Time `json:"stagedAt"`
+}
+
+const stagedRollbackFile = "rollback.json"
+
+// stagedFilesDir is the directory below the staging directory holding the
+// files to put in place.
+const stagedFilesDir = "files"
+
+// replacedFilesDir is the directory below the staging directory the
+// replaced live files are moved to.
+const replacedFilesDir = "replaced"
+
+// StagePlayerRollback extracts the files of player from the snapshot at the
+// end of chain into dir.
+func StagePlayerRollback(ctx context.Context, chain []*CatalogEntry, player *Player, dir string, cache *StreamCache, source Destination) (*StagedRollback, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("staging directory %s is not empty", dir)
+	}
+	snapshot := chain[len(chain)-1].Snapshot
+	files, err := ExtractMatching(ctx, chain, playerFileMatcher(player.UUID), filepath.Join(dir, stagedFilesDir), cache, source)
+	if errors.Is(err, ErrNoMatch) {
+		return nil, fmt.Errorf("no files of player %s in %s", player, snapshot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	staged := &StagedRollback{Player: *player, Snapshot: snapshot, Files: files, StagedAt: time.Now()}
+	data, err := json.MarshalIndent(staged, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, stagedRollbackFile), data, 0644); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// ReadStagedRollback reads the description of a staging directory.
+func ReadStagedRollback(dir string) (*StagedRollback, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stagedRollbackFile))
+	if err != nil {
+		return nil, err
+	}
+	var staged StagedRollback
+	if err := json.Unmarshal(data, &staged); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", stagedRollbackFile, err)
+	}
+	return &staged, nil
+}
+
+// ParseOnlinePlayers parses the response to the list command, like "There
+// are 2 of a max of 20 players online: Alex, Steve".
+func ParseOnlinePlayers(response string) ([]string, error) {
+	response = strings.TrimSpace(stripFormatting(response))
+	if !strings.HasPrefix(response, "There are ") {
+		return nil, fmt.Errorf("unexpected response to list: %q", response)
+	}
+	_, names, _ := strings.Cut(response, ":")
+	var players []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			players = append(players, name)
+		}
+	}
+	return players, nil
+}
+
+// stripFormatting removes § formatting codes.
+func stripFormatting(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "§") {
+			i += len("§")
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// checkPlayerOffline asks the server over RCON whether player is online.
+// The server saves and reloads player data on join and quit, so files must
+// only be replaced while the player is offline.
+func checkPlayerOffline(cfg *Config, player *Player) error {
+	if player.Name == "" {
+		return fmt.Errorf("the name of %s is unknown, so it cannot be checked whether the player is online", player.UUID)
+	}
+	conn, err := rcon.Dial(cfg.RCONAddress, cfg.RCONPassword, rcon.SetDialTimeout(10*time.Second))
+	if err != nil {
+		return fmt.Errorf("failed to connect to RCON at %s: %w", cfg.RCONAddress, err)
+	}
+	defer conn.Close()
+	response, err := conn.Execute("list")
+	if err != nil {
+		return fmt.Errorf("failed to list online players: %w", err)
+	}
+	online, err := ParseOnlinePlayers(response)
+	if err != nil {
+		return err
+	}
+	for _, name := range online {
+		if strings.EqualFold(name, player.Name) {
+			return fmt.Errorf("%s is online; ask them to disconnect first", player.Name)
+		}
+	}
+	return nil
+}
+
+// ApplyStagedRollback puts the staged files in place below root, moving
+// the files they replace to the staging directory.
+func ApplyStagedRollback(dir string, staged *StagedRollback, root string) error {
+	for _, file := range staged.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file)) {
+			return fmt.Errorf("staged path %q leaves the server directory", file)
+		}
+		target := filepath.Join(root, filepath.FromSlash(file))
+		if _, err := os.Lstat(target); err == nil {
+			replaced := filepath.Join(dir, replacedFilesDir, filepath.FromSlash(file))
+			if err := os.MkdirAll(filepath.Dir(replaced), 0755); err != nil {
+				return err
+			}
+			if err := copyFileAtomic(target, replaced); err != nil {
+				return fmt.Errorf("failed to keep %s: %w", file, err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := copyFileAtomic(filepath.Join(dir, stagedFilesDir, filepath.FromSlash(file)), target); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// copyFileAtomic copies src over dst through a temporary file, so dst is
+// never partially written.
+func copyFileAtomic(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".rollback"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func playerCommand(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "stage":
+			return playerStageCommand(args[1:])
+		case "apply":
+			return playerApplyCommand(args[1:])
+		}
+	}
+	return fmt.Errorf("usage: snapuploader player stage|apply ...")
+}
+
+func playerStageCommand(args []string) error {
+	flags := flag.NewFlagSet("player stage", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to extract from")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		return fmt.Errorf("usage: snapuploader player stage [-from <destination>] <player> <snapshot> <directory>")
+	}
+	name, snapshot, dir := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	player, err := ResolvePlayer(name, cfg.UserCache)
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	source, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, source, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	chain, err := catalog.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := CheckChainApplicable(ctx, chain, source); err != nil {
+		return err
+	}
+	staged, err := StagePlayerRollback(ctx, chain, player, dir, NewStreamCache(cfg), source)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Staged %s as of %s:\n", player, snapshot)
+	for _, file := range staged.Files {
+		fmt.Printf("  %s\n", file)
+		if path.Base(path.Dir(file)) != "playerdata" {
+			continue
+		}
+		summary, err := ReadPlayerSummary(filepath.Join(dir, stagedFilesDir, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		if err := WritePlayerSummary(os.Stdout, summary); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Run \"snapuploader player apply %s\" while the player is offline to put the files in place\n", dir)
+	return nil
+}
+
+func playerApplyCommand(args []string) error {
+	flags := flag.NewFlagSet("player apply", flag.ContinueOnError)
+	offline := flags.Bool("offline", false, "the server is stopped, skip the online check")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("usage: snapuploader player apply [-offline] <directory>")
+	}
+	dir := flags.Arg(0)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.SnapshotSource == "" {
+		return fmt.Errorf("snapshotSource (SNAPSHOT_SRC) is required to apply a rollback")
+	}
+	staged, err := ReadStagedRollback(dir)
+	if err != nil {
+		return err
+	}
+	if !*offline {
+		if err := checkPlayerOffline(cfg, &staged.Player); err != nil {
+			return fmt.Errorf("%w (use -offline if the server is stopped)", err)
+		}
+	}
+	if err := ApplyStagedRollback(dir, staged, cfg.SnapshotSource); err != nil {
+		return err
+	}
+	fmt.Printf("Rolled back %s to %s; the replaced files are in %s\n", &staged.Player, staged.Snapshot, filepath.Join(dir, replacedFilesDir))
+	return nil
+}
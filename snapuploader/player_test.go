@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rinsuki-lab/mc1218c/nbt"
+)
+
+func TestResolvePlayer(t *testing.T) {
+	usercache := filepath.Join(t.TempDir(), "usercache.json")
+	data := `[{"name":"Steve","uuid":"8667ba71-b85a-4004-af54-457a9734eed7","expiresOn":"2026-11-01 00:00:00 +0000"}]`
+	if err := os.WriteFile(usercache, []byte(data), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, arg := range []string{"steve", "8667BA71B85A4004AF54457A9734EED7", "8667ba71-b85a-4004-af54-457a9734eed7"} {
+		player, err := ResolvePlayer(arg, usercache)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", arg, err)
+		}
+		want := Player{UUID: "8667ba71-b85a-4004-af54-457a9734eed7", Name: "Steve"}
+		if *player != want {
+			t.Fatalf("%s: unexpected player: want %+v, got %+v", arg, want, *player)
+		}
+	}
+
+	if _, err := ResolvePlayer("Alex", usercache); err == nil {
+		t.Fatalf("expected an unknown name to fail")
+	}
+	player, err := ResolvePlayer("ec561538-f3fd-461d-aff5-086b22154bce", filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || player.Name != "" {
+		t.Fatalf("expected a UUID to resolve without the user cache: %+v, %v", player, err)
+	}
+}
+
+func TestPlayerFileMatcher(t *testing.T) {
+	match := playerFileMatcher("8667ba71-b85a-4004-af54-457a9734eed7")
+	for p, want := range map[string]bool{
+		"worlds/world/playerdata/8667ba71-b85a-4004-af54-457a9734eed7.dat":     true,
+		"worlds/world/playerdata/8667ba71-b85a-4004-af54-457a9734eed7.dat_old": false,
+		"worlds/world/stats/8667ba71-b85a-4004-af54-457a9734eed7.json":         true,
+		"worlds/world/advancements/8667ba71-b85a-4004-af54-457a9734eed7.json":  true,
+		"worlds/world/playerdata/ec561538-f3fd-461d-aff5-086b22154bce.dat":     false,
+		"worlds/world/data/8667ba71-b85a-4004-af54-457a9734eed7.dat":           false,
+		"worlds/world/playerdata": false,
+	} {
+		if got := match(p); got != want {
+			t.Fatalf("unexpected match of %s: want %v, got %v", p, want, got)
+		}
+	}
+}
+
+func TestParseOnlinePlayers(t *testing.T) {
+	players, err := ParseOnlinePlayers("There are 2 of a max of 20 players online: §eAlex§r, Steve\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"Alex", "Steve"}; !reflect.DeepEqual(players, want) {
+		t.Fatalf("unexpected players: want %q, got %q", want, players)
+	}
+	if players, err := ParseOnlinePlayers("There are 0 of a max of 20 players online: "); err != nil || len(players) != 0 {
+		t.Fatalf("unexpected players: %q, %v", players, err)
+	}
+	if _, err := ParseOnlinePlayers("Unknown command"); err == nil {
+		t.Fatalf("expected an unexpected response to fail")
+	}
+}
+
+func TestReadPlayerSummary(t *testing.T) {
+	b := &nbtBuilder{}
+	b.tag(nbt.TagCompound, "")
+	b.tag(nbt.TagString, "Dimension").str("minecraft:the_nether")
+	b.tag(nbt.TagList, "Pos").be(byte(nbt.TagDouble)).be(int32(3))
+	for _, v := range []float64{12.5, 64, -30.25} {
+		b.be(math.Float64bits(v))
+	}
+	b.tag(nbt.TagFloat, "Health").be(math.Float32bits(20))
+	b.tag(nbt.TagInt, "XpLevel").be(int32(30))
+	b.tag(nbt.TagList, "Inventory").be(byte(nbt.TagCompound)).be(int32(2))
+	b.tag(nbt.TagByte, "Slot").be(int8(0))
+	b.tag(nbt.TagString, "id").str("minecraft:diamond_sword")
+	b.end()
+	b.tag(nbt.TagByte, "Slot").be(int8(103))
+	b.tag(nbt.TagString, "id").str("minecraft:netherite_helmet")
+	b.tag(nbt.TagInt, "count").be(int32(1))
+	b.end()
+	b.tag(nbt.TagCompound, "equipment")
+	b.tag(nbt.TagCompound, "offhand")
+	b.tag(nbt.TagString, "id").str("minecraft:torch")
+	b.tag(nbt.TagInt, "count").be(int32(64))
+	b.end() // offhand
+	b.end() // equipment
+	b.end() // root
+
+	file := filepath.Join(t.TempDir(), "player.dat")
+	if err := os.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	summary, err := ReadPlayerSummary(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &PlayerSummary{
+		Dimension: "minecraft:the_nether",
+		Pos:       [3]float64{12.5, 64, -30.25},
+		Health:    20,
+		XpLevel:   30,
+		Inventory: []ItemStack{
+			{Slot: "hotbar 1", ID: "minecraft:diamond_sword", Count: 1},
+			{Slot: "head", ID: "minecraft:netherite_helmet", Count: 1},
+			{Slot: "offhand", ID: "minecraft:torch", Count: 64},
+		},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("unexpected summary: want %+v, got %+v", want, summary)
+	}
+}
+
+func TestApplyStagedRollback(t *testing.T) {
+	dir, root := t.TempDir(), t.TempDir()
+	file := "worlds/world/playerdata/8667ba71-b85a-4004-af54-457a9734eed7.dat"
+	staged := filepath.Join(dir, stagedFilesDir, file)
+	live := filepath.Join(root, file)
+	for p, content := range map[string]string{staged: "old", live: "broken"} {
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := ApplyStagedRollback(dir, &StagedRollback{Files: []string{file}}, root); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(live); string(data) != "old" {
+		t.Fatalf("unexpected live file: want %q, got %q", "old", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, replacedFilesDir, file)); string(data) != "broken" {
+		t.Fatalf("unexpected replaced file: want %q, got %q", "broken", data)
+	}
+
+	if err := ApplyStagedRollback(dir, &StagedRollback{Files: []string{"../escape"}}, root); err == nil {
+		t.Fatalf("expected a path leaving the root to fail")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// wallClockLayouts are the layouts accepted for a point in time, in local
+// time unless the layout has a zone.
+var wallClockLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// timeOfDayLayouts are accepted for a time today.
+var timeOfDayLayouts = []string{"15:04:05", "15:04"}
+
+// ParseWallClock parses a point in time given by an operator, like
+// "2026-10-18 21:40" or "21:40" for today.
+func ParseWallClock(s string, now time.Time) (time.Time, error) {
+	for _, layout := range wallClockLayouts {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range timeOfDayLayouts {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			year, month, day := now.Date()
+			return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, now.Location()), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use \"2006-01-02 15:04\" or \"15:04\"", s)
+}
+
+// SnapshotTime returns when a stored snapshot was taken, and what that is
+// based on: the time in its name, the last save recorded in level.dat, or
+// its upload time. The upload time is later than the snapshot, so a
+// snapshot resolved by it was certainly taken before the point in time.
+func SnapshotTime(backup *StoredBackup, layout string) (time.Time, string, bool) {
+	if t := ParseSnapshotName(backup.Snapshot, layout).Time; !t.IsZero() {
+		return t, "name", true
+	}
+	if backup.Link == nil {
+		return time.Time{}, "", false
+	}
+	if backup.Link.World != nil && !backup.Link.World.LastPlayed.IsZero() {
+		return backup.Link.World.LastPlayed, "level.dat", true
+	}
+	if !backup.Link.UploadedAt.IsZero() {
+		return backup.Link.UploadedAt, "upload", true
+	}
+	return time.Time{}, "", false
+}
+
+// SnapshotGameTime returns the game time a stored snapshot was taken at,
+// from its name or level.dat.
+func SnapshotGameTime(backup *StoredBackup) (int64, bool) {
+	if name := ParseSnapshotName(backup.Snapshot, ""); name.HasGameTime {
+		return name.GameTime, true
+	}
+	if backup.Link != nil && backup.Link.World != nil {
+		return backup.Link.World.GameTime, true
+	}
+	return 0, false
+}
+
+// ResolveTime returns the latest backup taken at or before at.
+func ResolveTime(backups []StoredBackup, at time.Time, layout string) (*StoredBackup, error) {
+	var best *StoredBackup
+	var bestTime time.Time
+	for i := range backups {
+		t, _, ok := SnapshotTime(&backups[i], layout)
+		if !ok || t.After(at) {
+			continue
+		}
+		if best == nil || t.After(bestTime) {
+			best, bestTime = &backups[i], t
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no backup taken at or before %s", at.Format(time.DateTime))
+	}
+	return best, nil
+}
+
+// ResolveGameTime returns the latest backup taken at or before the game
+// time tick.
+func ResolveGameTime(backups []StoredBackup, tick int64) (*StoredBackup, error) {
+	var best *StoredBackup
+	var bestTick int64
+	for i := range backups {
+		gameTime, ok := SnapshotGameTime(&backups[i])
+		if !ok || gameTime > tick {
+			continue
+		}
+		if best == nil || gameTime > bestTick {
+			best, bestTick = &backups[i], gameTime
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no backup taken at or before game time %d", tick)
+	}
+	return best, nil
+}
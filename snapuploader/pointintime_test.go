@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshotName(t *testing.T) {
+	layout := "/snapshots/2006-01-02T15-04-05-"
+	name := ParseSnapshotName("2026-10-18T21-35-00-gt19500000", layout)
+	if !name.HasGameTime || name.GameTime != 19500000 {
+		t.Fatalf("unexpected game time: %+v", name)
+	}
+	if want := time.Date(2026, 10, 18, 21, 35, 0, 0, time.Local); !name.Time.Equal(want) {
+		t.Fatalf("unexpected time: want %v, got %v", want, name.Time)
+	}
+
+	name = ParseSnapshotName("gt42", "")
+	if !name.HasGameTime || name.GameTime != 42 || !name.Time.IsZero() {
+		t.Fatalf("unexpected name: %+v", name)
+	}
+	name = ParseSnapshotName("manual-backup", layout)
+	if name.HasGameTime || !name.Time.IsZero() {
+		t.Fatalf("expected nothing to parse: %+v", name)
+	}
+}
+
+func TestParseWallClock(t *testing.T) {
+	now := time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)
+	for s, want := range map[string]time.Time{
+		"2026-10-18 21:40":          time.Date(2026, 10, 18, 21, 40, 0, 0, time.UTC),
+		"2026-10-18T21:40:30":       time.Date(2026, 10, 18, 21, 40, 30, 0, time.UTC),
+		"2026-10-18T21:40:00+09:00": time.Date(2026, 10, 18, 12, 40, 0, 0, time.UTC),
+		"02:30":                     time.Date(2026, 10, 19, 2, 30, 0, 0, time.UTC),
+	} {
+		got, err := ParseWallClock(s, now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", s, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("%s: unexpected time: want %v, got %v", s, want, got)
+		}
+	}
+	if _, err := ParseWallClock("yesterday", now); err == nil {
+		t.Fatalf("expected an invalid time to fail")
+	}
+}
+
+func TestResolvePointInTime(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2026, 10, 18, hour, minute, 0, 0, time.Local)
+	}
+	backups := []StoredBackup{
+		// Named with a time
+		{CatalogEntry: &CatalogEntry{Snapshot: "2026-10-18T21-00-00-gt1000"}},
+		// Only the upload time is known
+		{CatalogEntry: &CatalogEntry{Snapshot: "gt2000"}, Link: &ManifestLink{UploadedAt: at(21, 30)}},
+		// level.dat is preferred over the upload time
+		{CatalogEntry: &CatalogEntry{Snapshot: "gt3000"}, Link: &ManifestLink{
+			UploadedAt: at(21, 50),
+			World:      &WorldInfo{GameTime: 3000, LastPlayed: at(21, 39)},
+		}},
+		{CatalogEntry: &CatalogEntry{Snapshot: "gt4000"}, Link: &ManifestLink{UploadedAt: at(22, 0)}},
+	}
+	layout := "2006-01-02T15-04-05-"
+
+	for point, want := range map[time.Time]string{
+		at(21, 0):  "2026-10-18T21-00-00-gt1000",
+		at(21, 35): "gt2000",
+		at(21, 40): "gt3000",
+		at(23, 0):  "gt4000",
+	} {
+		backup, err := ResolveTime(backups, point, layout)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", point, err)
+		}
+		if backup.Snapshot != want {
+			t.Fatalf("%v: unexpected snapshot: want %s, got %s", point, want, backup.Snapshot)
+		}
+	}
+	if _, err := ResolveTime(backups, at(20, 0), layout); err == nil || !strings.Contains(err.Error(), "no backup") {
+		t.Fatalf("expected no backup before the first, got %v", err)
+	}
+
+	for tick, want := range map[int64]string{1000: "2026-10-18T21-00-00-gt1000", 2999: "gt2000", 1 << 40: "gt4000"} {
+		backup, err := ResolveGameTime(backups, tick)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", tick, err)
+		}
+		if backup.Snapshot != want {
+			t.Fatalf("%d: unexpected snapshot: want %s, got %s", tick, want, backup.Snapshot)
+		}
+	}
+	if _, err := ResolveGameTime(backups, 999); err == nil {
+		t.Fatalf("expected no backup before game time 1000")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// PruneCandidates returns the local snapshots that can be deleted. Kept
+// are the latest keep uploaded snapshots, pinned ones, those not on every
+// destination yet, and the chain since the latest full, which the next
+// incremental and the backup policy build on.
+func PruneCandidates(snapshots []SnapshotInfo, keep int, destinations []string) []*SnapshotInfo {
+	chainStart := len(snapshots)
+	if latestFull := FindLatestFullParent(snapshots); latestFull != nil {
+		for i := range snapshots {
+			if snapshots[i].Path == latestFull.Path {
+				chainStart = i
+			}
+		}
+	}
+
+	var candidates []*SnapshotInfo
+	kept := 0
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := &snapshots[i]
+		if !snapshot.HasDone {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		if i >= chainStart || snapshot.Done == nil || snapshot.Done.Pin != nil {
+			continue
+		}
+		if len(snapshot.Done.LaggingDestinations(destinations)) > 0 {
+			continue
+		}
+		candidates = append(candidates, snapshot)
+	}
+	// Oldest first
+	for i, j := 0, len(candidates)-1; i < j; i, j = i+1, j-1 {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return candidates
+}
+
+// DeleteSnapshot deletes the subvolume of a local snapshot and then its
+// .done file.
+func DeleteSnapshot(snapshotPath string) error {
+	output, err := exec.Command("btrfs", "subvolume", "delete", snapshotPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs subvolume delete %s: %w: %s", snapshotPath, err, strings.TrimSpace(string(output)))
+	}
+	if err := os.Remove(snapshotPath + ".done"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove .done file: %w", err)
+	}
+	return nil
+}
+
+func pruneCommand(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	keep := flags.Int("keep", 10, "number of latest uploaded snapshots to keep")
+	dryRun := flags.Bool("dry-run", false, "only print what would be deleted")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *keep < 0 {
+		return fmt.Errorf("usage: snapuploader prune [-keep <n>] [-dry-run]")
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	snapshots, err := FindSnapshots(cfg.WatchDir, cfg.SnapshotTimeLayout)
+	if err != nil {
+		return err
+	}
+	candidates := PruneCandidates(snapshots, *keep, cfg.DestinationNames())
+	for _, snapshot := range candidates {
+		if *dryRun {
+			fmt.Printf("Would delete %s\n", snapshot.Name)
+			continue
+		}
+		if err := DeleteSnapshot(snapshot.Path); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s\n", snapshot.Name)
+	}
+	if len(candidates) == 0 {
+		fmt.Println("Nothing to prune")
+	}
+	return nil
+}
+
+// ExpireCandidates returns the full backups whose chains can be deleted
+// from a destination: all but the latest keep chains, unless a link of the
+// chain is pinned. manifests maps the full backup names to their chain
+// manifests. Which chains are the latest must be known for sure, so it
+// fails if a snapshot name cannot be ordered with layout.
+func ExpireCandidates(catalog *Catalog, manifests map[string]*ChainManifest, keep int, layout string) ([]string, error) {
+	if names := catalog.Unorderable(layout); len(names) > 0 {
+		return nil, fmt.Errorf("cannot tell the time of these snapshots from their names, refusing to expire: %s", strings.Join(names, ", "))
+	}
+	var chains []string
+	seen := make(map[string]bool)
+	for _, entry := range catalog.EntriesByTime(layout) {
+		if !seen[entry.Full] {
+			seen[entry.Full] = true
+			chains = append(chains, entry.Full)
+		}
+	}
+
+	var candidates []string
+	for i, full := range chains {
+		if i >= len(chains)-keep {
+			break
+		}
+		if manifest := manifests[full]; manifest != nil {
+			if pinned := manifest.Pinned(); len(pinned) > 0 {
+				log.Printf("Keeping chain %s: %s is pinned", full, pinned[0].Snapshot)
+				continue
+			}
+		}
+		candidates = append(candidates, full)
+	}
+	return candidates, nil
+}
+
+// ExpireChain deletes every object of the chain of a full backup from
+// destination. The manifest goes last, so an interrupted expiry still
+// shows what is left of the chain.
+func ExpireChain(ctx context.Context, destination Destination, prefix string, full string) error {
+	deleter, ok := destination.(DeletingDestination)
+	if !ok {
+		return fmt.Errorf("cannot delete backups from %s", destination.Name())
+	}
+	dir := backupKeyPrefix(prefix) + full + "/"
+	keys, err := destination.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	manifestKey := dir + "manifest.json"
+	for _, key := range keys {
+		if key == manifestKey {
+			continue
+		}
+		if err := deleter.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return deleter.Delete(ctx, manifestKey)
+}
+
+func expireCommand(args []string) error {
+	flags := flag.NewFlagSet("expire", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to expire backups from")
+	keep := flags.Int("keep", 4, "number of latest chains to keep")
+	dryRun := flags.Bool("dry-run", false, "only print what would be deleted")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *keep < 1 {
+		return fmt.Errorf("usage: snapuploader expire [-from <destination>] [-keep <n>] [-dry-run]")
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	destination, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, destination, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	manifests := make(map[string]*ChainManifest)
+	for _, entry := range catalog.Entries() {
+		if _, ok := manifests[entry.Full]; ok {
+			continue
+		}
+		manifest, err := LoadManifest(ctx, destination, ManifestKey(entry.Key))
+		if err != nil {
+			return err
+		}
+		manifests[entry.Full] = manifest
+	}
+
+	candidates, err := ExpireCandidates(catalog, manifests, *keep, cfg.SnapshotTimeLayout)
+	if err != nil {
+		return err
+	}
+	for _, full := range candidates {
+		if *dryRun {
+			fmt.Printf("Would expire chain %s\n", full)
+			continue
+		}
+		if err := ExpireChain(ctx, destination, cfg.SnapshotPrefix, full); err != nil {
+			return err
+		}
+		fmt.Printf("Expired chain %s\n", full)
+	}
+	if len(candidates) == 0 {
+		fmt.Println("Nothing to expire")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	destination := &LocalDestination{name: PrimaryDestination, root: t.TempDir()}
+	catalog := storeChains(t, destination)
+	manifests := make(map[string]*ChainManifest)
+	for _, full := range []string{"gt100", "gt400"} {
+		manifest, err := LoadManifest(ctx, destination, "backup/"+full+"/manifest.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests[full] = manifest
+	}
+
+	if got, err := ExpireCandidates(catalog, manifests, 1, ""); err != nil || !reflect.DeepEqual(got, []string{"gt100"}) {
+		t.Fatalf("unexpected candidates: %v, %v", got, err)
+	}
+	if got, err := ExpireCandidates(catalog, manifests, 2, ""); err != nil || len(got) != 0 {
+		t.Fatalf("unexpected candidates: %v, %v", got, err)
+	}
+	// Pinning any link keeps the chain
+	if err := SetPin(ctx, destination, catalog, "gt300", &Pin{PinnedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := LoadManifest(ctx, destination, "backup/gt100/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests["gt100"] = manifest
+	if got, err := ExpireCandidates(catalog, manifests, 1, ""); err != nil || len(got) != 0 {
+		t.Fatalf("expected the pinned chain to be kept, got %v, %v", got, err)
+	}
+
+	if err := ExpireChain(ctx, destination, "", "gt100"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, err := destination.List(ctx, "backup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"backup/gt400/full.zst", "backup/gt400/incremental.gt500.zst", "backup/gt400/manifest.json"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys after expiry:\nwant %v\ngot  %v", want, keys)
+	}
+}
+
+func TestExpireCandidates_Order(t *testing.T) {
+	// By name, gt100000 would sort before gt99999
+	catalog := NewCatalog([]string{
+		"backup/gt99999/full.zst",
+		"backup/gt100000/full.zst",
+	}, "")
+	if got, err := ExpireCandidates(catalog, nil, 1, ""); err != nil || !reflect.DeepEqual(got, []string{"gt99999"}) {
+		t.Fatalf("unexpected candidates: %v, %v", got, err)
+	}
+
+	layout := "2006-01-02T15-04-05-"
+	catalog = NewCatalog([]string{
+		"backup/2026-10-18T21-00-00-gt500/full.zst",
+		"backup/2026-10-19T03-00-00-gt100/full.zst",
+	}, "")
+	if got, err := ExpireCandidates(catalog, nil, 1, layout); err != nil || !reflect.DeepEqual(got, []string{"2026-10-18T21-00-00-gt500"}) {
+		t.Fatalf("unexpected candidates: %v, %v", got, err)
+	}
+
+	// One name without a game time would make the order fall back to names
+	catalog = NewCatalog([]string{
+		"backup/gt99999/full.zst",
+		"backup/gt100000/full.zst",
+		"backup/manual/full.zst",
+	}, "")
+	if _, err := ExpireCandidates(catalog, nil, 1, ""); err == nil || !strings.Contains(err.Error(), "manual") {
+		t.Fatalf("expected expiry to be refused, got %v", err)
+	}
+}
+
+func TestPruneCandidates(t *testing.T) {
+	done := func(name string, backupType string, pin *Pin) SnapshotInfo {
+		return SnapshotInfo{Path: "/watch/" + name, Name: name, HasDone: true, BackupType: backupType, Done: &DoneFileContent{Type: backupType, Pin: pin}}
+	}
+	snapshots := []SnapshotInfo{
+		done("gt100", "full", nil),
+		done("gt200", "incremental", &Pin{PinnedAt: time.Now()}),
+		done("gt300", "incremental", nil),
+		done("gt400", "full", nil),
+		done("gt500", "incremental", nil),
+		{Path: "/watch/gt600", Name: "gt600"},
+	}
+	var names []string
+	for _, snapshot := range PruneCandidates(snapshots, 1, []string{PrimaryDestination}) {
+		names = append(names, snapshot.Name)
+	}
+	if want := []string{"gt100", "gt300"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected candidates: want %v, got %v", want, names)
+	}
+}
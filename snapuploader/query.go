@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// MatchChangedPath reports whether a changed path matches a query. Queries
+// with glob characters match the whole path, others match the path or its
+// trailing segments, so "r.3.-2.mca" finds "region/r.3.-2.mca".
+func MatchChangedPath(query string, p string) bool {
+	if strings.ContainsAny(query, "*?[") {
+		matched, _ := path.Match(query, p)
+		return matched
+	}
+	query = strings.Trim(query, "/")
+	return p == query || strings.HasSuffix(p, "/"+query)
+}
+
+// QueryResult is a change of a matching path in one stream.
+type QueryResult struct {
+	Entry *CatalogEntry
+	Path  string
+	Bytes int64
+	Ops   []string
+}
+
+// QueryChanges searches the changed-files indexes of every stream in the
+// catalog. Streams uploaded before indexes existed are skipped.
+func QueryChanges(ctx context.Context, catalog *Catalog, destination Destination, query string) ([]QueryResult, error) {
+	manifests := make(map[string]*ChainManifest)
+	var results []QueryResult
+	for _, entry := range catalog.Entries() {
+		manifestKey := ManifestKey(entry.Key)
+		manifest, ok := manifests[manifestKey]
+		if !ok {
+			var err error
+			if manifest, err = LoadManifest(ctx, destination, manifestKey); err != nil {
+				return nil, err
+			}
+			manifests[manifestKey] = manifest
+		}
+		indexKey := IndexKey(entry.Key)
+		if link, ok := manifest.Lookup(entry.Snapshot); ok {
+			if link.Index == "" {
+				continue
+			}
+			indexKey = link.Index
+		}
+
+		index, err := LoadIndex(ctx, destination, indexKey)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, change := range index.Changes {
+			if MatchChangedPath(query, change.Path) {
+				results = append(results, QueryResult{Entry: entry, Path: change.Path, Bytes: change.Bytes, Ops: change.Ops})
+			}
+		}
+	}
+	return results, nil
+}
+
+func queryCommand(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to search")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("usage: snapuploader query [-from <destination>] <path>")
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	source, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, source, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	results, err := QueryChanges(ctx, catalog, source, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("no indexed stream changed %s", flags.Arg(0))
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tTYPE\tPATH\tBYTES\tOPS")
+	for _, result := range results {
+		backupType := "incremental"
+		if result.Entry.IsFull() {
+			backupType = "full"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", result.Entry.Snapshot, backupType, result.Path, result.Bytes, strings.Join(result.Ops, ","))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+func TestQueryChanges(t *testing.T) {
+	ctx := context.Background()
+	primary := &LocalDestination{name: PrimaryDestination, root: t.TempDir()}
+
+	streams := []struct {
+		link    ManifestLink
+		changes []sendstream.Change
+	}{
+		{ManifestLink{Snapshot: "gt100", Type: "full", Key: "backup/gt100/full.zst"},
+			[]sendstream.Change{{Path: "region/r.3.-2.mca", Bytes: 100, Ops: []string{"mkfile", "write"}}}},
+		{ManifestLink{Snapshot: "gt200", Parent: "gt100", Type: "incremental", Key: "backup/gt100/incremental.gt200.zst"},
+			[]sendstream.Change{{Path: "level.dat", Bytes: 10, Ops: []string{"write"}}}},
+		{ManifestLink{Snapshot: "gt300", Parent: "gt200", Type: "incremental", Key: "backup/gt100/incremental.gt300.from.gt200.zst"},
+			[]sendstream.Change{{Path: "region/r.3.-2.mca", Bytes: 4096, Ops: []string{"write"}}}},
+	}
+	var keys []string
+	for _, s := range streams {
+		s.link.Index = IndexKey(s.link.Key)
+		s.link.UploadedAt = time.Now()
+		index, err := EncodeIndex(&ChangedFilesIndex{Snapshot: s.link.Snapshot, Changes: s.changes})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := PublishStreamExtras(ctx, primary, s.link, index); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		keys = append(keys, s.link.Key)
+	}
+
+	manifest, err := LoadManifest(ctx, primary, "backup/gt100/manifest.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manifest.Links) != 3 || manifest.Full != "gt100" {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+
+	results, err := QueryChanges(ctx, NewCatalog(keys, ""), primary, "r.3.-2.mca")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 || results[0].Entry.Snapshot != "gt100" || results[1].Entry.Snapshot != "gt300" || results[1].Bytes != 4096 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	if !MatchChangedPath("region/*.mca", "region/r.3.-2.mca") || MatchChangedPath("3.-2.mca", "region/r.3.-2.mca") {
+		t.Fatalf("unexpected path matching")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rinsuki-lab/mc1218c/sendstream"
+)
+
+// ErrNeedsCloneSources is returned for chains with streams that clone from
+// snapshots older than their parent. Streams are applied to one tree, which
+// no longer holds the files of those snapshots.
+var ErrNeedsCloneSources = errors.New("chain needs earlier snapshots as clone sources, restore it with btrfs receive")
+
+// CheckChainApplicable returns ErrNeedsCloneSources if a stream of chain
+// was sent with extra clone sources, as recorded in the manifests.
+func CheckChainApplicable(ctx context.Context, chain []*CatalogEntry, source Destination) error {
+	manifests := make(map[string]*ChainManifest)
+	for _, entry := range chain {
+		key := ManifestKey(entry.Key)
+		manifest, ok := manifests[key]
+		if !ok {
+			var err error
+			if manifest, err = LoadManifest(ctx, source, key); err != nil {
+				return err
+			}
+			manifests[key] = manifest
+		}
+		if link, ok := manifest.Lookup(entry.Snapshot); ok && link.Format != nil && len(link.Format.CloneSources) > 0 {
+			return fmt.Errorf("%s clones from %s: %w", entry.Snapshot, strings.Join(link.Format.CloneSources, ", "), ErrNeedsCloneSources)
+		}
+	}
+	return nil
+}
+
+// RestoreChain applies the streams of chain in order to the directory dir,
+// which must be empty. Streams are read from the cache if it has them.
+func RestoreChain(ctx context.Context, chain []*CatalogEntry, dir string, cache *StreamCache, destinations []Destination) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+
+	applier, err := sendstream.NewApplier(dir)
+	if err != nil {
+		return err
+	}
+	applier.Decode = decodeExtent
+	for i, entry := range chain {
+		log.Printf("Applying %s (%d/%d)", entry.Key, i+1, len(chain))
+		if err := applyStoredStream(ctx, applier, entry.Key, cache, destinations); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", entry.Key, err)
+		}
+	}
+	return nil
+}
+
+func applyStoredStream(ctx context.Context, applier *sendstream.Applier, key string, cache *StreamCache, destinations []Destination) error {
+	r, err := OpenStream(ctx, key, cache, destinations)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	stream, err := DecompressStream(ctx, r)
+	if err != nil {
+		return err
+	}
+	if err := applier.ApplyStream(stream); err != nil {
+		stream.Close()
+		return err
+	}
+	return stream.Close()
+}
+
+// decodeExtent decodes zstd-compressed extents of encoded writes with the
+// zstd tool. Other compression types are not supported.
+func decodeExtent(compression uint64, data []byte, unencodedLen uint64) ([]byte, error) {
+	if compression != sendstream.CompressionZstd {
+		return nil, fmt.Errorf("unsupported compression type %d", compression)
+	}
+	cmd := exec.Command("zstd", "-dc")
+	cmd.Stdin = bytes.NewReader(data)
+	var out bytes.Buffer
+	out.Grow(int(unencodedLen))
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd extent: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := flags.String("from", PrimaryDestination, "destination to restore from")
+	at := flags.String("at", "", "restore the latest snapshot taken at or before this time")
+	tick := flags.Int64("tick", -1, "restore the latest snapshot taken at or before this game time")
+	yes := flags.Bool("yes", false, "do not ask for confirmation")
+	flags.SetOutput(io.Discard)
+	err := flags.Parse(args)
+	// A point in time takes the place of the snapshot argument
+	pointInTime := *at != "" || *tick >= 0
+	wantArgs := 2
+	if pointInTime {
+		wantArgs = 1
+	}
+	if err != nil || flags.NArg() != wantArgs || (*at != "" && *tick >= 0) {
+		return fmt.Errorf("usage: snapuploader restore [-from <destination>] <snapshot> <directory>\n" +
+			"       snapuploader restore [-from <destination>] [-yes] -at <time>|-tick <game time> <directory>")
+	}
+	dir := flags.Arg(flags.NArg() - 1)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return err
+	}
+	source, err := findDestination(destinations, *from)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	catalog, err := LoadCatalog(ctx, source, cfg.SnapshotPrefix)
+	if err != nil {
+		return err
+	}
+	backups, err := ListBackups(ctx, catalog, source)
+	if err != nil {
+		return err
+	}
+
+	var snapshot string
+	switch {
+	case *at != "":
+		point, err := ParseWallClock(*at, time.Now())
+		if err != nil {
+			return err
+		}
+		backup, err := ResolveTime(backups, point, cfg.SnapshotTimeLayout)
+		if err != nil {
+			return err
+		}
+		snapshot = backup.Snapshot
+		fmt.Printf("Latest snapshot at or before %s: %s\n", point.Format(time.DateTime), snapshot)
+	case *tick >= 0:
+		backup, err := ResolveGameTime(backups, *tick)
+		if err != nil {
+			return err
+		}
+		snapshot = backup.Snapshot
+		fmt.Printf("Latest snapshot at or before game time %d: %s\n", *tick, snapshot)
+	default:
+		snapshot = flags.Arg(0)
+	}
+
+	chain, err := catalog.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := WriteChain(os.Stdout, chain, backups, cfg.SnapshotTimeLayout); err != nil {
+		return err
+	}
+	if err := CheckChainApplicable(ctx, chain, source); err != nil {
+		return err
+	}
+	if pointInTime && !*yes {
+		ok, err := confirm(os.Stdin, os.Stdout, fmt.Sprintf("Restore %s to %s?", snapshot, dir))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("aborted")
+		}
+	}
+	if err := RestoreChain(ctx, chain, dir, NewStreamCache(cfg), []Destination{source}); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s to %s from %d streams\n", snapshot, dir, len(chain))
+	return nil
+}
+
+// WriteChain prints the streams of a chain with when each snapshot was
+// taken.
+func WriteChain(w io.Writer, chain []*CatalogEntry, backups []StoredBackup, layout string) error {
+	bySnapshot := make(map[string]*StoredBackup, len(backups))
+	for i := range backups {
+		bySnapshot[backups[i].Snapshot] = &backups[i]
+	}
+
+	fmt.Fprintf(w, "Chain of %d streams:\n", len(chain))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  SNAPSHOT\tTYPE\tTAKEN\tWORLD")
+	for _, entry := range chain {
+		backupType := "incremental"
+		if entry.IsFull() {
+			backupType = "full"
+		}
+		taken, world := "-", "-"
+		if backup, ok := bySnapshot[entry.Snapshot]; ok {
+			if t, basis, ok := SnapshotTime(backup, layout); ok {
+				taken = fmt.Sprintf("%s (%s)", t.Local().Format(time.DateTime), basis)
+			}
+			if backup.Link != nil && backup.Link.World != nil {
+				world = backup.Link.World.Summary()
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", entry.Snapshot, backupType, taken, world)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if requirements := ChainRequirements(chain, bySnapshot); len(requirements) > 0 {
+		fmt.Fprintln(w, "Receiver needs:")
+		for _, requirement := range requirements {
+			fmt.Fprintf(w, "  %s\n", requirement)
+		}
+	}
+	return nil
+}
+
+// ChainRequirements returns what a receiver needs to apply the streams of a
+// chain, as recorded in their manifest links.
+func ChainRequirements(chain []*CatalogEntry, bySnapshot map[string]*StoredBackup) []string {
+	var requirements []string
+	seen := make(map[string]bool)
+	for _, entry := range chain {
+		backup, ok := bySnapshot[entry.Snapshot]
+		if !ok || backup.Link == nil {
+			continue
+		}
+		for _, requirement := range backup.Link.Format.Requirements() {
+			if !seen[requirement] {
+				seen[requirement] = true
+				requirements = append(requirements, requirement)
+			}
+		}
+	}
+	return requirements
+}
+
+// confirm asks a yes/no question, defaulting to no.
+func confirm(r io.Reader, w io.Writer, question string) (bool, error) {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// findDestination returns the destination with the given name.
+func findDestination(destinations []Destination, name string) (Destination, error) {
+	for _, destination := range destinations {
+		if destination.Name() == name {
+			return destination, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown destination %q", name)
+}
@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Uploader struct {
+	name     string
 	client   *s3.Client
 	uploader *manager.Uploader
 	bucket   string
@@ -23,43 +30,65 @@ type S3Uploader struct {
 // ErrS3Upload is a sentinel error indicating S3 upload failures.
 var ErrS3Upload = fmt.Errorf("s3 upload error")
 
-func NewS3Uploader(cfg *Config) (*S3Uploader, error) {
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			cfg.S3AccessKey,
-			cfg.S3SecretKey,
-			"",
-		)),
+func NewS3Uploader(name string, cfg *S3Config) (*S3Uploader, error) {
+	opts := []func(*config.LoadOptions) error{
 		config.WithRegion(cfg.S3Region),
-		// Configure AWS SDK retryer to retry up to 10 attempts
+		// Configure AWS SDK retryer to retry up to the configured attempts
 		config.WithRetryer(func() aws.Retryer {
 			return retry.NewStandard(func(o *retry.StandardOptions) {
-				o.MaxAttempts = 10
+				o.MaxAttempts = cfg.S3MaxAttempts
 			})
 		}),
-	)
+	}
+	if cfg.S3CABundle != "" {
+		caBundle, err := os.Open(cfg.S3CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open CA bundle: %w", err)
+		}
+		defer caBundle.Close()
+		opts = append(opts, config.WithCustomCABundle(caBundle))
+	}
+	// Without configured credentials the default credential chain is used
+	if provider := CredentialsProvider(cfg); provider != nil {
+		opts = append(opts, config.WithCredentialsProvider(provider))
+	} else {
+		log.Printf("No S3 credentials configured, using the default AWS credential chain")
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String(fmt.Sprintf("https://%s", cfg.S3Hostname))
+		o.BaseEndpoint = aws.String(cfg.S3EndpointURL())
+		o.UsePathStyle = cfg.S3UsePathStyle
+		if cfg.S3DisablePayloadSigning {
+			// Some providers reject or mishandle signed streaming payloads
+			o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+		}
 	})
 
 	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
 		// Configure uploader settings
-		u.PartSize = 16 * 1024 * 1024 // 16MB parts
-		u.Concurrency = 3			 // 3 concurrent uploads
+		u.PartSize = cfg.S3PartSize
+		u.Concurrency = cfg.S3Concurrency
 	})
 
 	return &S3Uploader{
+		name:     name,
 		client:   client,
 		uploader: uploader,
 		bucket:   cfg.S3Bucket,
 	}, nil
 }
 
-func (u *S3Uploader) Upload(ctx context.Context, key string, reader io.Reader, contentLength int64) error {
+// Name returns the destination name of the bucket.
+func (u *S3Uploader) Name() string {
+	return u.name
+}
+
+func (u *S3Uploader) Upload(ctx context.Context, key string, reader io.Reader, contentLength int64, metadata map[string]string) error {
 	log.Printf("Starting upload to s3://%s/%s", u.bucket, key)
 
 	input := &s3.PutObjectInput{
@@ -67,6 +96,9 @@ func (u *S3Uploader) Upload(ctx context.Context, key string, reader io.Reader, c
 		Key:	aws.String(key),
 		Body:   reader,
 	}
+	if len(metadata) > 0 {
+		input.Metadata = metadata
+	}
 
 	if contentLength > 0 {
 		input.ContentLength = aws.Int64(contentLength)
@@ -75,6 +107,12 @@ func (u *S3Uploader) Upload(ctx context.Context, key string, reader io.Reader, c
 	// Use the upload manager for better handling of streams
 	_, err := u.uploader.Upload(ctx, input)
 	if err != nil {
+		// The upload manager aborts the multipart upload with ctx, which
+		// does not work when the upload failed because ctx was canceled
+		var multiErr manager.MultiUploadFailure
+		if ctx.Err() != nil && errors.As(err, &multiErr) {
+			u.abortMultipartUpload(key, aws.String(multiErr.UploadID()))
+		}
 		return fmt.Errorf("%w: %v", ErrS3Upload, err)
 	}
 
@@ -84,5 +122,237 @@ func (u *S3Uploader) Upload(ctx context.Context, key string, reader io.Reader, c
 
 func (u *S3Uploader) UploadStream(ctx context.Context, key string, reader io.Reader) error {
 	// For streaming upload without known content length
-	return u.Upload(ctx, key, reader, -1)
+	return u.Upload(ctx, key, reader, -1, nil)
+}
+
+// UploadStreamWithMetadata uploads a stream as an object with user metadata.
+func (u *S3Uploader) UploadStreamWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+	return u.Upload(ctx, key, reader, -1, metadata)
+}
+
+// maxCopyObjectSize is the largest object CopyObject can copy in one request.
+// Larger objects are copied part by part.
+const maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the part size used for multipart copies.
+const copyPartSize = 512 * 1024 * 1024
+
+// abortTimeout bounds cleanup requests made after the caller's context was
+// canceled.
+const abortTimeout = 30 * time.Second
+
+// StagingKey returns the temporary key a stream for key is uploaded to
+// before it is promoted.
+func StagingKey(key string) string {
+	return key + ".uploading"
+}
+
+// Promote moves the object at stagingKey to key. S3 has no rename, so the
+// object is copied, keeping its metadata, and the staged object is deleted
+// afterwards.
+func (u *S3Uploader) Promote(ctx context.Context, stagingKey string, key string) error {
+	head, err := u.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(stagingKey),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: failed to stat staged object %s: %v", ErrS3Upload, stagingKey, err)
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	copySource := copySourceFor(u.bucket, stagingKey)
+	if size <= maxCopyObjectSize {
+		_, err = u.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(u.bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(copySource),
+		})
+	} else {
+		err = u.multipartCopy(ctx, copySource, key, size, head.Metadata)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: failed to promote %s to %s: %v", ErrS3Upload, stagingKey, key, err)
+	}
+
+	if err := u.Delete(ctx, stagingKey); err != nil {
+		// The final object is complete, a leftover staged object is only garbage
+		log.Printf("Warning: %v", err)
+	}
+
+	log.Printf("Promoted s3://%s/%s to s3://%s/%s", u.bucket, stagingKey, u.bucket, key)
+	return nil
+}
+
+// copySourceFor returns the URL-encoded "bucket/key" value for CopySource.
+func copySourceFor(bucket string, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func (u *S3Uploader) multipartCopy(ctx context.Context, copySource string, key string, size int64, metadata map[string]string) error {
+	// Unlike CopyObject, a multipart copy does not carry over the metadata
+	created, err := u.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(key),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []types.CompletedPart
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+copyPartSize, partNumber+1 {
+		last := min(offset+copyPartSize, size) - 1
+		out, err := u.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(u.bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+		})
+		if err != nil {
+			u.abortMultipartUpload(key, created.UploadId)
+			return err
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+	}
+
+	_, err = u.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		u.abortMultipartUpload(key, created.UploadId)
+		return err
+	}
+	return nil
+}
+
+func (u *S3Uploader) abortMultipartUpload(key string, uploadID *string) {
+	// Use a fresh context, the caller's one may already be canceled
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	_, err := u.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Warning: failed to abort multipart upload of %s: %v", key, err)
+	}
+}
+
+// AbortMultipartUploads aborts all incomplete multipart uploads to key, for
+// example ones left behind by a process that was killed.
+func (u *S3Uploader) AbortMultipartUploads(ctx context.Context, key string) error {
+	paginator := s3.NewListMultipartUploadsPaginator(u.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(u.bucket),
+		Prefix: aws.String(key),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list multipart uploads of %s: %w", key, err)
+		}
+		for _, upload := range page.Uploads {
+			if aws.ToString(upload.Key) != key {
+				continue
+			}
+			log.Printf("Aborting incomplete multipart upload %s of s3://%s/%s", aws.ToString(upload.UploadId), u.bucket, key)
+			u.abortMultipartUpload(key, upload.UploadId)
+		}
+	}
+	return nil
+}
+
+// DiscardStaged removes everything an interrupted or failed upload to
+// stagingKey may have left behind.
+func (u *S3Uploader) DiscardStaged(ctx context.Context, stagingKey string) error {
+	if err := u.AbortMultipartUploads(ctx, stagingKey); err != nil {
+		return err
+	}
+	return u.Delete(ctx, stagingKey)
+}
+
+// Open returns the content of the object at key.
+func (u *S3Uploader) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := u.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			// Let callers check for a missing object like for a missing file
+			return nil, fmt.Errorf("failed to get s3://%s/%s: %w", u.bucket, key, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to get s3://%s/%s: %w", u.bucket, key, err)
+	}
+	return out.Body, nil
+}
+
+// List returns the keys of all objects whose key starts with prefix.
+func (u *S3Uploader) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(u.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(u.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", u.bucket, prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes the object at key.
+func (u *S3Uploader) Delete(ctx context.Context, key string) error {
+	_, err := u.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete s3://%s/%s: %w", u.bucket, key, err)
+	}
+	log.Printf("Deleted s3://%s/%s", u.bucket, key)
+	return nil
+}
+
+// SetTags replaces the tags of the object at key. No tags removes them.
+func (u *S3Uploader) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	var err error
+	if len(tags) == 0 {
+		_, err = u.client.DeleteObjectTagging(ctx, &s3.DeleteObjectTaggingInput{
+			Bucket: aws.String(u.bucket),
+			Key:    aws.String(key),
+		})
+	} else {
+		tagSet := make([]types.Tag, 0, len(tags))
+		for k, v := range tags {
+			tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		_, err = u.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(u.bucket),
+			Key:     aws.String(key),
+			Tagging: &types.Tagging{TagSet: tagSet},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to tag s3://%s/%s: %w", u.bucket, key, err)
+	}
+	return nil
 }
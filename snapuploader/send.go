@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+)
+
+// StreamFormat records how btrfs send produced a stream, and with it what a
+// receiver must support. It is nil for streams sent with the defaults.
+type StreamFormat struct {
+	Protocol       int      `json:"protocol,omitempty"` // Send stream version, 0 for the btrfs default
+	CompressedData bool     `json:"compressedData,omitempty"`
+	CloneSources   []string `json:"cloneSources,omitempty"` // Snapshots passed with -c, which the receiver must have
+}
+
+// Args returns the btrfs send arguments for the format. Clone sources are
+// siblings of snapshotPath.
+func (f *StreamFormat) Args(snapshotPath string) []string {
+	if f == nil {
+		return nil
+	}
+	var args []string
+	if f.Protocol != 0 {
+		args = append(args, "--proto", strconv.Itoa(f.Protocol))
+	}
+	if f.CompressedData {
+		args = append(args, "--compressed-data")
+	}
+	for _, name := range f.CloneSources {
+		args = append(args, "-c", filepath.Join(filepath.Dir(snapshotPath), name))
+	}
+	return args
+}
+
+// Requirements describes what a receiver needs to apply the stream.
+func (f *StreamFormat) Requirements() []string {
+	if f == nil {
+		return nil
+	}
+	var requirements []string
+	if f.Protocol >= 2 {
+		requirements = append(requirements, fmt.Sprintf("send stream version %d (btrfs-progs and kernel 6.0 or later)", f.Protocol))
+	}
+	if f.CompressedData {
+		requirements = append(requirements, "encoded writes of compressed extents")
+	}
+	for _, name := range f.CloneSources {
+		requirements = append(requirements, fmt.Sprintf("snapshot %s received as clone source", name))
+	}
+	return requirements
+}
+
+// NewStreamFormat returns the format of the stream sent for a snapshot with
+// the given parent, or nil if it is sent with the defaults. Clone sources
+// are only passed to incrementals: without -p, btrfs send would pick a
+// parent among them.
+func NewStreamFormat(options SendOptions, snapshots []SnapshotInfo, parentPath *string) *StreamFormat {
+	format := &StreamFormat{Protocol: options.Protocol, CompressedData: options.CompressedData}
+	if parentPath != nil {
+		for _, source := range cloneSources(snapshots, *parentPath, options.CloneSources) {
+			format.CloneSources = append(format.CloneSources, source.Name)
+		}
+	}
+	if format.Protocol == 0 && !format.CompressedData && len(format.CloneSources) == 0 {
+		return nil
+	}
+	return format
+}
+
+// cloneSources returns up to n uploaded snapshots before the parent in its
+// chain, newest first. Only snapshots of the chain are used, so restoring
+// the chain in order always provides them. Snapshots that fail the parent
+// checks are left out.
+func cloneSources(snapshots []SnapshotInfo, parentPath string, n int) []*SnapshotInfo {
+	parentIndex := -1
+	for i := range snapshots {
+		if snapshots[i].Path == parentPath {
+			parentIndex = i
+		}
+	}
+	if parentIndex < 0 || snapshots[parentIndex].BackupType == "full" {
+		return nil
+	}
+
+	var parent *SubvolumeInfo
+	var sources []*SnapshotInfo
+	for i := parentIndex - 1; i >= 0 && len(sources) < n; i-- {
+		snapshot := &snapshots[i]
+		if !snapshot.HasDone || snapshot.BackupType == BackupTypeAlias {
+			continue
+		}
+		if parent == nil {
+			info, err := ShowSubvolume(parentPath)
+			if err != nil {
+				log.Printf("Warning: not using clone sources: %v", err)
+				return nil
+			}
+			parent = info
+		}
+		if err := ValidateParent(parent, snapshot); err != nil {
+			log.Printf("Warning: not using %s as clone source: %v", snapshot.Name, err)
+		} else {
+			sources = append(sources, snapshot)
+		}
+		// The chain starts at its full
+		if snapshot.BackupType == "full" {
+			break
+		}
+	}
+	return sources
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStreamFormat(t *testing.T) {
+	snapshots := []SnapshotInfo{{Path: "/snapshots/gt100", Name: "gt100", HasDone: true, BackupType: "full"}}
+	if format := NewStreamFormat(SendOptions{CloneSources: 2}, snapshots, nil); format != nil {
+		t.Fatalf("expected no format for a full with the defaults, got %+v", format)
+	}
+	// The parent is the full, which has nothing before it to clone from
+	parent := "/snapshots/gt100"
+	format := NewStreamFormat(SendOptions{Protocol: 2, CompressedData: true, CloneSources: 2}, snapshots, &parent)
+	if want := (&StreamFormat{Protocol: 2, CompressedData: true}); !reflect.DeepEqual(format, want) {
+		t.Fatalf("unexpected format: want %+v, got %+v", want, format)
+	}
+
+	format.CloneSources = []string{"gt100"}
+	args := strings.Join(format.Args("/snapshots/gt300"), " ")
+	if want := "--proto 2 --compressed-data -c /snapshots/gt100"; args != want {
+		t.Fatalf("unexpected args: want %q, got %q", want, args)
+	}
+	if requirements := format.Requirements(); len(requirements) != 3 || !strings.Contains(requirements[2], "gt100") {
+		t.Fatalf("unexpected requirements: %v", requirements)
+	}
+
+	var defaults *StreamFormat
+	if defaults.Args("/snapshots/gt300") != nil || defaults.Requirements() != nil {
+		t.Fatalf("expected nothing for the defaults")
+	}
+}
+
+func TestCheckChainApplicable(t *testing.T) {
+	ctx := context.Background()
+	destination := &LocalDestination{name: PrimaryDestination, root: t.TempDir()}
+	links := []ManifestLink{
+		{Snapshot: "gt100", Type: "full", Key: "backup/gt100/full.zst"},
+		{Snapshot: "gt200", Parent: "gt100", Type: "incremental", Key: "backup/gt100/incremental.gt200.zst"},
+		{Snapshot: "gt300", Parent: "gt200", Type: "incremental", Key: "backup/gt100/incremental.gt300.from.gt200.zst",
+			Format: &StreamFormat{Protocol: 2, CloneSources: []string{"gt100"}}},
+	}
+	var keys []string
+	for _, link := range links {
+		if err := RecordInManifest(ctx, destination, link); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, link.Key)
+	}
+	catalog := NewCatalog(keys, "")
+
+	chain, err := catalog.Chain("gt200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckChainApplicable(ctx, chain, destination); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chain, err = catalog.Chain("gt300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckChainApplicable(ctx, chain, destination); !errors.Is(err, ErrNeedsCloneSources) {
+		t.Fatalf("unexpected error: want %v, got %v", ErrNeedsCloneSources, err)
+	}
+}
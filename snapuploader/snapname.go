@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// gameTimeSuffix matches the "gt<gameTime>" suffix snaptaker requests
+// snapshots with.
+var gameTimeSuffix = regexp.MustCompile(`gt(\d+)$`)
+
+// SnapshotName is a snapshot name split into the parts the snapshotter
+// builds it from: a prefix formatted from the time the snapshot was taken
+// and the suffix requested by snaptaker.
+type SnapshotName struct {
+	Name        string
+	GameTime    int64
+	HasGameTime bool
+	Time        time.Time // Zero without a time layout or if the prefix did not parse
+}
+
+// ParseSnapshotName parses a snapshot name. layout is the Go time layout of
+// the snapshotter's SNAPSHOT_PREFIX without its directory, or empty if the
+// names carry no time.
+func ParseSnapshotName(name string, layout string) SnapshotName {
+	parsed := SnapshotName{Name: name}
+	prefix := name
+	if m := gameTimeSuffix.FindStringSubmatchIndex(name); m != nil {
+		if gameTime, err := strconv.ParseInt(name[m[2]:m[3]], 10, 64); err == nil {
+			parsed.GameTime, parsed.HasGameTime = gameTime, true
+			prefix = name[:m[0]]
+		}
+	}
+	if layout = filepath.Base(layout); layout != "." && prefix != "" {
+		if t, err := time.ParseInLocation(layout, prefix, time.Local); err == nil {
+			parsed.Time = t
+		}
+	}
+	return parsed
+}
+
+// Orderable reports whether the name has every part snapshots are ordered
+// by: the game time, and the time prefix if a layout is configured.
+func (n SnapshotName) Orderable(layout string) bool {
+	return n.HasGameTime && (layout == "" || !n.Time.IsZero())
+}
+
+// UnorderableSnapshots returns the names of snapshots that do not have
+// every part snapshots are ordered by.
+func UnorderableSnapshots(snapshots []SnapshotInfo, layout string) []string {
+	names := make([]string, len(snapshots))
+	for i := range snapshots {
+		names[i] = snapshots[i].Name
+	}
+	return unorderableNames(names, layout)
+}
+
+// unorderableNames returns the names that do not have every part snapshots
+// are ordered by.
+func unorderableNames(names []string, layout string) []string {
+	var unorderable []string
+	for _, name := range names {
+		if !ParseSnapshotName(name, layout).Orderable(layout) {
+			unorderable = append(unorderable, name)
+		}
+	}
+	return unorderable
+}
+
+// orderKey is what a snapshot is ordered by.
+type orderKey struct {
+	name    SnapshotName
+	created time.Time // Zero if unknown
+}
+
+// chronologicalOrder returns the indexes of keys in chronological order.
+// Names with a game time are ordered by their time prefix, if any of them
+// has one, then by the game time. Names without these parts cannot be
+// ordered among them and come first, so they are never taken for the
+// latest snapshot; among themselves they are ordered by creation time if
+// all of them have one. Ties are broken by name.
+func chronologicalOrder(keys []orderKey) []int {
+	useTime := false
+	for _, key := range keys {
+		useTime = useTime || !key.name.Time.IsZero()
+	}
+	orderable := func(key orderKey) bool {
+		return key.name.HasGameTime && (!useTime || !key.name.Time.IsZero())
+	}
+	useCreated := true
+	for _, key := range keys {
+		useCreated = useCreated && (orderable(key) || !key.created.IsZero())
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := keys[order[i]], keys[order[j]]
+		if orderable(a) != orderable(b) {
+			return !orderable(a)
+		}
+		switch {
+		case !orderable(a):
+			if useCreated && !a.created.Equal(b.created) {
+				return a.created.Before(b.created)
+			}
+		case useTime && !a.name.Time.Equal(b.name.Time):
+			return a.name.Time.Before(b.name.Time)
+		case a.name.GameTime != b.name.GameTime:
+			return a.name.GameTime < b.name.GameTime
+		}
+		return a.name.Name < b.name.Name
+	})
+	return order
+}
+
+// creationTime returns the birth time of path, or the zero time if the
+// file system does not record it. btrfs records it for subvolumes as their
+// otime.
+func creationTime(path string) time.Time {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil {
+		return time.Time{}
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+}
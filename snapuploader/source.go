@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// zstdMagic starts every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// OpenStreamSource opens a stored stream named by source, which is either
+// an s3:// URL, a local file or a key of the configured destinations. Keys
+// are read from the stream cache if it has them.
+func OpenStreamSource(ctx context.Context, source string) (io.ReadCloser, error) {
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, key, ok := strings.Cut(rest, "/")
+		if !ok || bucket == "" || key == "" {
+			return nil, fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", source)
+		}
+		cfg, err := LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+		// Use the credentials and endpoint of the primary destination
+		s3cfg := cfg.S3Config
+		s3cfg.S3Bucket = bucket
+		uploader, err := NewS3Uploader(bucket, &s3cfg)
+		if err != nil {
+			return nil, err
+		}
+		return uploader.Open(ctx, key)
+	}
+
+	if _, err := os.Stat(source); err == nil {
+		return os.Open(source)
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	destinations, err := NewDestinations(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return OpenStream(ctx, source, NewStreamCache(cfg), destinations)
+}
+
+// zstdReader reads the output of a zstd decompression process.
+type zstdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close stops reading and reports whether zstd failed.
+func (r *zstdReader) Close() error {
+	r.ReadCloser.Close()
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd decompression failed: %w", err)
+	}
+	return nil
+}
+
+// DecompressStream returns the uncompressed send stream of r. Streams are
+// stored zstd-compressed, but uncompressed ones are passed through.
+func DecompressStream(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return io.NopCloser(br), nil
+	}
+
+	cmd := exec.CommandContext(ctx, "zstd", "-dc")
+	cmd.Stdin = br
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd: %w", err)
+	}
+	return &zstdReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// OpenSendStream opens source and returns its uncompressed send stream.
+// Closing it closes the source as well.
+func OpenSendStream(ctx context.Context, source string) (io.ReadCloser, error) {
+	r, err := OpenStreamSource(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := DecompressStream(ctx, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &multiCloser{ReadCloser: stream, source: r}, nil
+}
+
+type multiCloser struct {
+	io.ReadCloser
+	source io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	// Close the source first so a decompressor still reading it stops
+	m.source.Close()
+	return m.ReadCloser.Close()
+}
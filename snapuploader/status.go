@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Snapshot states reported by the status command and the metrics endpoint.
+const (
+	StateDone        = "done"
+	StatePending     = "pending"
+	StateFailed      = "failed"
+	StateQuarantined = "quarantined"
+	StateDiscarded   = "discarded"
+)
+
+var allStates = []string{StateDone, StatePending, StateFailed, StateQuarantined, StateDiscarded}
+
+// SnapshotState returns the processing state of the snapshot.
+func SnapshotState(snapshot *SnapshotInfo, maxAttempts int) string {
+	switch {
+	case snapshot.HasDone:
+		return StateDone
+	case snapshot.Failure == nil:
+		return StatePending
+	case snapshot.Failure.Discarded:
+		return StateDiscarded
+	case snapshot.Failure.Quarantined(maxAttempts):
+		return StateQuarantined
+	default:
+		return StateFailed
+	}
+}
+
+// CountSnapshotStates returns the number of snapshots in each state.
+func CountSnapshotStates(snapshots []SnapshotInfo, maxAttempts int) map[string]int {
+	counts := make(map[string]int, len(allStates))
+	for _, state := range allStates {
+		counts[state] = 0
+	}
+	for i := range snapshots {
+		counts[SnapshotState(&snapshots[i], maxAttempts)]++
+	}
+	return counts
+}
+
+// WriteStatus prints a table of all snapshots in the watch directory.
+func WriteStatus(w io.Writer, snapshots []SnapshotInfo, maxAttempts int, destinations []string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tSTATE\tTYPE\tSIZE\tWORLD\tLAGGING\tINTEGRITY\tATTEMPTS\tLAST ERROR")
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		state := SnapshotState(snapshot, maxAttempts)
+		attempts, lastError := "-", ""
+		if snapshot.Failure != nil {
+			attempts = fmt.Sprintf("%d/%d", snapshot.Failure.Attempts, maxAttempts)
+			lastError = snapshot.Failure.LastError
+		}
+		backupType, size, world, lagging, integrity := "-", "-", "-", "-", "-"
+		if snapshot.HasDone {
+			backupType = snapshot.BackupType
+			size = fmt.Sprintf("%d", snapshot.Size)
+			if names := snapshot.Done.LaggingDestinations(destinations); len(names) > 0 {
+				lagging = strings.Join(names, ",")
+			}
+			if snapshot.Done != nil && snapshot.Done.Integrity != nil {
+				integrity = snapshot.Done.Integrity.Summary()
+			}
+			if snapshot.Done != nil && snapshot.Done.World != nil {
+				world = snapshot.Done.World.Summary()
+			}
+			if snapshot.Done != nil && snapshot.Done.Pin != nil {
+				backupType += " (pinned)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", snapshot.Name, state, backupType, size, world, lagging, integrity, attempts, lastError)
+	}
+	return tw.Flush()
+}
+
+// CountLaggingSnapshots returns the number of completed snapshots each
+// destination does not have yet.
+func CountLaggingSnapshots(snapshots []SnapshotInfo, destinations []string) map[string]int {
+	counts := make(map[string]int, len(destinations))
+	for _, name := range destinations {
+		counts[name] = 0
+	}
+	for i := range snapshots {
+		for _, name := range snapshots[i].Done.LaggingDestinations(destinations) {
+			counts[name]++
+		}
+	}
+	return counts
+}
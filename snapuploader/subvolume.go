@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// btrfsFirstFreeObjectID is the inode number of the root directory of every
+// btrfs subvolume.
+const btrfsFirstFreeObjectID = 256
+
+// ErrNotSubvolume is returned for directories that are not btrfs subvolumes.
+var ErrNotSubvolume = errors.New("not a btrfs subvolume")
+
+// SubvolumeInfo is the subset of "btrfs subvolume show" we rely on.
+type SubvolumeInfo struct {
+	UUID         string
+	ParentUUID   string
+	ReceivedUUID string
+	Generation   uint64
+	ReadOnly     bool
+}
+
+// IsSubvolume reports whether path is the root of a btrfs subvolume.
+func IsSubvolume(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if !fi.IsDir() {
+		return false, nil
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("unsupported stat result for %s", path)
+	}
+	return stat.Ino == btrfsFirstFreeObjectID, nil
+}
+
+// ShowSubvolume runs "btrfs subvolume show" on path and parses its output.
+func ShowSubvolume(path string) (*SubvolumeInfo, error) {
+	output, err := exec.Command("btrfs", "subvolume", "show", path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("btrfs subvolume show %s: %w: %s", path, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("btrfs subvolume show %s: %w", path, err)
+	}
+	return ParseSubvolumeShow(string(output))
+}
+
+// ParseSubvolumeShow parses the output of "btrfs subvolume show".
+func ParseSubvolumeShow(output string) (*SubvolumeInfo, error) {
+	info := &SubvolumeInfo{}
+	hasGeneration := false
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "-" {
+			value = ""
+		}
+		switch key {
+		case "UUID":
+			info.UUID = value
+		case "Parent UUID":
+			info.ParentUUID = value
+		case "Received UUID":
+			info.ReceivedUUID = value
+		case "Generation":
+			generation, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid generation %q: %w", value, err)
+			}
+			info.Generation = generation
+			hasGeneration = true
+		case "Flags":
+			for _, flag := range strings.Fields(value) {
+				if flag == "readonly" {
+					info.ReadOnly = true
+				}
+			}
+		}
+	}
+	if info.UUID == "" || !hasGeneration {
+		return nil, fmt.Errorf("unexpected btrfs subvolume show output")
+	}
+	return info, nil
+}
+
+// WaitForSnapshotReady waits until path is a read-only btrfs subvolume whose
+// generation did not change between two consecutive checks. It returns
+// ErrNotSubvolume when path is an ordinary directory.
+func WaitForSnapshotReady(ctx context.Context, path string, timeout time.Duration, interval time.Duration) error {
+	return waitForSnapshotReady(ctx, path, timeout, interval, IsSubvolume, ShowSubvolume)
+}
+
+// waitForSnapshotReady is WaitForSnapshotReady with the subvolume checks
+// passed in, so it can be tested without btrfs.
+func waitForSnapshotReady(ctx context.Context, path string, timeout time.Duration, interval time.Duration,
+	isSubvolumeFn func(string) (bool, error), showFn func(string) (*SubvolumeInfo, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastGeneration uint64
+	seen := false
+	for {
+		isSubvolume, err := isSubvolumeFn(path)
+		if err != nil {
+			return err
+		}
+		if !isSubvolume {
+			return ErrNotSubvolume
+		}
+
+		info, err := showFn(path)
+		if err != nil {
+			log.Printf("Snapshot %s not ready yet: %v", path, err)
+		} else if !info.ReadOnly {
+			log.Printf("Snapshot %s is not read-only yet", path)
+			seen = false
+		} else if seen && info.Generation == lastGeneration {
+			return nil
+		} else {
+			lastGeneration = info.Generation
+			seen = true
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("snapshot %s did not become ready within %s", path, timeout)
+			}
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ProbeSnapshotReady checks once whether path is ready the way
+// WaitForSnapshotReady waits for it, reading the generation twice, interval
+// apart. It returns an error if the snapshot is not ready yet.
+func ProbeSnapshotReady(ctx context.Context, path string, interval time.Duration) error {
+	return probeSnapshotReady(ctx, path, interval, IsSubvolume, ShowSubvolume)
+}
+
+// probeSnapshotReady is ProbeSnapshotReady with the subvolume checks passed
+// in, so it can be tested without btrfs.
+func probeSnapshotReady(ctx context.Context, path string, interval time.Duration,
+	isSubvolumeFn func(string) (bool, error), showFn func(string) (*SubvolumeInfo, error)) error {
+	var generation uint64
+	for check := 0; check < 2; check++ {
+		if check > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		isSubvolume, err := isSubvolumeFn(path)
+		if err != nil {
+			return err
+		}
+		if !isSubvolume {
+			return ErrNotSubvolume
+		}
+		info, err := showFn(path)
+		if err != nil {
+			return err
+		}
+		if !info.ReadOnly {
+			return fmt.Errorf("snapshot %s is not read-only yet", path)
+		}
+		if check > 0 && info.Generation != generation {
+			return fmt.Errorf("snapshot %s is still being written", path)
+		}
+		generation = info.Generation
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSubvolumeShow(t *testing.T) {
+	output := `snapshots/gt1200
+	Name: 			gt1200
+	UUID: 			8a1e4d6e-4a3b-9b4c-8c3d-2f1e0a9b8c7d
+	Parent UUID: 		d1b2c3a4-1111-2222-3333-444455556666
+	Received UUID: 		-
+	Creation time: 		2025-08-01 00:00:00 +0900
+	Subvolume ID: 		300
+	Generation: 		4711
+	Gen at creation: 	4711
+	Parent ID: 		5
+	Top level ID: 		5
+	Flags: 			readonly
+	Send transid: 		0
+	Send time: 		2025-08-01 00:00:00 +0900
+	Receive transid: 	0
+	Receive time: 		-
+	Snapshot(s):
+`
+	info, err := ParseSubvolumeShow(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.UUID != "8a1e4d6e-4a3b-9b4c-8c3d-2f1e0a9b8c7d" {
+		t.Fatalf("unexpected UUID: %q", info.UUID)
+	}
+	if info.ParentUUID != "d1b2c3a4-1111-2222-3333-444455556666" {
+		t.Fatalf("unexpected parent UUID: %q", info.ParentUUID)
+	}
+	if info.ReceivedUUID != "" {
+		t.Fatalf("expected empty received UUID, got %q", info.ReceivedUUID)
+	}
+	if info.Generation != 4711 {
+		t.Fatalf("unexpected generation: %d", info.Generation)
+	}
+	if !info.ReadOnly {
+		t.Fatalf("expected read-only flag")
+	}
+}
+
+func TestParseSubvolumeShow_Writable(t *testing.T) {
+	output := "rw\n\tUUID: \t\tabc\n\tGeneration: \t\t12\n\tFlags: \t\t\t-\n"
+	info, err := ParseSubvolumeShow(output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.ReadOnly {
+		t.Fatalf("expected writable subvolume")
+	}
+}
+
+func TestParseSubvolumeShow_Invalid(t *testing.T) {
+	if _, err := ParseSubvolumeShow("ERROR: not a subvolume\n"); err == nil {
+		t.Fatalf("expected error for unexpected output")
+	}
+}
+
+func TestWaitForSnapshotReady(t *testing.T) {
+	isSubvolume := func(string) (bool, error) { return true, nil }
+	// Read-only only from the second check, then the generation settles
+	states := []SubvolumeInfo{
+		{UUID: "u", Generation: 10},
+		{UUID: "u", Generation: 11, ReadOnly: true},
+		{UUID: "u", Generation: 12, ReadOnly: true},
+		{UUID: "u", Generation: 12, ReadOnly: true},
+	}
+	checks := 0
+	show := func(string) (*SubvolumeInfo, error) {
+		info := states[min(checks, len(states)-1)]
+		checks++
+		return &info, nil
+	}
+	if err := waitForSnapshotReady(context.Background(), "gt100", time.Second, time.Millisecond, isSubvolume, show); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checks != len(states) {
+		t.Fatalf("unexpected number of checks: want %d, got %d", len(states), checks)
+	}
+
+	writable := func(string) (*SubvolumeInfo, error) { return &SubvolumeInfo{UUID: "u", Generation: 10}, nil }
+	err := waitForSnapshotReady(context.Background(), "gt100", 20*time.Millisecond, time.Millisecond, isSubvolume, writable)
+	if err == nil || !strings.Contains(err.Error(), "did not become ready") {
+		t.Fatalf("expected a writable snapshot to time out, got %v", err)
+	}
+
+	notSubvolume := func(string) (bool, error) { return false, nil }
+	if err := waitForSnapshotReady(context.Background(), "gt100", time.Second, time.Millisecond, notSubvolume, writable); !errors.Is(err, ErrNotSubvolume) {
+		t.Fatalf("unexpected error: want %v, got %v", ErrNotSubvolume, err)
+	}
+}
+
+func TestProbeSnapshotReady(t *testing.T) {
+	isSubvolume := func(string) (bool, error) { return true, nil }
+	sequence := func(states ...SubvolumeInfo) func(string) (*SubvolumeInfo, error) {
+		checks := 0
+		return func(string) (*SubvolumeInfo, error) {
+			info := states[min(checks, len(states)-1)]
+			checks++
+			return &info, nil
+		}
+	}
+	ctx := context.Background()
+
+	if err := probeSnapshotReady(ctx, "gt100", time.Millisecond, isSubvolume, sequence(SubvolumeInfo{Generation: 12, ReadOnly: true})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A single probe does not wait for the snapshot to settle
+	if err := probeSnapshotReady(ctx, "gt100", time.Millisecond, isSubvolume, sequence(SubvolumeInfo{Generation: 10})); err == nil {
+		t.Fatalf("expected a writable snapshot not to be ready")
+	}
+	changing := sequence(SubvolumeInfo{Generation: 11, ReadOnly: true}, SubvolumeInfo{Generation: 12, ReadOnly: true})
+	if err := probeSnapshotReady(ctx, "gt100", time.Millisecond, isSubvolume, changing); err == nil {
+		t.Fatalf("expected a snapshot that is still written not to be ready")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := probeSnapshotReady(cancelled, "gt100", time.Hour, isSubvolume, sequence(SubvolumeInfo{Generation: 12, ReadOnly: true})); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/rinsuki-lab/mc1218c/sendstream"
 )
 
 type CountingReader struct {
@@ -24,41 +27,95 @@ func (cr *CountingReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// readyPollInterval is how often a new snapshot is checked for readiness.
+const readyPollInterval = time.Second
+
+// watchCheckInterval is how often the watch directory is checked for being
+// removed, replaced or re-mounted.
+const watchCheckInterval = 10 * time.Second
+
+// fileID identifies a directory independently of its path.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func fileIDOf(fi os.FileInfo) fileID {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fileID{dev: uint64(stat.Dev), ino: stat.Ino}
+	}
+	return fileID{}
+}
+
 type DirectoryWatcher struct {
-	watchDir string
-	watcher  *fsnotify.Watcher
-	config   *Config
-	uploader *S3Uploader
+	watchDir     string
+	watcher      *fsnotify.Watcher
+	config       *Config
+	destinations []Destination
+	cache        *StreamCache
+
+	// watching is false while the watch directory is missing
+	watching  bool
+	watchedID fileID
+
+	// unorderable holds snapshot names already reported as unparseable
+	unorderable map[string]bool
+	// clearing holds .failed markers the watcher removed itself, whose
+	// removal events are not retries
+	clearing map[string]bool
 }
 
-func NewDirectoryWatcher(cfg *Config, uploader *S3Uploader) (*DirectoryWatcher, error) {
+func NewDirectoryWatcher(cfg *Config, destinations []Destination) (*DirectoryWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
 	}
 
 	return &DirectoryWatcher{
-		watchDir: cfg.WatchDir,
-		watcher:  watcher,
-		config:   cfg,
-		uploader: uploader,
+		watchDir:     cfg.WatchDir,
+		watcher:      watcher,
+		config:       cfg,
+		destinations: destinations,
+		cache:        NewStreamCache(cfg),
+		unorderable:  make(map[string]bool),
+		clearing:     make(map[string]bool),
 	}, nil
 }
 
-func (dw *DirectoryWatcher) Start(ctx context.Context) error {
+// Start watches for new snapshots until ctx is canceled. Snapshots are
+// processed with workCtx, which is canceled separately so that an upload in
+// progress when ctx is canceled can still finish within a grace period.
+func (dw *DirectoryWatcher) Start(ctx context.Context, workCtx context.Context) error {
 	// Add the watch directory
-	if err := dw.watcher.Add(dw.watchDir); err != nil {
-		return fmt.Errorf("failed to add watch directory: %w", err)
+	if err := dw.addWatch(); err != nil {
+		return err
 	}
 
 	log.Printf("Started watching directory: %s", dw.watchDir)
 
+	// Clean up after uploads interrupted by a previous shutdown or crash
+	if err := RecoverInterruptedUploads(workCtx, dw.watchDir, dw.uploadTargets()); err != nil {
+		return err
+	}
+
 	// Process existing snapshots on startup
-	if err := dw.processExistingSnapshots(ctx); err != nil {
+	if err := dw.processExistingSnapshots(ctx, workCtx); err != nil {
 		// Propagate error so main can handle fatal exit
 		return err
 	}
 
+	// Periodic rescan in case an event was dropped
+	var rescan <-chan time.Time
+	if dw.config.RescanInterval > 0 {
+		ticker := time.NewTicker(time.Duration(dw.config.RescanInterval))
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+
+	// Periodic check that the watch still refers to the watch directory
+	watchCheck := time.NewTicker(watchCheckInterval)
+	defer watchCheck.Stop()
+
 	// Start watching for new events
 	for {
 		select {
@@ -68,17 +125,105 @@ func (dw *DirectoryWatcher) Start(ctx context.Context) error {
 			if !ok {
 				return fmt.Errorf("watcher events channel closed")
 			}
-			dw.handleEvent(ctx, event)
+			dw.handleEvent(ctx, workCtx, event)
 		case err, ok := <-dw.watcher.Errors:
 			if !ok {
 				return fmt.Errorf("watcher errors channel closed")
 			}
 			log.Printf("Watcher error: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost, find out what we missed
+				dw.processPending(ctx, workCtx, "event queue overflow")
+			}
+		case <-rescan:
+			dw.processPending(ctx, workCtx, "periodic rescan")
+		case <-watchCheck.C:
+			if dw.checkWatch() {
+				dw.processPending(ctx, workCtx, "watch re-established")
+			}
+		}
+	}
+}
+
+// addWatch adds the watch directory to the fsnotify watcher and remembers
+// which directory it refers to.
+func (dw *DirectoryWatcher) addWatch() error {
+	fi, err := os.Stat(dw.watchDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat watch directory: %w", err)
+	}
+	if err := dw.watcher.Add(dw.watchDir); err != nil {
+		return fmt.Errorf("failed to add watch directory: %w", err)
+	}
+	dw.watching = true
+	dw.watchedID = fileIDOf(fi)
+	return nil
+}
+
+// checkWatch re-establishes the watch when the watch directory was removed
+// and re-created or re-mounted. It returns true when the watch was
+// re-established.
+func (dw *DirectoryWatcher) checkWatch() bool {
+	fi, err := os.Stat(dw.watchDir)
+	if err != nil {
+		if dw.watching {
+			log.Printf("Watch directory is gone: %v", err)
+			dw.watching = false
+		}
+		return false
+	}
+	if dw.watching && fileIDOf(fi) == dw.watchedID {
+		return false
+	}
+
+	if dw.watching {
+		log.Printf("Watch directory %s was replaced or re-mounted", dw.watchDir)
+		// The old watch may already be gone with the old directory
+		dw.watcher.Remove(dw.watchDir)
+	}
+	if err := dw.addWatch(); err != nil {
+		log.Printf("Failed to re-establish watch: %v", err)
+		dw.watching = false
+		return false
+	}
+	log.Printf("Re-established watch on %s", dw.watchDir)
+	return true
+}
+
+// processPending processes all pending snapshots, exiting on S3 errors.
+func (dw *DirectoryWatcher) processPending(ctx context.Context, workCtx context.Context, reason string) {
+	if err := dw.processExistingSnapshots(ctx, workCtx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
 		}
+		if errors.Is(err, ErrS3Upload) {
+			log.Printf("S3 error detected while processing snapshots; exiting: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Error processing pending snapshots (%s): %v", reason, err)
 	}
 }
 
-func (dw *DirectoryWatcher) handleEvent(ctx context.Context, event fsnotify.Event) {
+func (dw *DirectoryWatcher) handleEvent(ctx context.Context, workCtx context.Context, event fsnotify.Event) {
+	// The watch directory itself went away, its watch is gone with it
+	if event.Name == dw.watchDir && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		log.Printf("Watch directory %s was removed; waiting for it to reappear", dw.watchDir)
+		dw.watching = false
+		return
+	}
+
+	// An operator cleared a .failed marker ("snapuploader retry"), pick the
+	// snapshot up again without waiting for the next snapshot
+	if event.Op&fsnotify.Remove == fsnotify.Remove && strings.HasSuffix(event.Name, ".failed") {
+		if name := filepath.Clean(event.Name); dw.clearing[name] {
+			delete(dw.clearing, name)
+			return
+		}
+		log.Printf("Failure marker removed: %s", event.Name)
+		dw.processPending(ctx, workCtx, "retry of "+event.Name)
+		return
+	}
+
 	// We're interested in new directories being created
 	if event.Op&fsnotify.Create == fsnotify.Create {
 		// Check if it's a directory
@@ -93,44 +238,95 @@ func (dw *DirectoryWatcher) handleEvent(ctx context.Context, event fsnotify.Even
 			return
 		}
 
-		// Wait a bit for the snapshot to be fully created
-		time.Sleep(5 * time.Second)
+		// Wait for the snapshot to be fully created
+		if err := WaitForSnapshotReady(ctx, event.Name, time.Duration(dw.config.ReadyTimeout), readyPollInterval); err != nil {
+			if errors.Is(err, ErrNotSubvolume) {
+				log.Printf("Ignoring %s: %v", event.Name, err)
+				return
+			}
+			log.Printf("Snapshot %s is not ready: %v", event.Name, err)
+			return
+		}
 
 		// Instead of only uploading the created snapshot, process all
 		// snapshots that are not yet uploaded (.done missing)
-		if err := dw.processExistingSnapshots(ctx); err != nil {
-			if errors.Is(err, ErrS3Upload) {
-				log.Printf("S3 error detected while processing snapshots; exiting: %v", err)
-				os.Exit(1)
-			}
-			log.Printf("Error processing pending snapshots after new event %s: %v", event.Name, err)
-		}
+		dw.processPending(ctx, workCtx, "new event "+event.Name)
 	}
 }
 
-func (dw *DirectoryWatcher) processExistingSnapshots(ctx context.Context) error {
-	snapshots, err := FindSnapshots(dw.watchDir)
+func (dw *DirectoryWatcher) processExistingSnapshots(ctx context.Context, workCtx context.Context) error {
+	snapshots, err := FindSnapshots(dw.watchDir, dw.config.SnapshotTimeLayout)
 	if err != nil {
 		return fmt.Errorf("failed to find snapshots: %w", err)
 	}
+	for _, name := range UnorderableSnapshots(snapshots, dw.config.SnapshotTimeLayout) {
+		if !dw.unorderable[name] {
+			dw.unorderable[name] = true
+			log.Printf("Warning: cannot tell the time of snapshot %s from its name, it is ordered before the other snapshots", name)
+		}
+	}
 
 	for _, snapshot := range snapshots {
+		// Do not start new work once shutdown has begun
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if !snapshot.HasDone {
+			if snapshot.Failure.Quarantined(dw.config.MaxAttempts) {
+				log.Printf("Skipping quarantined snapshot: %s (attempts: %d, discarded: %v, last error: %s)",
+					snapshot.Name, snapshot.Failure.Attempts, snapshot.Failure.Discarded, snapshot.Failure.LastError)
+				continue
+			}
+			// A snapshot that is still being created is not its own fault,
+			// a later rescan or event picks it up. Probe it once rather
+			// than wait, so one stuck subvolume does not stall every rescan.
+			if err := ProbeSnapshotReady(ctx, snapshot.Path, readyPollInterval); err != nil {
+				if errors.Is(err, ErrNotSubvolume) {
+					log.Printf("Ignoring %s: %v", snapshot.Name, err)
+				} else if ctx.Err() != nil {
+					return ctx.Err()
+				} else {
+					log.Printf("Skipping snapshot %s for now, it is not ready: %v", snapshot.Name, err)
+				}
+				continue
+			}
 			log.Printf("Found unprocessed snapshot: %s", snapshot.Name)
-			if err := dw.processSnapshot(ctx, snapshot.Path); err != nil {
+			if err := dw.processSnapshot(workCtx, snapshot.Path); err != nil {
+				if workCtx.Err() != nil {
+					// Aborted by shutdown, not the snapshot's fault
+					log.Printf("Aborted processing of snapshot %s: %v", snapshot.Name, err)
+					return workCtx.Err()
+				}
 				// Exit on S3-specific errors
 				if errors.Is(err, ErrS3Upload) {
 					return err
 				}
 				log.Printf("Error processing snapshot %s: %v", snapshot.Name, err)
+				metrics.failuresTotal.Add(1)
+				record, ferr := RecordFailure(snapshot.Path, err)
+				if ferr != nil {
+					log.Printf("Failed to record failure of snapshot %s: %v", snapshot.Name, ferr)
+				} else if record.Quarantined(dw.config.MaxAttempts) {
+					log.Printf("Snapshot %s failed %d times and is now quarantined; run \"snapuploader retry %s\" or \"snapuploader discard %s\"",
+						snapshot.Name, record.Attempts, snapshot.Name, snapshot.Name)
+				}
 			}
 		}
 	}
 
+	// Copy streams to destinations that missed them
+	if ctx.Err() == nil {
+		snapshots, err := FindSnapshots(dw.watchDir, dw.config.SnapshotTimeLayout)
+		if err != nil {
+			return fmt.Errorf("failed to find snapshots: %w", err)
+		}
+		CatchUpDestinations(workCtx, snapshots, dw.destinations)
+	}
+
 	return nil
 }
 
-func (dw *DirectoryWatcher) processSnapshot(ctx context.Context, snapshotPath string) error {
+func (dw *DirectoryWatcher) processSnapshot(ctx context.Context, snapshotPath string) (err error) {
 	log.Printf("Processing snapshot: %s", snapshotPath)
 
 	// Check if already processed
@@ -141,33 +337,114 @@ func (dw *DirectoryWatcher) processSnapshot(ctx context.Context, snapshotPath st
 	}
 
 	// Find all snapshots
-	snapshots, err := FindSnapshots(dw.watchDir)
+	snapshots, err := FindSnapshots(dw.watchDir, dw.config.SnapshotTimeLayout)
 	if err != nil {
 		return fmt.Errorf("failed to find snapshots: %w", err)
 	}
 
 	// Decide upload plan (S3 key, full/incremental, parent)
-	key, parentPath, derr := DecideUpload(snapshotPath, snapshots, dw.config.SnapshotPrefix)
+	key, parentPath, derr := DecideUpload(snapshotPath, snapshots, dw.config.SnapshotPrefix, dw.config.Policy)
 	if derr != nil {
 		return derr
 	}
+
+	// btrfs send -p needs the parent to be the read-only snapshot that was
+	// uploaded. Start a new chain rather than upload a stream nobody can apply.
+	current, err := ShowSubvolume(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to inspect snapshot: %w", err)
+	}
+	if parentPath != nil {
+		if perr := dw.parentProblem(current, *parentPath, snapshots); perr != nil {
+			log.Printf("Cannot use %s as parent, falling back to a FULL backup: %v", filepath.Base(*parentPath), perr)
+			key, parentPath = FullBackupKey(snapshotPath, dw.config.SnapshotPrefix), nil
+		}
+	}
+	// Do not lengthen the chain with a stream that changes next to nothing
+	if parentPath != nil && dw.config.Policy.SkipEmptyBelow > 0 {
+		size, merr := MeasureIncremental(ctx, snapshotPath, *parentPath)
+		if merr != nil {
+			log.Printf("Warning: failed to measure incremental, uploading it: %v", merr)
+		} else if size.NearEmpty(dw.config.Policy.SkipEmptyBelow) {
+			log.Printf("Skipping near-empty incremental (%d bytes in %d files), recording it as alias of %s", size.Bytes, size.Files, filepath.Base(*parentPath))
+			done := &DoneFileContent{
+				Type:          BackupTypeAlias,
+				AliasOf:       filepath.Base(*parentPath),
+				SubvolumeUUID: current.UUID,
+				World:         readSnapshotWorld(snapshotPath, dw.config.LevelDat),
+			}
+			dw.recordAlias(ctx, filepath.Base(snapshotPath), *parentPath, snapshots)
+			if err := WriteDoneFile(snapshotPath, done); err != nil {
+				return fmt.Errorf("failed to create .done file: %w", err)
+			}
+			dw.clearFailure(snapshotPath)
+			return nil
+		}
+	}
+
 	if parentPath == nil {
 		log.Printf("Creating FULL backup (no parent)")
 	} else {
 		log.Printf("Creating INCREMENTAL backup with parent: %s", filepath.Base(*parentPath))
 	}
 
+	// Check region files before they end up in every later incremental
+	var parent *SnapshotInfo
+	for i := range snapshots {
+		if parentPath != nil && snapshots[i].Path == *parentPath {
+			parent = &snapshots[i]
+		}
+	}
+	integrity, err := checkIntegrity(dw.config.IntegrityCheck, snapshotPath, parent)
+	if err != nil {
+		return err
+	}
+
+	// Annotate the backup with the state of the world
+	world := readSnapshotWorld(snapshotPath, dw.config.LevelDat)
+	var metadata map[string]string
+	if world != nil {
+		metadata = world.S3Metadata()
+	}
+
+	// Remember the upload until it is settled, so an interrupted one can be
+	// cleaned up on the next start
+	stagingKey := StagingKey(key)
+	if err := CreateInProgressFile(snapshotPath, stagingKey); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Never leave a partial stream behind on a destination
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+			defer cancel()
+			for _, destination := range dw.uploadTargets() {
+				if derr := destination.DiscardStaged(cleanupCtx, stagingKey); derr != nil {
+					log.Printf("Warning: failed to clean up incomplete upload on %s: %v", destination.Name(), derr)
+				}
+			}
+		}
+		RemoveInProgressFile(snapshotPath)
+	}()
+
 	// Create btrfs send stream
-	btrfsCmd, btrfsOutput, err := CreateBtrfsSendDiff(snapshotPath, parentPath)
+	format := NewStreamFormat(dw.config.Send, snapshots, parentPath)
+	btrfsCmd, btrfsOutput, err := CreateBtrfsSendDiff(ctx, snapshotPath, parentPath, format)
 	if err != nil {
 		return fmt.Errorf("failed to create btrfs send: %w", err)
 	}
 	defer btrfsOutput.Close()
 
+	// Verify the stream on its way to the compressor
+	changes := sendstream.NewChangeIndex()
+	validator := sendstream.NewValidatingReader(btrfsOutput, changes.Add)
+	defer validator.Close()
+
 	// Compress with zstd
-	zstdCmd, zstdOutput, err := CompressWithZstd(btrfsOutput)
+	zstdCmd, zstdOutput, err := CompressWithZstd(ctx, validator, dw.config.ZstdLevel, dw.config.ZstdThreads)
 	if err != nil {
 		btrfsCmd.Process.Kill()
+		btrfsCmd.Wait()
 		return fmt.Errorf("failed to start zstd compression: %w", err)
 	}
 	defer zstdOutput.Close()
@@ -175,40 +452,190 @@ func (dw *DirectoryWatcher) processSnapshot(ctx context.Context, snapshotPath st
 	// Wrap with counting reader to measure size
 	countingReader := &CountingReader{reader: zstdOutput}
 
-	// Upload to S3
-	if err := dw.uploader.UploadStream(ctx, key, countingReader); err != nil {
+	// Upload to a staging key first. The stream is only known to be complete
+	// once both processes exited cleanly, so nothing must appear under the
+	// final key before that. The stream is teed to every destination and
+	// the stream cache, which comes last.
+	uploadErrs := UploadToAll(ctx, dw.uploadTargets(), stagingKey, countingReader, metadata)
+	var cacheErr error
+	if dw.cache != nil {
+		cacheErr = uploadErrs[len(dw.destinations)]
+		uploadErrs = uploadErrs[:len(dw.destinations)]
+	}
+	if succeeded := countSucceeded(uploadErrs); succeeded == 0 {
 		btrfsCmd.Process.Kill()
 		zstdCmd.Process.Kill()
-		return fmt.Errorf("failed to upload to S3: %w", err)
+		btrfsCmd.Wait()
+		zstdCmd.Wait()
+		if ctx.Err() != nil {
+			return fmt.Errorf("upload aborted: %w", ctx.Err())
+		}
+		return fmt.Errorf("failed to upload to any destination: %w", errors.Join(uploadErrs...))
 	}
 
 	// Wait for commands to finish
-	if err := btrfsCmd.Wait(); err != nil {
-		return fmt.Errorf("btrfs send failed: %w", err)
+	btrfsErr := btrfsCmd.Wait()
+	zstdErr := zstdCmd.Wait()
+	if btrfsErr != nil || zstdErr != nil {
+		if btrfsErr != nil {
+			return fmt.Errorf("btrfs send failed: %w", btrfsErr)
+		}
+		return fmt.Errorf("zstd compression failed: %w", zstdErr)
 	}
-	
-	if err := zstdCmd.Wait(); err != nil {
-		return fmt.Errorf("zstd compression failed: %w", err)
+
+	// Never let a truncated or garbled stream into a chain
+	if err := validator.Result(); err != nil {
+		return fmt.Errorf("btrfs send produced an invalid stream: %w", err)
 	}
 
 	// Get the size that was uploaded
 	uploadedSize := countingReader.count
 
-	// Create .done file with backup type and size
+	// Create .done file with backup type, size and per-destination state
 	bt := "full"
 	if parentPath != nil {
 		bt = "incremental"
 	}
-	if err := CreateDoneFile(snapshotPath, bt, uploadedSize); err != nil {
+	done := &DoneFileContent{Type: bt, Size: uploadedSize, Key: key, Integrity: integrity, World: world, SubvolumeUUID: current.UUID, Format: format}
+	for i, destination := range dw.destinations {
+		if uploadErrs[i] == nil {
+			if perr := destination.Promote(ctx, stagingKey, key); perr != nil {
+				uploadErrs[i] = perr
+				if derr := destination.DiscardStaged(context.Background(), stagingKey); derr != nil {
+					log.Printf("Warning: failed to clean up staged upload on %s: %v", destination.Name(), derr)
+				}
+			}
+		}
+		if uploadErrs[i] != nil {
+			log.Printf("Upload to %s failed, it will be caught up later: %v", destination.Name(), uploadErrs[i])
+		}
+		done.SetDestinationResult(destination.Name(), uploadErrs[i])
+	}
+	if countSucceeded(uploadErrs) == 0 {
+		if ctx.Err() != nil {
+			return fmt.Errorf("upload aborted: %w", ctx.Err())
+		}
+		return fmt.Errorf("failed to promote on any destination: %w", errors.Join(uploadErrs...))
+	}
+
+	// Publish what changed and the chain manifest next to the stream
+	link := ManifestLink{
+		Snapshot:   filepath.Base(snapshotPath),
+		Type:       bt,
+		Key:        key,
+		Size:       uploadedSize,
+		Index:      IndexKey(key),
+		UploadedAt: time.Now(),
+		World:      world,
+		Format:     format,
+	}
+	if parentPath != nil {
+		link.Parent = filepath.Base(*parentPath)
+	}
+	index, ierr := EncodeIndex(&ChangedFilesIndex{Snapshot: link.Snapshot, Changes: changes.Changes()})
+	if ierr != nil {
+		log.Printf("Warning: %v", ierr)
+	}
+	for i, destination := range dw.destinations {
+		if uploadErrs[i] != nil {
+			continue
+		}
+		if perr := PublishStreamExtras(ctx, destination, link, index); perr != nil {
+			log.Printf("Warning: failed to publish index of %s on %s: %v", link.Snapshot, destination.Name(), perr)
+		}
+	}
+
+	if err := WriteDoneFile(snapshotPath, done); err != nil {
 		return fmt.Errorf("failed to create .done file: %w", err)
 	}
+	if dw.cache != nil {
+		dw.cacheStream(stagingKey, key, cacheErr)
+	}
+	dw.clearFailure(snapshotPath)
+	metrics.uploadsTotal.Add(1)
+	metrics.uploadedBytesTotal.Add(uploadedSize)
 
 	snapshotName := filepath.Base(snapshotPath)
-	log.Printf("Successfully processed snapshot: %s -> %s (type: %s, size: %d bytes)", 
+	log.Printf("Successfully processed snapshot: %s -> %s (type: %s, size: %d bytes)",
 		snapshotName, key, bt, uploadedSize)
 	return nil
 }
 
+// clearFailure removes the .failed marker of a snapshot that was processed
+// after all, remembering it so its removal event does not trigger a rescan.
+func (dw *DirectoryWatcher) clearFailure(snapshotPath string) {
+	path := failedFilePath(snapshotPath)
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return
+	}
+	if err := ClearFailure(snapshotPath); err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	dw.clearing[filepath.Clean(path)] = true
+}
+
+// recordAlias records in the manifest of the parent's chain that snapshot
+// is an alias of it, so it can be restored by name. Like the rest of the
+// manifest, it only helps browsing backups.
+func (dw *DirectoryWatcher) recordAlias(ctx context.Context, snapshot string, parentPath string, snapshots []SnapshotInfo) {
+	var parentKey string
+	for _, s := range snapshots {
+		if s.Path == parentPath && s.Done != nil {
+			parentKey = s.Done.Key
+		}
+	}
+	if parentKey == "" {
+		log.Printf("Warning: cannot record alias %s, the key of %s is unknown", snapshot, filepath.Base(parentPath))
+		return
+	}
+	for _, destination := range dw.destinations {
+		if err := RecordAlias(ctx, destination, parentKey, snapshot, filepath.Base(parentPath)); err != nil {
+			log.Printf("Warning: failed to record alias %s on %s: %v", snapshot, destination.Name(), err)
+		}
+	}
+}
+
+// uploadTargets returns the destinations followed by the stream cache, if
+// enabled.
+func (dw *DirectoryWatcher) uploadTargets() []Destination {
+	if dw.cache == nil {
+		return dw.destinations
+	}
+	targets := make([]Destination, 0, len(dw.destinations)+1)
+	targets = append(targets, dw.destinations...)
+	return append(targets, dw.cache)
+}
+
+// cacheStream settles the cached copy of a completed upload. A failure only
+// means restores of this snapshot have to download it.
+func (dw *DirectoryWatcher) cacheStream(stagingKey string, key string, uploadErr error) {
+	ctx := context.Background()
+	err := uploadErr
+	if err == nil {
+		err = dw.cache.Promote(ctx, stagingKey, key)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to cache %s: %v", key, err)
+		if derr := dw.cache.DiscardStaged(ctx, stagingKey); derr != nil {
+			log.Printf("Warning: failed to clean up cache: %v", derr)
+		}
+	}
+	if err := dw.cache.Evict(); err != nil {
+		log.Printf("Warning: failed to evict from the stream cache: %v", err)
+	}
+}
+
+func countSucceeded(errs []error) int {
+	n := 0
+	for _, err := range errs {
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
 func (dw *DirectoryWatcher) Close() error {
 	return dw.watcher.Close()
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rinsuki-lab/mc1218c/nbt"
+)
+
+// ticksPerDay is the length of a Minecraft day.
+const ticksPerDay = 24000
+
+// levelDatCandidates are the paths below a snapshot searched for level.dat
+// when none is configured.
+var levelDatCandidates = []string{
+	"worlds/world/level.dat",
+	"world/level.dat",
+	"level.dat",
+}
+
+// difficultyNames are the names of the Difficulty values of level.dat.
+var difficultyNames = []string{"peaceful", "easy", "normal", "hard"}
+
+// WorldInfo is the state of the world a snapshot was taken of, read from
+// its level.dat.
+type WorldInfo struct {
+	LevelName   string    `json:"levelName,omitempty"`
+	Version     string    `json:"version,omitempty"` // Minecraft version, like "1.21.10"
+	DataVersion int64     `json:"dataVersion,omitempty"`
+	GameTime    int64     `json:"gameTime"` // Ticks the world has run
+	DayTime     int64     `json:"dayTime"`  // Ticks of the day cycle, including skipped nights
+	Weather     string    `json:"weather"`  // "clear", "rain" or "thunder"
+	Difficulty  string    `json:"difficulty,omitempty"`
+	Hardcore    bool      `json:"hardcore,omitempty"`
+	LastPlayed  time.Time `json:"lastPlayed"`
+}
+
+// Day returns the in-game day, as shown on the debug screen.
+func (w *WorldInfo) Day() int64 {
+	return w.DayTime / ticksPerDay
+}
+
+// TimeOfDay returns the in-game time of day as "HH:MM". A day starts at
+// 06:00.
+func (w *WorldInfo) TimeOfDay() string {
+	ticks := w.DayTime % ticksPerDay
+	hour := (ticks/1000 + 6) % 24
+	minute := ticks % 1000 * 60 / 1000
+	return fmt.Sprintf("%02d:%02d", hour, minute)
+}
+
+// Summary describes the world in a few words, like "Day 812, Minecraft
+// 1.21.10".
+func (w *WorldInfo) Summary() string {
+	if w.Version == "" {
+		return fmt.Sprintf("Day %d", w.Day())
+	}
+	return fmt.Sprintf("Day %d, Minecraft %s", w.Day(), w.Version)
+}
+
+// S3Metadata returns the user metadata stored with the stream. The level
+// name is left out, as metadata values must be ASCII.
+func (w *WorldInfo) S3Metadata() map[string]string {
+	metadata := map[string]string{
+		"game-time":   strconv.FormatInt(w.GameTime, 10),
+		"day":         strconv.FormatInt(w.Day(), 10),
+		"time-of-day": w.TimeOfDay(),
+		"weather":     w.Weather,
+		"last-played": w.LastPlayed.UTC().Format(time.RFC3339),
+	}
+	if w.Version != "" {
+		metadata["minecraft-version"] = w.Version
+	}
+	if w.Difficulty != "" {
+		metadata["difficulty"] = w.Difficulty
+	}
+	return metadata
+}
+
+// ReadWorldInfo reads the world state from a level.dat file.
+func ReadWorldInfo(path string) (*WorldInfo, error) {
+	root, err := nbt.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := root.Compound("Data")
+	if !ok {
+		return nil, fmt.Errorf("%s has no Data compound", path)
+	}
+
+	info := &WorldInfo{Weather: "clear"}
+	info.LevelName, _ = data.String("LevelName")
+	info.DataVersion, _ = data.Int("DataVersion")
+	info.GameTime, _ = data.Int("Time")
+	info.DayTime, _ = data.Int("DayTime")
+	if version, ok := data.Compound("Version"); ok {
+		info.Version, _ = version.String("Name")
+	}
+	if thundering, _ := data.Bool("thundering"); thundering {
+		info.Weather = "thunder"
+	} else if raining, _ := data.Bool("raining"); raining {
+		info.Weather = "rain"
+	}
+	if difficulty, ok := data.Int("Difficulty"); ok && difficulty >= 0 && int(difficulty) < len(difficultyNames) {
+		info.Difficulty = difficultyNames[difficulty]
+	}
+	info.Hardcore, _ = data.Bool("hardcore")
+	if lastPlayed, ok := data.Int("LastPlayed"); ok {
+		info.LastPlayed = time.UnixMilli(lastPlayed)
+	}
+	return info, nil
+}
+
+// FindLevelDat returns the path of level.dat in a snapshot: configured, if
+// set, or the first of levelDatCandidates that exists.
+func FindLevelDat(snapshotPath string, configured string) (string, error) {
+	if configured != "" {
+		return filepath.Join(snapshotPath, configured), nil
+	}
+	for _, candidate := range levelDatCandidates {
+		p := filepath.Join(snapshotPath, candidate)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no level.dat found in %s", snapshotPath)
+}
+
+// readSnapshotWorld reads the world state of a snapshot. It is only used to
+// annotate the backup, so failures are logged and nil is returned.
+func readSnapshotWorld(snapshotPath string, configured string) *WorldInfo {
+	path, err := FindLevelDat(snapshotPath, configured)
+	if err == nil {
+		var info *WorldInfo
+		if info, err = ReadWorldInfo(path); err == nil {
+			log.Printf("World state: %s, %s, %s", info.Summary(), info.TimeOfDay(), info.Weather)
+			return info
+		}
+	}
+	log.Printf("Warning: failed to read world state: %v", err)
+	return nil
+}
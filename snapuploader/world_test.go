@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rinsuki-lab/mc1218c/nbt"
+)
+
+// nbtBuilder writes NBT data for tests.
+type nbtBuilder struct{ bytes.Buffer }
+
+func (b *nbtBuilder) tag(tagType byte, name string) *nbtBuilder {
+	b.WriteByte(tagType)
+	return b.str(name)
+}
+
+func (b *nbtBuilder) str(s string) *nbtBuilder {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+func (b *nbtBuilder) be(v any) *nbtBuilder {
+	binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+// end closes a compound.
+func (b *nbtBuilder) end() *nbtBuilder {
+	b.WriteByte(nbt.TagEnd)
+	return b
+}
+
+// writeLevelDat writes a gzip compressed level.dat with the fields read by
+// ReadWorldInfo.
+func writeLevelDat(t *testing.T, path string, dayTime int64) {
+	t.Helper()
+	b := &nbtBuilder{}
+	b.tag(nbt.TagCompound, "")
+	b.tag(nbt.TagCompound, "Data")
+	b.tag(nbt.TagLong, "Time").be(int64(19_500_123))
+	b.tag(nbt.TagLong, "DayTime").be(dayTime)
+	b.tag(nbt.TagByte, "raining").be(int8(1))
+	b.tag(nbt.TagByte, "Difficulty").be(int8(3))
+	b.tag(nbt.TagLong, "LastPlayed").be(int64(1_700_000_000_000))
+	b.tag(nbt.TagCompound, "Version")
+	b.tag(nbt.TagString, "Name").str("1.21.10")
+	b.end() // Version
+	b.end() // Data
+	b.end() // root
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write(b.Bytes())
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+}
+
+func TestReadWorldInfo(t *testing.T) {
+	snapshot := t.TempDir()
+	// Day 812, 13000 ticks into the day
+	writeLevelDat(t, filepath.Join(snapshot, "worlds", "world", "level.dat"), 812*24000+13000)
+
+	path, err := FindLevelDat(snapshot, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, err := ReadWorldInfo(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := info.Summary(), "Day 812, Minecraft 1.21.10"; got != want {
+		t.Fatalf("unexpected summary: want %q, got %q", want, got)
+	}
+	if got, want := info.TimeOfDay(), "19:00"; got != want {
+		t.Fatalf("unexpected time of day: want %q, got %q", want, got)
+	}
+	if info.Weather != "rain" || info.Difficulty != "hard" || info.GameTime != 19_500_123 {
+		t.Fatalf("unexpected world info: %+v", info)
+	}
+	if !info.LastPlayed.Equal(time.UnixMilli(1_700_000_000_000)) {
+		t.Fatalf("unexpected last played time: %v", info.LastPlayed)
+	}
+	metadata := info.S3Metadata()
+	if metadata["minecraft-version"] != "1.21.10" || metadata["day"] != "812" || metadata["last-played"] != "2023-11-14T22:13:20Z" {
+		t.Fatalf("unexpected metadata: %v", metadata)
+	}
+
+	if _, err := FindLevelDat(t.TempDir(), ""); err == nil {
+		t.Fatalf("expected an error without level.dat")
+	}
+	if readSnapshotWorld(snapshot, "missing/level.dat") != nil {
+		t.Fatalf("expected no world info from a missing configured level.dat")
+	}
+}